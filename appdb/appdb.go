@@ -1,68 +1,97 @@
 // Copyright 2011 Teppo Salonen. All rights reserved.
 // This file is part of ArBit and distributed under the terms of the MIT/X11 license.
 
-// Package appdb implements basic functions for storing and retrieving data from Google App Engine's datastore.
+// Package appdb implements basic functions for storing and retrieving data from a pluggable storage backend,
+// such as Google App Engine's datastore (see package gae), or the in-memory and on-disk stores used by the standalone daemon.
 package appdb
 
-// TODO: |filterStr| and |filterVal| not used in |Query|
-
 import (
-	"appengine"
-	"appengine/datastore"
 	"os"
 )
 
+// ErrNoSuchEntity is returned when no entity was found for the given key.
+var ErrNoSuchEntity = os.NewError("appdb: no such entity")
+
+// Error is an error of a storage operation, with the operation and the kind of the entities it was done on.
+type Error struct {
+	Op   string // E.g. "put"
+	Kind string
+	Err  os.Error
+}
+
+func (e *Error) String() string {
+	return "appdb: " + e.Op + " " + e.Kind + ": " + e.Err.String()
+}
+
+// wrap adds the operation and the kind to |err|, unless it is nil or one of the errors the callers compare against
+// (ErrNoSuchEntity and the errors of the leases).
+func wrap(op string, kind string, err os.Error) os.Error {
+	switch err {
+	case nil, ErrNoSuchEntity, ErrNoTransactions, ErrLeaseHeld, ErrLeaseLost:
+		return err
+	}
+	return &Error{op, kind, err}
+}
+
+// Entity contains the properties of a stored entity by property name.
+type Entity map[string]interface{}
+
+// Store is the interface implemented by the storage backends.
+// An entity is identified by its kind and a unique key, which is either a string (|sKey|) or an integer (|iKey|).
+type Store interface {
+	Put(kind string, sKey string, iKey int64, data interface{}) os.Error
+	Get(kind string, sKey string, iKey int64, data interface{}) os.Error
+	Search(s *Search) (data []Entity, cursor string, err os.Error)
+	Delete(kind string, sKey string, iKey int64) os.Error
+}
+
 type UniqueKeyer interface {
 	UniqueKey() (string, int64)
 }
 
-// Put creates or updates a datastore entity of given kind - the entity is stored in |data| and implements interface |UniqueKeyer|.
-func Put(c appengine.Context, kind string, data UniqueKeyer) (err os.Error) {
+// Put creates or updates an entity of given kind - the entity is stored in |data| and implements interface |UniqueKeyer|.
+func Put(s Store, kind string, data UniqueKeyer) (err os.Error) {
 	stringId, intId := data.UniqueKey()
-	key := datastore.NewKey(c, kind, stringId, intId, nil)
-	_, err = datastore.Put(c, key, data)
+	err = wrap("put", kind, s.Put(kind, stringId, intId, data))
 	return
 }
 
-// KeyPut creates or updates a datastore entity of given kind - the entity is stored in |data| and has a unique key either in |sKey| or in |iKey|.
-func KeyPut(c appengine.Context, kind string, data interface{}, sKey string, iKey int64) (err os.Error) {
-	key := datastore.NewKey(c, kind, sKey, iKey, nil)
-	_, err = datastore.Put(c, key, data)
+// KeyPut creates or updates an entity of given kind - the entity is stored in |data| and has a unique key either in |sKey| or in |iKey|.
+func KeyPut(s Store, kind string, data interface{}, sKey string, iKey int64) (err os.Error) {
+	err = wrap("put", kind, s.Put(kind, sKey, iKey, data))
 	return
 }
 
-// Get retrieves a datastore entity of given kind based on the unique key found in |data|, and stores the entity back to |data|.
-func Get(c appengine.Context, kind string, data UniqueKeyer) (err os.Error) {
+// Get retrieves an entity of given kind based on the unique key found in |data|, and stores the entity back to |data|.
+func Get(s Store, kind string, data UniqueKeyer) (err os.Error) {
 	stringId, intId := data.UniqueKey()
-	key := datastore.NewKey(c, kind, stringId, intId, nil)
-	err = datastore.Get(c, key, data)
+	err = wrap("get", kind, s.Get(kind, stringId, intId, data))
 	return
 }
 
-// KeyGet retrieves a datastore entity of given kind based on the unique key in either |sKey| or |iKey|, and stores the entity to |data|.
-func KeyGet(c appengine.Context, kind string, data interface{}, sKey string, iKey int64) (err os.Error) {
-	key := datastore.NewKey(c, kind, sKey, iKey, nil)
-	err = datastore.Get(c, key, data)
+// KeyGet retrieves an entity of given kind based on the unique key in either |sKey| or |iKey|, and stores the entity to |data|.
+func KeyGet(s Store, kind string, data interface{}, sKey string, iKey int64) (err os.Error) {
+	err = wrap("get", kind, s.Get(kind, sKey, iKey, data))
 	return
 }
 
-// Query retrieves datastore entities of given kind.
-func Query(c appengine.Context, kind string, filterStr string, filterVal interface{},
-order string, offset int, limit int) (data []datastore.Map, err os.Error) {
-	q := datastore.NewQuery(kind)
-	if order != "" {
-		q = q.Order(order)
+// Query retrieves entities of given kind, filtered by |filterStr| and |filterVal| (see Search.Where) unless |filterStr| is empty.
+func Query(s Store, kind string, filterStr string, filterVal interface{},
+order string, offset int, limit int) (data []Entity, err os.Error) {
+	q := NewSearch(kind)
+	if filterStr != "" {
+		q.Where(filterStr, filterVal)
 	}
-	q = q.Offset(offset).Limit(limit)
-	data = make([]datastore.Map, 0)
-	_, err = q.GetAll(c, &data)
+	q.Order = order
+	q.Offset = offset
+	q.Limit = limit
+	data, _, err = q.Run(s)
 	return
 }
 
-// Delete deletes a datastore entity of given kind based on the unique key found in |data|.
-func Delete(c appengine.Context, kind string, data UniqueKeyer) (err os.Error) {
+// Delete deletes an entity of given kind based on the unique key found in |data|.
+func Delete(s Store, kind string, data UniqueKeyer) (err os.Error) {
 	stringId, intId := data.UniqueKey()
-	key := datastore.NewKey(c, kind, stringId, intId, nil)
-	err = datastore.Delete(c, key)
+	err = wrap("delete", kind, s.Delete(kind, stringId, intId))
 	return
 }
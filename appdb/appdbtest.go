@@ -0,0 +1,136 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+type testEntity struct {
+	Date  int64
+	Price float64
+}
+
+// TestStore checks that store |s| (which should be empty) can put, get, query and delete entities.
+func TestStore(s Store) os.Error {
+	for i, d := range []int64{20, 10, 30} {
+		err := KeyPut(s, "Test", &testEntity{d, float64(i)}, "", d)
+		if err != nil {
+			return err
+		}
+	}
+
+	var e testEntity
+	err := KeyGet(s, "Test", &e, "", 10)
+	if err != nil {
+		return err
+	}
+	if e.Date != 10 || e.Price != 1 {
+		return os.NewError(fmt.Sprint("Store.Get<br>=<br>", e, "<br>want<br>", testEntity{10, 1}))
+	}
+
+	data, err := Query(s, "Test", "", nil, "-Date", 0, 2)
+	if err != nil {
+		return err
+	}
+	if len(data) != 2 || fmt.Sprint(data[0]["Date"], data[1]["Date"]) != "30 20" {
+		return os.NewError(fmt.Sprint("Store.Query (-Date, limit 2)<br>=<br>", data))
+	}
+
+	data, err = Query(s, "Test", "Price >", 0, "Date", 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(data) != 2 || fmt.Sprint(data[0]["Date"], data[1]["Date"]) != "10 30" {
+		return os.NewError(fmt.Sprint("Store.Query (Price > 0, Date)<br>=<br>", data))
+	}
+
+	// Time range in pages of one entity
+	q := NewSearch("Test").Between("Date", 10, 30)
+	q.Order = "-Date"
+	q.Limit = 1
+	var dates []interface{}
+	for {
+		data, cursor, err := q.Run(s)
+		if err != nil {
+			return err
+		}
+		for _, e := range data {
+			dates = append(dates, e["Date"])
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if fmt.Sprint(dates...) != "20 10" {
+		return os.NewError(fmt.Sprint("Search.Between (Date 10-30, -Date, limit 1)<br>=<br>", dates))
+	}
+
+	err = s.Delete("Test", "", 10)
+	if err != nil {
+		return err
+	}
+	if s.Get("Test", "", 10, &e) != ErrNoSuchEntity {
+		return os.NewError("Store.Delete: entity still exists after delete")
+	}
+	return nil
+}
+
+// TestFileStore checks FileStore with TestStore in a temporary directory, and that the entities are read back after
+// reopening the store, with the log of a kind often rewritten compacted instead of growing with every Put.
+func TestFileStore() os.Error {
+	dir, err := ioutil.TempDir("", "appdbtest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	savedSlack := compactSlack
+	compactSlack = 1000
+	defer func() { compactSlack = savedSlack }()
+
+	f, err := OpenFileStore(dir)
+	if err != nil {
+		return err
+	}
+	err = TestStore(f)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 500; i++ {
+		err = f.Put("Counter", "n", 0, &testEntity{int64(i), 0})
+		if err != nil {
+			return err
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dir, "Counter.log"))
+	if err != nil {
+		return err
+	}
+	if fi.Size > 3000 {
+		return os.NewError(fmt.Sprint("FileStore: log of a single entity grown to ", fi.Size, " bytes after 500 puts"))
+	}
+	f.Close()
+
+	f, err = OpenFileStore(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var e testEntity
+	err = f.Get("Counter", "n", 0, &e)
+	if err != nil {
+		return err
+	}
+	if e.Date != 499 {
+		return os.NewError(fmt.Sprint("FileStore reopened: Get<br>=<br>", e, "<br>want<br>", testEntity{499, 0}))
+	}
+	if f.Get("Test", "", 10, &e) != ErrNoSuchEntity || f.Get("Test", "", 30, &e) != nil {
+		return os.NewError("FileStore reopened: deleted entity found or stored entity missing")
+	}
+	return nil
+}
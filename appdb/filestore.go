@@ -0,0 +1,291 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore is a Store keeping the entities on disk in an append-only log per kind (e.g. "Ticker_MtGox.log"), with a line
+// of JSON for each Put and Delete. All entities are also kept in memory. A log is compacted (rewritten with only the current
+// entities of its kind) when the store is opened, and when it has grown to twice its compacted size (plus compactSlack),
+// so storing an entity takes the same time however many entities of its kind there are.
+type FileStore struct {
+	MemStore
+	dir  string
+	fmu  sync.Mutex          // Serializes the changes, so that they are logged in the order they were made
+	logs map[string]*kindLog // By kind
+}
+
+// compactSlack is the number of bytes a log may grow by before it is compacted, in addition to its compacted size.
+var compactSlack int64 = 1 << 20
+
+// kindLog is the log of a kind, open for appending.
+type kindLog struct {
+	file      *os.File
+	size      int64
+	compacted int64 // Size after the last compaction
+}
+
+// kindFile is the contents of a file storing the entities of a single kind (e.g. "Ticker_MtGox.json"), which was written
+// by the earlier versions of FileStore. Such a file is replaced by a log when the store is opened.
+type kindFile struct {
+	Entities []fileEntity
+}
+
+// fileEntity is a line of a log: an entity stored by Put, or the key of an entity removed by Delete.
+type fileEntity struct {
+	Key     string
+	Seq     int64
+	Data    string // JSON encoded entity
+	Deleted bool
+}
+
+// OpenFileStore opens the FileStore in directory |dir|, creating the directory if it does not exist yet.
+func OpenFileStore(dir string) (f *FileStore, err os.Error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	f = &FileStore{dir: dir, logs: make(map[string]*kindLog)}
+	f.entities = make(map[string]*record)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	kinds := make(map[string]bool)
+	for _, fi := range files {
+		if ext := filepath.Ext(fi.Name); fi.IsRegular() && (ext == ".json" || ext == ".log") {
+			kinds[fi.Name[:len(fi.Name)-len(ext)]] = true
+		}
+	}
+	for kind, _ := range kinds {
+		path := filepath.Join(dir, kind)
+		old, err := f.loadFile(kind, path+".json")
+		if err != nil {
+			return nil, err
+		}
+		if err = f.loadLog(kind, path+".log"); err != nil {
+			return nil, err
+		}
+		if err = f.compact(kind); err != nil {
+			return nil, err
+		}
+		if old {
+			if err = os.Remove(path + ".json"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// loadFile reads the entities of |kind| from the file of an earlier version at |path|, telling whether there was one.
+func (f *FileStore) loadFile(kind string, path string) (bool, os.Error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return true, err
+	}
+	var kf kindFile
+	err = json.Unmarshal(b, &kf)
+	if err != nil {
+		return true, os.NewError("appdb: " + path + ": " + err.String())
+	}
+	for _, e := range kf.Entities {
+		f.apply(kind, e)
+	}
+	return true, nil
+}
+
+// loadLog replays the changes to the entities of |kind| from the log at |path|, if there is one.
+// An incomplete last line (being written when the process stopped) is ignored.
+func (f *FileStore) loadLog(kind string, path string) os.Error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		if err == os.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e fileEntity
+		err = json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			return os.NewError("appdb: " + path + ": " + err.String())
+		}
+		f.apply(kind, e)
+	}
+	panic("unreachable")
+}
+
+func (f *FileStore) apply(kind string, e fileEntity) {
+	if e.Deleted {
+		f.entities[e.Key] = nil, false
+		return
+	}
+	f.entities[e.Key] = &record{kind, e.Seq, []byte(e.Data)}
+	if e.Seq > f.seq {
+		f.seq = e.Seq
+	}
+}
+
+func logLine(e fileEntity) ([]byte, os.Error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// compact rewrites the log of |kind| with only the current entities of the kind, and opens it for appending.
+// The new log is written next to the old one and then renamed over it, so a crash in the middle of writing never
+// leaves a partially written log behind. The caller must hold fmu (unless the store is being opened).
+func (f *FileStore) compact(kind string) os.Error {
+	var rs records
+	keys := make(map[*record]string)
+	f.mu.RLock()
+	for key, r := range f.entities {
+		if r.kind == kind {
+			rs = append(rs, r)
+			keys[r] = key
+		}
+	}
+	f.mu.RUnlock()
+	sort.Sort(rs)
+
+	var buf bytes.Buffer
+	for _, r := range rs {
+		b, err := logLine(fileEntity{keys[r], r.seq, string(r.data), false})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	if l := f.logs[kind]; l != nil {
+		l.file.Close()
+		f.logs[kind] = nil, false
+	}
+	path := filepath.Join(f.dir, kind+".log")
+	err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	f.logs[kind] = &kindLog{file, int64(buf.Len()), int64(buf.Len())}
+	return nil
+}
+
+// logChange appends change |e| to the log of |kind|, compacting the log if it has grown enough. The log of a new kind
+// is created by compacting it, which writes the change too. The caller must hold fmu.
+func (f *FileStore) logChange(kind string, e fileEntity) os.Error {
+	l := f.logs[kind]
+	if l == nil {
+		return f.compact(kind)
+	}
+	b, err := logLine(e)
+	if err != nil {
+		return err
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if l.size > 2*l.compacted+compactSlack {
+		return f.compact(kind)
+	}
+	return nil
+}
+
+// Close closes the log files. The store must not be used afterwards.
+func (f *FileStore) Close() os.Error {
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+	var err os.Error
+	for kind, l := range f.logs {
+		if cerr := l.file.Close(); cerr != nil {
+			err = cerr
+		}
+		f.logs[kind] = nil, false
+	}
+	return err
+}
+
+func checkKind(kind string) os.Error {
+	if kind == "" || strings.IndexAny(kind, `/\.`) >= 0 {
+		return os.NewError("appdb: invalid kind for FileStore: " + kind)
+	}
+	return nil
+}
+
+// Put stores |data| under the given key and appends it to the log of the kind.
+func (f *FileStore) Put(kind string, sKey string, iKey int64, data interface{}) os.Error {
+	err := checkKind(kind)
+	if err != nil {
+		return err
+	}
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+	err = f.MemStore.Put(kind, sKey, iKey, data)
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	if sKey == "" && iKey == 0 {
+		iKey = f.seq // Allocated by MemStore.Put
+	}
+	key := entityKey(kind, sKey, iKey)
+	r := f.entities[key]
+	f.mu.RUnlock()
+	return f.logChange(kind, fileEntity{key, r.seq, string(r.data), false})
+}
+
+// Delete deletes the entity with the given key and appends the deletion to the log of the kind.
+func (f *FileStore) Delete(kind string, sKey string, iKey int64) os.Error {
+	err := checkKind(kind)
+	if err != nil {
+		return err
+	}
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+	err = f.MemStore.Delete(kind, sKey, iKey)
+	if err != nil {
+		return err
+	}
+	return f.logChange(kind, fileEntity{Key: entityKey(kind, sKey, iKey), Deleted: true})
+}
+
+// RunInTransaction runs |f| while no other transaction is running (see MemStore.RunInTransaction).
+func (f *FileStore) RunInTransaction(fn func(tx Store) os.Error) os.Error {
+	f.txMu.Lock()
+	defer f.txMu.Unlock()
+	return fn(f)
+}
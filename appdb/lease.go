@@ -0,0 +1,133 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"os"
+	"time"
+)
+
+// Transactor is implemented by the stores that can run a series of operations atomically (MemStore, FileStore and
+// the datastore of package gae).
+type Transactor interface {
+	// RunInTransaction runs |f| with store |tx|, so that no other transaction sees or changes the entities in between.
+	// A store may return ErrConcurrentTransaction if another transaction changed the same entities at the same time.
+	RunInTransaction(f func(tx Store) os.Error) os.Error
+}
+
+// ErrConcurrentTransaction is returned by RunInTransaction when the transaction collided with another one.
+var ErrConcurrentTransaction = os.NewError("appdb: concurrent transaction")
+
+// ErrNoTransactions is returned by the lease functions for stores that don't implement Transactor.
+var ErrNoTransactions = os.NewError("appdb: store does not support transactions")
+
+// ErrLeaseHeld is returned by AcquireLease when the lease is held by someone else.
+var ErrLeaseHeld = os.NewError("appdb: lease is held by another holder")
+
+// ErrLeaseLost is returned when a lease has expired or has been taken over by someone else.
+var ErrLeaseLost = os.NewError("appdb: lease has expired or been taken over")
+
+// LeaseKind is the kind of the entities storing the leases.
+const LeaseKind = "Lease"
+
+// Lease is a lock held for a limited time, so that a holder that dies (or hangs) cannot keep it forever.
+// The token is incremented each time the lease is acquired. It works as a fencing token: a holder whose lease has expired
+// can tell that someone else has taken the lease since (see Check), even if the lease has been released again.
+type Lease struct {
+	Name    string
+	Holder  string // Empty when released
+	Token   int64
+	Expires int64 // Time the lease expires in nanoseconds (see time.Nanoseconds)
+}
+
+// transact runs |f| in a transaction of store |s|.
+func transact(s Store, f func(tx Store) os.Error) os.Error {
+	t, ok := s.(Transactor)
+	if !ok {
+		return ErrNoTransactions
+	}
+	return t.RunInTransaction(f)
+}
+
+// AcquireLease takes lease |name| for |holder| for |duration| nanoseconds, unless someone else holds it (and it has not expired),
+// in which case the current lease is returned with ErrLeaseHeld. Trying to take the lease at the same time with someone
+// else is reported as ErrLeaseHeld too (with a nil lease, since the other holder is not known).
+func AcquireLease(s Store, name string, holder string, duration int64) (l *Lease, err os.Error) {
+	err = transact(s, func(tx Store) os.Error {
+		l = &Lease{Name: name}
+		err := tx.Get(LeaseKind, name, 0, l)
+		if err != nil && err != ErrNoSuchEntity {
+			return err
+		}
+		now := time.Nanoseconds()
+		if l.Holder != "" && l.Expires > now {
+			return ErrLeaseHeld
+		}
+		l.Holder, l.Token, l.Expires = holder, l.Token+1, now+duration
+		return tx.Put(LeaseKind, name, 0, l)
+	})
+	if err == ErrConcurrentTransaction {
+		l, err = nil, ErrLeaseHeld
+	}
+	err = wrap("lease", LeaseKind, err)
+	return
+}
+
+// Check returns ErrLeaseLost unless lease |l| is still held with the same token and has not expired.
+// It is called before each action that must not be done by two holders at the same time.
+func (l *Lease) Check(s Store) os.Error {
+	var cur Lease
+	err := s.Get(LeaseKind, l.Name, 0, &cur)
+	if err == ErrNoSuchEntity || err == nil && !l.same(&cur) {
+		return ErrLeaseLost
+	}
+	return wrap("get", LeaseKind, err)
+}
+
+// Renew extends lease |l| to expire |duration| nanoseconds from now. ErrLeaseLost is returned if it has expired already.
+func (l *Lease) Renew(s Store, duration int64) os.Error {
+	return l.update(s, func(cur *Lease) {
+		cur.Expires = time.Nanoseconds() + duration
+	})
+}
+
+// Release releases lease |l|, unless it has been taken over by someone else already (in which case nothing is done).
+func (l *Lease) Release(s Store) os.Error {
+	err := l.update(s, func(cur *Lease) {
+		cur.Holder, cur.Expires = "", 0
+	})
+	if err == ErrLeaseLost {
+		return nil
+	}
+	return err
+}
+
+// update changes lease |l| with |f| in a transaction, if the lease is still held by the holder of |l|.
+func (l *Lease) update(s Store, f func(cur *Lease)) os.Error {
+	err := transact(s, func(tx Store) os.Error {
+		var cur Lease
+		err := tx.Get(LeaseKind, l.Name, 0, &cur)
+		if err == ErrNoSuchEntity || err == nil && !l.same(&cur) {
+			return ErrLeaseLost
+		}
+		if err != nil {
+			return err
+		}
+		f(&cur)
+		err = tx.Put(LeaseKind, l.Name, 0, &cur)
+		if err == nil {
+			*l = cur
+		}
+		return err
+	})
+	if err == ErrConcurrentTransaction {
+		err = ErrLeaseLost
+	}
+	return wrap("lease", LeaseKind, err)
+}
+
+// same tells whether |cur| is the same lease as |l|, still held and not expired.
+func (l *Lease) same(cur *Lease) bool {
+	return cur.Token == l.Token && cur.Holder != "" && cur.Expires > time.Nanoseconds()
+}
@@ -0,0 +1,73 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"os"
+	"fmt"
+	"time"
+)
+
+// TestLease checks that a lease in store |s| (which should be empty) is held by one holder at a time, and that the fencing
+// token tells an expired holder that the lease has been taken over.
+func TestLease(s Store) os.Error {
+	a, err := AcquireLease(s, "Test", "a", 50e6)
+	if err != nil {
+		return err
+	}
+	if a.Holder != "a" || a.Token != 1 {
+		return os.NewError(fmt.Sprint("AcquireLease<br>=<br>", *a, "<br>want holder a with token 1"))
+	}
+	b, err := AcquireLease(s, "Test", "b", 50e6)
+	if err != ErrLeaseHeld || b.Holder != "a" {
+		return os.NewError(fmt.Sprint("AcquireLease of a held lease<br>=<br>", b, ", ", err, "<br>want the lease of a and ", ErrLeaseHeld))
+	}
+	if err = a.Check(s); err != nil {
+		return err
+	}
+
+	// The lease of a expires, and b takes it over
+	time.Sleep(60e6)
+	if err = a.Check(s); err != ErrLeaseLost {
+		return os.NewError(fmt.Sprint("Lease.Check after expiry = ", err, ", want ", ErrLeaseLost))
+	}
+	b, err = AcquireLease(s, "Test", "b", 10e9)
+	if err != nil {
+		return err
+	}
+	if b.Token != 2 {
+		return os.NewError(fmt.Sprint("AcquireLease after expiry: token ", b.Token, ", want 2"))
+	}
+	if err = a.Renew(s, 10e9); err != ErrLeaseLost {
+		return os.NewError(fmt.Sprint("Lease.Renew of a lease taken over = ", err, ", want ", ErrLeaseLost))
+	}
+	if err = a.Release(s); err != nil {
+		return err
+	}
+	if err = b.Check(s); err != nil {
+		return os.NewError("Lease.Check after an expired holder released the lease: " + err.String())
+	}
+
+	// After b releases the lease, it is free again (with a new token)
+	if err = b.Release(s); err != nil {
+		return err
+	}
+	if err = b.Check(s); err != ErrLeaseLost {
+		return os.NewError(fmt.Sprint("Lease.Check after release = ", err, ", want ", ErrLeaseLost))
+	}
+	c, err := AcquireLease(s, "Test", "c", 10e9)
+	if err != nil {
+		return err
+	}
+	if c.Token != 3 {
+		return os.NewError(fmt.Sprint("AcquireLease after release: token ", c.Token, ", want 3"))
+	}
+
+	// Leases need transactions
+	_, err = AcquireLease(struct{ Store }{s}, "Test", "d", 10e9)
+	if err != ErrNoTransactions {
+		return os.NewError(fmt.Sprint("AcquireLease without transactions = ", err, ", want ", ErrNoTransactions))
+	}
+	return nil
+}
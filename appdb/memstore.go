@@ -0,0 +1,282 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"encoding/base64"
+	"json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemStore is a Store keeping all entities in memory (used by the standalone daemon when no other storage is configured).
+// The entities are kept JSON encoded, so Get and Query return copies of the data just like the datastore does.
+type MemStore struct {
+	mu       sync.RWMutex
+	txMu     sync.Mutex         // Held by the transaction in progress (see RunInTransaction)
+	entities map[string]*record // By entity key (see entityKey)
+	seq      int64              // Incremented on every Put, to keep the entities in the order they were stored
+}
+
+type record struct {
+	kind string
+	seq  int64
+	data []byte // JSON encoded entity
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{entities: make(map[string]*record)}
+}
+
+func entityKey(kind string, sKey string, iKey int64) string {
+	if sKey != "" {
+		return kind + "/" + sKey
+	}
+	return kind + "#" + strconv.Itoa64(iKey)
+}
+
+// Put stores |data| under the given key. If both |sKey| and |iKey| are empty, a new unique integer key is allocated.
+func (m *MemStore) Put(kind string, sKey string, iKey int64, data interface{}) os.Error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	if sKey == "" && iKey == 0 {
+		iKey = m.seq
+	}
+	m.entities[entityKey(kind, sKey, iKey)] = &record{kind, m.seq, b}
+	return nil
+}
+
+// Get retrieves the entity with the given key and stores it to |data|.
+func (m *MemStore) Get(kind string, sKey string, iKey int64, data interface{}) os.Error {
+	m.mu.RLock()
+	r, ok := m.entities[entityKey(kind, sKey, iKey)]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return json.Unmarshal(r.data, data)
+}
+
+// Search retrieves the entities matching search |q|. Entities with equal values of the sorted property
+// are returned in the order they were stored in, which also makes the cursors stable between searches.
+func (m *MemStore) Search(q *Search) (data []Entity, cursor string, err os.Error) {
+	m.mu.RLock()
+	var rs records
+	for _, r := range m.entities {
+		if r.kind == q.Kind {
+			rs = append(rs, r)
+		}
+	}
+	m.mu.RUnlock()
+
+	filters := make([]Filter, len(q.Filters))
+	for i, f := range q.Filters {
+		filters[i] = f
+		filters[i].Value, err = normalize(f.Value)
+		if err != nil {
+			return
+		}
+	}
+	property, desc := strings.TrimLeft(q.Order, "-"), strings.HasPrefix(q.Order, "-")
+
+	var found items
+	for _, r := range rs {
+		var e Entity
+		err = json.Unmarshal(r.data, &e)
+		if err != nil {
+			return
+		}
+		ok := true
+		for _, f := range filters {
+			if !match(f.Operator, compare(e[f.Property], f.Value)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			found.list = append(found.list, item{e, e[property], r.seq})
+		}
+	}
+	found.desc = desc
+	sort.Sort(&found)
+
+	list := found.list
+	if q.Cursor != "" {
+		var c item
+		c.value, c.seq, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return
+		}
+		i := 0
+		for i < len(list) && !found.before(c, list[i]) {
+			i++
+		}
+		list = list[i:]
+	}
+	if q.Offset >= len(list) {
+		list = list[:0]
+	} else {
+		list = list[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit <= len(list) {
+		list = list[:q.Limit]
+		if len(list) > 0 {
+			last := list[len(list)-1]
+			cursor, err = encodeCursor(last.value, last.seq)
+		}
+	}
+
+	data = make([]Entity, len(list))
+	for i, it := range list {
+		data[i] = it.entity
+	}
+	return
+}
+
+// Delete deletes the entity with the given key.
+func (m *MemStore) Delete(kind string, sKey string, iKey int64) os.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entities[entityKey(kind, sKey, iKey)] = nil, false
+	return nil
+}
+
+// RunInTransaction runs |f| while no other transaction is running. The changes made by |f| are not undone if it fails,
+// so |f| should only change the entities after all its checks have passed (as the lease functions do).
+func (m *MemStore) RunInTransaction(f func(tx Store) os.Error) os.Error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	return f(m)
+}
+
+type records []*record
+
+func (r records) Len() int           { return len(r) }
+func (r records) Less(i, j int) bool { return r[i].seq < r[j].seq }
+func (r records) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// item is an entity found by a search, with the value of the property the results are sorted by.
+type item struct {
+	entity Entity
+	value  interface{}
+	seq    int64
+}
+
+type items struct {
+	list []item
+	desc bool
+}
+
+// before tells whether item |a| comes before item |b| in the sort order.
+func (s *items) before(a item, b item) bool {
+	c := compare(a.value, b.value)
+	if s.desc {
+		c = -c
+	}
+	if c == 0 {
+		return a.seq < b.seq
+	}
+	return c < 0
+}
+
+func (s *items) Len() int           { return len(s.list) }
+func (s *items) Less(i, j int) bool { return s.before(s.list[i], s.list[j]) }
+func (s *items) Swap(i, j int)      { s.list[i], s.list[j] = s.list[j], s.list[i] }
+
+// normalize converts a filter value to the same type its JSON encoded counterpart in an entity would have (e.g. int64 to float64).
+func normalize(v interface{}) (n interface{}, err os.Error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &n)
+	return
+}
+
+type memCursor struct {
+	Value interface{}
+	Seq   int64
+}
+
+func encodeCursor(value interface{}, seq int64) (string, os.Error) {
+	b, err := json.Marshal(memCursor{value, seq})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string) (value interface{}, seq int64, err os.Error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return
+	}
+	var c memCursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		err = os.NewError("appdb: invalid cursor")
+		return
+	}
+	return c.Value, c.Seq, nil
+}
+
+// compare returns -1, 0 or +1 depending on whether |a| is less than, equal to, or greater than |b|.
+// Values of different types are ordered by type: nil < bool < number < string.
+func compare(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	switch {
+	case ra < rb:
+		return -1
+	case ra > rb:
+		return 1
+	}
+	switch x := a.(type) {
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	case float64:
+		y := b.(float64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	case string:
+		y := b.(string)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4 // Objects and arrays are not ordered
+}
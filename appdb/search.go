@@ -0,0 +1,86 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package appdb
+
+import (
+	"os"
+	"strings"
+)
+
+// Filter is a condition on the value of an entity property, e.g. Filter{"Date", ">=", 1317427200}.
+type Filter struct {
+	Property string
+	Operator string // One of "=", "<", "<=", ">" or ">="
+	Value    interface{}
+}
+
+// Search describes a query for entities of a single kind. All filters must match for an entity to be returned.
+// Note that the datastore supports inequality filters (and sorting after them) on a single property only.
+type Search struct {
+	Kind    string
+	Filters []Filter
+	Order   string // Property to sort the entities by ("-" prefix for descending order)
+	Offset  int    // Number of entities to skip
+	Limit   int    // Maximum number of entities to return (zero for no limit)
+	Cursor  string // Continue after the last entity returned by a previous search (see Run)
+}
+
+// NewSearch returns a Search for all entities of given kind.
+func NewSearch(kind string) *Search {
+	return &Search{Kind: kind}
+}
+
+// Where adds a filter to the search. Like with the datastore, |filterStr| is a property name followed by an operator,
+// e.g. "Date >=" or "Amount >". The operator defaults to "=" if only the property name is given.
+func (s *Search) Where(filterStr string, filterVal interface{}) *Search {
+	f := strings.Fields(filterStr)
+	switch len(f) {
+	case 1:
+		s.Filters = append(s.Filters, Filter{f[0], "=", filterVal})
+	case 2:
+		s.Filters = append(s.Filters, Filter{f[0], f[1], filterVal})
+	default:
+		s.Filters = append(s.Filters, Filter{filterStr, "", filterVal}) // Reported as invalid by Run
+	}
+	return s
+}
+
+// Between limits the search to entities where |property| is at least |from| but less than |to| (e.g. a time range on "Date").
+func (s *Search) Between(property string, from interface{}, to interface{}) *Search {
+	s.Filters = append(s.Filters, Filter{property, ">=", from}, Filter{property, "<", to})
+	return s
+}
+
+// Run executes the search in store |st|. If there may be more entities than the limit allowed to return,
+// |cursor| is set to a value that can be used as the Cursor of the next search to get the next page of entities.
+func (s *Search) Run(st Store) (data []Entity, cursor string, err os.Error) {
+	for _, f := range s.Filters {
+		switch f.Operator {
+		case "=", "<", "<=", ">", ">=":
+		default:
+			err = os.NewError("appdb: invalid filter: " + f.Property + " " + f.Operator)
+			return
+		}
+	}
+	data, cursor, err = st.Search(s)
+	err = wrap("search", s.Kind, err)
+	return
+}
+
+// match tells whether the result of compare(a, b) satisfies the operator.
+func match(operator string, c int) bool {
+	switch operator {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
@@ -6,43 +6,48 @@ package arbit
 
 // TODO: Send out an email with the arbitrage strategy executed?
 // TODO: Show the list of executed trades and calculated strategies in the dashboard (current dahsboard is pretty useless)
-// TODO: Replace hardcoded 500ms delays between API calls with exchange specific sleep times (100ms for TradeHill, 500ms for CampBX, etc)
 // TODO: Improve debugging, logging, and add more data to the dashboard
 
 import (
 	"os"
+	"io"
 	"fmt"
 	"http"
 	"xgen"
-	"mtgox"
-	"tradehill"
-	//	"campbx"
 	"appdb"
 	"arbitrage"
+	"nonce"
+	"mtgox"
+	"tradehill"
+	"campbx"
+	"restapi"
+	"secrets"
+	"simex"
+	"faults"
+	"stream"
+	"strconv"
 	"time"
-	"appengine"
-	"appengine/datastore"
 )
 
-// Bitcoin exchanges to be used for arbitrage
-const (
-	mtGox = iota
-	tradeHill
-	//	campBx
-	//	bitcoinica
+// Bitcoin exchanges to be used for arbitrage are registered with xgen.Register by Configure (see settings.go)
 
-	numExchanges
-)
+var pair = xgen.BTCUSD // Trading pair to arbitrage (only the exchanges supporting it are used)
 
-var exchangeName = [numExchanges]string{"MtGox", "TradeHill" /*, "CampBX", "Bitcoinica"*/ }
+var commission = make(map[string]xgen.Decimal) // Commission per trade (by exchange name)
+var minTrade = make(map[string]xgen.Balance)   // Minimum transaction size (by exchange name by currency)
+var timeout int64 = 30e9                       // Time allowed for fetching the data of a run in nanoseconds (calls not finished by then are skipped)
+var history int64 = 10000                      // Number of the latest timings and skipped runs kept in the datastore (see keep)
 
-var login [numExchanges]xgen.Credentials
+var debounce int64 = 100e6              // Nanoseconds the engine waits for more order book changes before evaluating (see Engine)
+var minInterval int64 = 1e9             // Minimum nanoseconds between the evaluations of the engine
+var pollInterval int64 = 10e9           // Nanoseconds between polling the order books of the exchanges without a stream
+var maxBookAge int64 = 60e9             // Nanoseconds an order book is used for by the engine after it was received (see Engine)
+var streamURL = make(map[string]string) // URL of the market data stream (by exchange name), see package stream
 
-var commission [numExchanges]float64                   // Commission per trade (by exchange)
-var minTrade [numExchanges][xgen.NumCurrencies]float64 // Minimum transaction size (by exchange by currency)
+var onesidedArb bool // Take one side of an arbitrage even if not enough funds on the other account (used for balancing the currencies of the pair within the account)
 
-var onesidedArb bool // Take one side of an arbitrage even if not enough funds on the other account (used for balancing USD and BTC within the account)
-var paperTrade bool  // In Paper Trade mode trades will not be executed
+// NewContext returns the context for handling request |r|. It is set by the platform ArBit runs on (see package gae and cmd/arbitd).
+var NewContext func(r *http.Request) xgen.Context
 
 func init() {
 	http.HandleFunc("/cron/", errorHandlerLog(cronjob))
@@ -50,221 +55,434 @@ func init() {
 	http.HandleFunc("/testing/", errorHandlerWeb(unittests))
 }
 
-func errorHandlerLog(fn http.HandlerFunc) http.HandlerFunc {
+// handler is an HTTP handler that returns its error, to be reported by errorHandlerLog or errorHandlerWeb.
+type handler func(w http.ResponseWriter, r *http.Request) os.Error
+
+// panicError converts a recovered panic value to an error (any value can be passed to panic, not only an os.Error).
+func panicError(v interface{}) os.Error {
+	if e, ok := v.(os.Error); ok {
+		return os.NewError("panic: " + e.String())
+	}
+	return os.NewError(fmt.Sprint("panic: ", v))
+}
+
+// errorHandlerLog writes the error returned by |fn| (or the panic of a bug) to the log.
+func errorHandlerLog(fn handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			if e, ok := recover().(os.Error); ok {
-				c := appengine.NewContext(r)
-				c.Criticalf(e.String())
+			if v := recover(); v != nil {
+				NewContext(r).Criticalf("%s", panicError(v))
 			}
 		}()
-		fn(w, r)
+		if err := fn(w, r); err != nil {
+			NewContext(r).Criticalf("%s", err)
+		}
 	}
 }
 
-func errorHandlerWeb(fn http.HandlerFunc) http.HandlerFunc {
+// errorHandlerWeb reports the error returned by |fn| (or the panic of a bug) in the response.
+func errorHandlerWeb(fn handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			if e, ok := recover().(os.Error); ok {
+			if v := recover(); v != nil {
 				w.WriteHeader(500)
-				fmt.Fprintln(w, e)
+				fmt.Fprintln(w, panicError(v))
 			}
 		}()
-		fn(w, r)
+		if err := fn(w, r); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+		}
+	}
+}
+
+func dashboard(w http.ResponseWriter, r *http.Request) os.Error { // Simple monitoring dashboard
+	c := NewContext(r)
+
+	fmt.Fprintln(w, "<h3>", pair, "</h3><table>")
+	fmt.Fprintln(w, "<tr><th>Exchange</th><th>Updated</th><th>Highest Buy</th><th>Lowest Sell</th><th>Last Trade</th></tr>")
+
+	// Read ticker data from datastore
+	for _, x := range exchanges() {
+		ticker, _ := appdb.Query(c.Store(), "Ticker_"+x.Name(), "", nil, "-Date", 0, 1) // Get the last ticker only
+		if len(ticker) == 0 {
+			continue
+		}
+		fmt.Fprintln(w, "<tr><td>", x.Name(), "</td><td>", time.SecondsToLocalTime(seconds(ticker[0]["Date"])),
+			"</td><td>", amount(ticker[0]["HighestBuy"]), "</td><td>", amount(ticker[0]["LowestSell"]), "</td><td>", amount(ticker[0]["Last"]), "</td></tr>")
 	}
+	fmt.Fprintln(w, "</table>")
+
+	// Ticker history of a single exchange, e.g. /dashboard/?exchange=MtGox&from=1317427200&to=1317513600
+	if name := r.FormValue("exchange"); name != "" {
+		return tickerHistory(w, r, c, name)
+	}
+	return nil
 }
 
-func check(err os.Error) {
+func tickerHistory(w http.ResponseWriter, r *http.Request, c xgen.Context, name string) os.Error {
+	from, _ := strconv.Atoi64(r.FormValue("from"))
+	to, err := strconv.Atoi64(r.FormValue("to"))
 	if err != nil {
-		panic(err)
+		to = time.Seconds()
 	}
+	s := appdb.NewSearch("Ticker_"+name).Between("Date", from, to)
+	s.Order = "Date"
+	s.Limit = 100
+	s.Cursor = r.FormValue("cursor")
+	ticker, cursor, err := s.Run(c.Store())
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "<h3>", name, pair, "</h3><table>")
+	fmt.Fprintln(w, "<tr><th>Updated</th><th>Highest Buy</th><th>Lowest Sell</th><th>Last Trade</th></tr>")
+	for _, t := range ticker {
+		fmt.Fprintln(w, "<tr><td>", time.SecondsToLocalTime(seconds(t["Date"])),
+			"</td><td>", amount(t["HighestBuy"]), "</td><td>", amount(t["LowestSell"]), "</td><td>", amount(t["Last"]), "</td></tr>")
+	}
+	fmt.Fprintln(w, "</table>")
+	if cursor != "" {
+		fmt.Fprintf(w, "<a href=\"?exchange=%s&from=%d&to=%d&cursor=%s\">Next</a>\n", http.URLEscape(name), from, to, http.URLEscape(cursor))
+	}
+	return nil
 }
 
-func dashboard(w http.ResponseWriter, r *http.Request) { // Simple monitoring dashboard
-	//var err os.Error
-	c := appengine.NewContext(r)
+// ticker is the quote of an exchange as stored in the datastore (which doesn't support nested structs such as xgen.Pair).
+type ticker struct {
+	Date       int64
+	Pair       string
+	HighestBuy xgen.Decimal
+	LowestSell xgen.Decimal
+	Last       xgen.Decimal
+}
 
-	fmt.Fprintln(w, "<table>")
-	fmt.Fprintln(w, "<tr><th>Exchange</th><th>Updated</th><th>Highest Buy</th><th>Lowest Sell</th><th>Last Trade</th></tr>")
+// exchanges returns the registered exchanges that support the trading pair.
+func exchanges() (x []xgen.Exchange) {
+	for _, e := range xgen.Exchanges() {
+		if xgen.Supports(e, pair) {
+			x = append(x, e)
+		}
+	}
+	return
+}
 
-	// Read ticker data from datastore
-	var ticker [numExchanges][]datastore.Map
-	for i := int8(0); i < numExchanges; i++ {
-		ticker[i], _ = appdb.Query(c, "Ticker_"+exchangeName[i], "", nil, "-Date", 0, 1) // Get the last ticker only
-		fmt.Fprintln(w, "<tr><td>", exchangeName[i], "</td><td>", time.SecondsToLocalTime(int64(ticker[i][0]["Date"].(datastore.Time))/1e6),
-			"</td><td>", ticker[i][0]["HighestBuy"], "</td><td>", ticker[i][0]["LowestSell"], "</td><td>", ticker[i][0]["Last"], "</td></tr>")
+// seconds converts a Unix timestamp read from the storage to int64 (the datastore returns int64, but JSON based stores float64).
+func seconds(v interface{}) int64 {
+	switch t := v.(type) {
+	case int64:
+		return t
+	case float64:
+		return int64(t)
 	}
-	fmt.Fprintln(w, "</table>")
+	return 0
+}
+
+// amount formats a monetary value read from the storage (the datastore returns Decimals as int64, but JSON based stores as float64).
+func amount(v interface{}) string {
+	switch t := v.(type) {
+	case int64:
+		return xgen.Decimal(t).String()
+	case float64:
+		return strconv.Ftoa64(t, 'f', -1)
+	}
+	return fmt.Sprint(v)
+}
+
+func cronjob(w http.ResponseWriter, r *http.Request) os.Error { // Main program (to be run as a cron job)
+	c := NewContext(r)
+	g := guard
+	if err := g.tryLock(); err != nil {
+		c.Warningf("Cron job skipped: %s", err)
+		return nil
+	}
+	defer g.unlock()
+	return run(c, w, exchanges())
+}
+
+// RunOnce checks for arbitrage and executes the trades, writing a report of the run to |w|.
+// It is used for running ArBit without the /cron/ handler (e.g. by the Scheduler).
+// ErrRunning is returned if another run is in progress, and ErrShutdown after Shutdown has been called.
+// A panic caused by a bug is returned as an error too, so that it doesn't stop the scheduler.
+func RunOnce(c xgen.Context, w io.Writer) (err os.Error) {
+	g := guard
+	if err = g.tryLock(); err != nil {
+		return
+	}
+	defer g.unlock()
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+	}()
+	return run(c, w, exchanges())
 }
 
-func cronjob(w http.ResponseWriter, r *http.Request) { // Main program (to be run as a cron job)
-	var err os.Error
-	c := appengine.NewContext(r)
+// run checks for arbitrage at exchanges |xs| and executes the trades. The errors returned tell the phase of the run they happened in (see xgen.CallError).
+func run(c xgen.Context, w io.Writer, xs []xgen.Exchange) (err os.Error) {
+	deadline := time.Nanoseconds() + timeout
+	lease, err := lock(c, w, 2*timeout) // Renewed before executing the trades
+	if lease == nil {
+		return
+	}
+	defer release(c, lease)
+	ms := make([]market, 0)
+	for _, x := range xs {
+		ms = append(ms, market{x: x})
+	}
 
 	// Quotes/Tickers by exchange
-	var quote [numExchanges]xgen.Quote
-	quote[mtGox], err = mtgox.GetQuote(c)
-	check(err)
-	quote[tradeHill], err = tradehill.GetQuote(c)
-	check(err)
-	//	quote[campBx], err = campbx.GetQuote(c) // For some reason the Unmarshal in GetJson function in api.go causes: "runtime error: invalid memory address or nil pointer dereference"
-	//	check(err)
+	ms = fetch(c, w, ms, "GetQuote", deadline, func(m *market) (err os.Error) {
+		m.quote, err = m.x.GetQuote(c, pair)
+		if err == nil && !m.quote.Validate() { // The adapters check their data, but not all exchanges do (e.g. the simulated ones)
+			err = os.NewError("invalid ticker")
+		}
+		return
+	})
+	if err = enough(ms, "GetQuote"); err != nil {
+		return
+	}
 
 	// Store ticker data in datastore
-	for i := int8(0); i < numExchanges; i++ {
-		err = appdb.KeyPut(c, "Ticker_"+exchangeName[i], &quote[i], "", time.Seconds())
-		check(err)
+	for _, m := range ms {
+		q := m.quote
+		t := ticker{q.Date, q.Pair.String(), q.HighestBuy, q.LowestSell, q.Last}
+		err = appdb.KeyPut(c.Store(), "Ticker_"+m.x.Name(), &t, "", time.Seconds())
+		if err != nil {
+			return xgen.InPhase("Store tickers", err)
+		}
 	}
 
 	// Check if arbitrage exists
-	var maxBid, minAsk float64
-	for ex, q := range quote {
-		bid := q.HighestBuy * (1 - commission[ex])
+	var maxBid, minAsk xgen.Decimal
+	for _, m := range ms {
+		bid := m.quote.HighestBuy.Mul(xgen.One - commission[m.x.Name()])
 		if maxBid == 0 || bid > maxBid {
 			maxBid = bid
 		}
-		ask := q.LowestSell / (1 - commission[ex])
+		ask := m.quote.LowestSell.Div(xgen.One - commission[m.x.Name()])
 		if minAsk == 0 || ask < minAsk {
 			minAsk = ask
 		}
 	}
 	if maxBid < minAsk {
 		fmt.Fprintln(w, "No Arbitrage Exists: Highest Buy ", maxBid, " < Lowest Sell ", minAsk, "<br>")
+		return nil
+	}
+
+	// Account balances and open orders by exchange (the API calls wait for the rate limits of the exchanges, see restapi.Wait)
+	ms = fetch(c, w, ms, "GetBalance+GetOpenOrders", deadline, func(m *market) (err os.Error) {
+		m.funds, err = m.x.GetBalance(c)
+		if err != nil {
+			return
+		}
+		m.pending, err = m.x.GetOpenOrders(c, pair)
+		return
+	})
+	if err = enough(ms, "GetBalance+GetOpenOrders"); err != nil {
 		return
 	}
 
-	time.Sleep(0.5 * 1e9) // Wait for half a second before the next API calls
-
-	// Account balances by exchange
-	var funds [numExchanges]xgen.Balance
-	funds[mtGox], err = mtgox.GetBalance(c, login[mtGox])
-	check(err)
-	funds[tradeHill], err = tradehill.GetBalance(c, login[tradeHill])
-	check(err)
-	//	funds[campBx], err = campbx.GetBalance(c, login[campBx])
-	//	check(err)
-
-	time.Sleep(0.5 * 1e9) // Wait for half a second before the next API calls
-
-	// Open orders by exchange
-	var pending [numExchanges]xgen.OpenOrders
-	pending[mtGox], err = mtgox.GetOpenOrders(c, login[mtGox])
-	check(err)
-	pending[tradeHill], err = tradehill.GetOpenOrders(c, login[tradeHill])
-	check(err)
-	//	pending[campBx], err = campbx.GetOpenOrders(c, login[campBx])
-	//	check(err)
-
-	time.Sleep(0.5 * 1e9) // Wait for half a second before the next API calls
-
-	// Cancel any open orders
-	for i := int8(0); i < numExchanges; i++ {
-		for oid, _ := range pending[i].Buy {
-			if !paperTrade {
-				switch i {
-				case mtGox:
-					_, err = mtgox.CancelOrder(c, login[i], oid, 2)
-				case tradeHill:
-					_, err = tradehill.CancelOrder(c, login[i], oid)
-					//					case campBx:  _, err = campbx.CancelOrder(c, login[i], oid, "Buy")
-				}
-				check(err)
-				// Store the canceled order in datastore
-				err = appdb.KeyPut(c, "Cancel_"+exchangeName[i], &pending[i].Buy, "", time.Seconds())
-				check(err)
-				time.Sleep(0.5 * 1e9) // Wait for half a second before the next API calls
-			}
+	// Cancel any open orders (a cancel still running after the deadline may yet cancel the orders, so the run stops there)
+	ms, late := gather(c, w, ms, "CancelOrder", deadline, func(m *market) os.Error {
+		if err := fence(c, lease); err != nil {
+			return err
+		}
+		return cancelOrders(c, m)
+	})
+	for _, m := range late {
+		fmt.Fprintln(w, m.x.Name(), ": Open orders in an unknown state (canceling them may still finish)<br>")
+	}
+	if len(late) > 0 {
+		return xgen.InPhase("CancelOrder", os.NewError(fmt.Sprint("Canceling the open orders did not finish by the deadline at ",
+			len(late), " exchanges, so their orders may or may not be canceled")))
+	}
+	if err = enough(ms, "CancelOrder"); err != nil {
+		return
+	}
+
+	// Limit order books by exchange
+	ms = fetch(c, w, ms, "GetOrderBook", deadline, func(m *market) (err os.Error) {
+		m.book, err = m.x.GetOrderBook(c, pair)
+		if err == nil && !m.book.Validate() {
+			err = os.NewError("invalid order book")
 		}
-		for oid, _ := range pending[i].Sell {
-			if !paperTrade {
-				switch i {
-				case mtGox:
-					_, err = mtgox.CancelOrder(c, login[i], oid, 1)
-				case tradeHill:
-					_, err = tradehill.CancelOrder(c, login[i], oid)
-					//					case campBx:  _, err = campbx.CancelOrder(c, login[i], oid, "Sell")
-				}
-				check(err)
-				// Store the canceled order in datastore
-				err = appdb.KeyPut(c, "Cancel_"+exchangeName[i], &pending[i].Sell, "", time.Seconds())
-				check(err)
-				time.Sleep(0.5 * 1e9) // Wait for half a second before the next API calls
+		return
+	})
+	if err = enough(ms, "GetOrderBook"); err != nil {
+		return
+	}
+
+	strategy, err := calculate(ms)
+	if err != nil {
+		return
+	}
+	if guard.shuttingDown() {
+		fmt.Fprintln(w, "Shutting down, no trades executed<br>")
+		return nil
+	}
+	if err = lease.Renew(c.Store(), 2*timeout); err != nil {
+		return xgen.InPhase("Lock", err)
+	}
+
+	// Execute trades (a failed order is only sent again if it certainly was not placed, see place)
+	for i, m := range ms {
+		x := m.x
+		if strategy.Buy[i].Amount > 0 || strategy.Sell[i].Amount > 0 {
+			if err = fence(c, lease); err != nil {
+				return
+			}
+			if err = trade(c, w, &m, strategy.Buy[i], strategy.Sell[i]); err != nil {
+				return
 			}
+		} else {
+			fmt.Fprintln(w, "No arbirage opportunities at:", x.Name(), "<br>")
 		}
+		fee := commission[x.Name()]
+		fmt.Fprintln(w, x.Name(), ": Bid", m.book.BuyTree[0].Price.Mul(xgen.One-fee), "Ask",
+			m.book.SellTree[0].Price.Div(xgen.One-fee), "<br><br>")
 	}
+	return nil
+}
 
-	// Limit order books by exchange
-	var book [numExchanges]xgen.OrderBook
-	book[mtGox], err = mtgox.GetOrderBook(c)
-	check(err)
-	book[tradeHill], err = tradehill.GetOrderBook(c)
-	check(err)
-	//	book[campBx], err = campbx.GetOrderBook(c)
-	//	check(err)
+// calculate finds the arbitrage strategy for the order books and funds of the markets |ms|. The orders of the strategy are in the same order as the markets.
+// A decimal overflow (from absurd prices or amounts, see xgen.Decimal.Mul) is returned as an error of the Calculate phase.
+func calculate(ms []market) (strategy arbitrage.Strategy, err os.Error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = xgen.InPhase("Calculate", panicError(v))
+		}
+	}()
+	// Order books, funds, commissions and minimum transaction sizes in the same order as the exchanges
+	numExchanges := len(ms)
+	book := make([]xgen.OrderBook, numExchanges)
+	funds := make([]xgen.Balance, numExchanges)
+	fee := make([]xgen.Decimal, numExchanges)
+	limit := make([]xgen.Balance, numExchanges)
+	for i, m := range ms {
+		book[i] = m.book
+		funds[i] = m.funds
+		fee[i] = commission[m.x.Name()]
+		limit[i] = minTrade[m.x.Name()]
+	}
 
 	// Find the arbitrage strategy
-	strategy := arbitrage.Calculate(book[:], funds[:], commission[:], minTrade[:])
+	strategy = arbitrage.Calculate(pair, book, funds, fee, limit)
 
 	// Check for internal arbitrage within the same exchange, since those should not happen if the data is correct and the exchange is working correctly
-	for i := int8(0); i < numExchanges; i++ {
+	for i, m := range ms {
 		if strategy.Buy[i].Amount > 0 && strategy.Sell[i].Amount > 0 {
-			panic(fmt.Sprintln("Arbitrage within", exchangeName[i], "order books"))
+			err = xgen.InPhase("Calculate", os.NewError(fmt.Sprint("Arbitrage within ", m.x.Name(), " order books")))
+			return
 		}
 	}
 
-	// If one-sided trades allowed, use them for balancing the total USD and BTC within accounts
+	// If one-sided trades allowed, use them for balancing the total amounts of both currencies within accounts
 	if onesidedArb {
-		strategy = arbitrage.Onesided(strategy, funds[:], commission[:])
-	}
-
-	time.Sleep(0.5 * 1e9) // One second is 1e9 nanoseconds
-
-	// Execute trades
-	for i := int8(0); i < numExchanges; i++ {
-		if strategy.Buy[i].Amount > 0 {
-			fmt.Fprintln(w, exchangeName[i], ": Buy", strategy.Buy[i].Amount, "bitcoins for", strategy.Buy[i].Price, "USD per BTC <br>")
-
-			// Execute trade:
-			if !paperTrade {
-				switch i {
-				case mtGox:
-					_, err = mtgox.Buy(c, login[i], strategy.Buy[i].Price, strategy.Buy[i].Amount)
-				case tradeHill:
-					_, err = tradehill.Buy(c, login[i], strategy.Buy[i].Price, strategy.Buy[i].Amount)
-					//					case campBx: _, err = campbx.Buy(c, login[i], strategy.Buy[i].Price, strategy.Buy[i].Amount)
-				}
-				check(err)
-				// Store the order in datastore
-				err = appdb.KeyPut(c, "Buy_"+exchangeName[i], &strategy.Buy[i], "", time.Seconds())
-				check(err)
-			}
-		} else if strategy.Sell[i].Amount > 0 {
-			fmt.Fprintln(w, exchangeName[i], ": Sell", strategy.Sell[i].Amount, "bitcoins for", strategy.Sell[i].Price, "USD per BTC <br>")
-
-			// Execute trade:
-			if !paperTrade {
-				switch i {
-				case mtGox:
-					_, err = mtgox.Sell(c, login[i], strategy.Sell[i].Price, strategy.Sell[i].Amount)
-				case tradeHill:
-					_, err = tradehill.Sell(c, login[i], strategy.Sell[i].Price, strategy.Sell[i].Amount)
-					//					case campBx: _, err = campbx.Sell(c, login[i], strategy.Sell[i].Price, strategy.Sell[i].Amount)
-				}
-				check(err)
-				// Store the order in datastore
-				err = appdb.KeyPut(c, "Sell_"+exchangeName[i], &strategy.Sell[i], "", time.Seconds())
-				check(err)
-			}
-		} else {
-			fmt.Fprintln(w, "No arbirage opportunities at:", exchangeName[i], "<br>")
+		strategy = arbitrage.Onesided(pair, strategy, funds, fee)
+	}
+	return
+}
+
+// trade executes the |buy| or |sell| order (whichever has a non-zero amount) at the exchange of market |m|,
+// and stores the order in the datastore (in paper trade mode the exchanges are simulated, see package simex).
+// An order rejected for a reason that doesn't stop the run (see rejected) is reported but not returned as an error.
+// No order is placed once Shutdown has started canceling the open orders (see ErrAborted).
+func trade(c xgen.Context, w io.Writer, m *market, buy xgen.Order, sell xgen.Order) os.Error {
+	x := m.x
+	t, o, side := xgen.BuyOrder, buy, "Buy"
+	if buy.Amount == 0 {
+		t, o, side = xgen.SellOrder, sell, "Sell"
+	}
+	if guard.aborted() {
+		return xgen.InPhase(side, ErrAborted)
+	}
+	fmt.Fprintln(w, x.Name(), ":", side, o.Amount, pair.Base, "for", o.Price, pair.Quote, "per", pair.Base, "<br>")
+	err := place(c, m, t, o)
+	if rejected(err) {
+		fmt.Fprintln(w, x.Name(), ": Order rejected:", err, "<br>")
+		c.Warningf("%s: %s order rejected: %s", x.Name(), side, err)
+		return nil
+	}
+	if err != nil {
+		return xgen.InPhase(side, err)
+	}
+	// Store the order in datastore
+	err = appdb.KeyPut(c.Store(), side+"_"+x.Name(), &o, "", time.Seconds())
+	if err != nil {
+		return xgen.InPhase("Store orders", err)
+	}
+	return nil
+}
+
+// cancelOrders cancels all the open orders of market |m|, one at a time.
+func cancelOrders(c xgen.Context, m *market) os.Error {
+	x := m.x
+	for oid, _ := range m.pending.Buy {
+		err := x.CancelOrder(c, pair, oid, xgen.BuyOrder)
+		if xgen.ClassOf(err) == xgen.UnknownOrder { // Filled or canceled since the open orders were read
+			continue
+		}
+		if err != nil {
+			return err
 		}
-		fmt.Fprintln(w, exchangeName[i], ": Bid", book[i].BuyTree[0].Price*(1-commission[i]), "Ask",
-			book[i].SellTree[0].Price/(1-commission[i]), "<br><br>")
+		// Store the canceled order in datastore
+		err = appdb.KeyPut(c.Store(), "Cancel_"+x.Name(), &m.pending.Buy, "", time.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+	for oid, _ := range m.pending.Sell {
+		err := x.CancelOrder(c, pair, oid, xgen.SellOrder)
+		if xgen.ClassOf(err) == xgen.UnknownOrder { // Filled or canceled since the open orders were read
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Store the canceled order in datastore
+		err = appdb.KeyPut(c.Store(), "Cancel_"+x.Name(), &m.pending.Sell, "", time.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejected tells whether an order was rejected by the exchange for a reason that does not stop the run
+// (the other exchanges can still trade, and the order is reconsidered in the next run).
+func rejected(err os.Error) bool {
+	switch xgen.ClassOf(err) {
+	case xgen.InsufficientFunds, xgen.BelowMinimum, xgen.RateLimited, xgen.Unavailable:
+		return true
+	}
+	return false
+}
+
+// enough returns an error unless there are at least two exchanges left for arbitrage after |phase|.
+func enough(ms []market, phase string) os.Error {
+	if len(ms) < 2 {
+		return xgen.InPhase(phase, os.NewError(fmt.Sprint("Not enough exchanges for arbitrage (", len(ms), " left after failed API calls)")))
 	}
+	return nil
 }
 
-func unittests(w http.ResponseWriter, r *http.Request) { // Delete and use 'gotest' instead!
-	err := arbitrage.TestCalculate()
+func unittests(w http.ResponseWriter, r *http.Request) os.Error { // Delete and use 'gotest' instead!
+	err := xgen.TestDecimal()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "xgen.TestDecimal: OK<br>")
+	}
+
+	err = xgen.TestErrors()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "xgen.TestErrors: OK<br>")
+	}
+
+	err = arbitrage.TestCalculate()
 	if err != nil {
 		fmt.Fprintln(w, err.String())
 	} else {
@@ -277,4 +495,173 @@ func unittests(w http.ResponseWriter, r *http.Request) { // Delete and use 'gote
 	} else {
 		fmt.Fprintln(w, "arbitrage.TestOnesided: OK<br>")
 	}
+
+	err = TestConfig()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestConfig: OK<br>")
+	}
+
+	err = TestCredentials()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestCredentials: OK<br>")
+	}
+
+	err = TestHTTPConfig()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestHTTPConfig: OK<br>")
+	}
+
+	err = TestEngine()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestEngine: OK<br>")
+	}
+
+	err = TestScheduler()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestScheduler: OK<br>")
+	}
+
+	err = TestLock()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestLock: OK<br>")
+	}
+
+	err = TestChaos()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "arbit.TestChaos: OK<br>")
+	}
+
+	err = restapi.TestSign()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestSign: OK<br>")
+	}
+
+	err = restapi.TestLimiter()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestLimiter: OK<br>")
+	}
+
+	err = restapi.TestRetry()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestRetry: OK<br>")
+	}
+
+	err = restapi.TestCassette()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestCassette: OK<br>")
+	}
+
+	err = restapi.TestConcurrentReplay()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestConcurrentReplay: OK<br>")
+	}
+
+	err = restapi.TestMiddleware()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "restapi.TestMiddleware: OK<br>")
+	}
+
+	err = mtgox.TestMtGox()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "mtgox.TestMtGox: OK<br>")
+	}
+
+	err = tradehill.TestTradeHill()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "tradehill.TestTradeHill: OK<br>")
+	}
+
+	err = campbx.TestCampBX()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "campbx.TestCampBX: OK<br>")
+	}
+
+	err = nonce.TestNonce(appdb.NewMemStore())
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "nonce.TestNonce: OK<br>")
+	}
+
+	err = secrets.TestSecrets()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "secrets.TestSecrets: OK<br>")
+	}
+
+	err = simex.TestSimex()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "simex.TestSimex: OK<br>")
+	}
+
+	err = faults.TestFaults()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "faults.TestFaults: OK<br>")
+	}
+
+	err = stream.TestStream()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "stream.TestStream: OK<br>")
+	}
+
+	err = appdb.TestStore(appdb.NewMemStore())
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "appdb.TestStore: OK<br>")
+	}
+
+	err = appdb.TestFileStore()
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "appdb.TestFileStore: OK<br>")
+	}
+
+	err = appdb.TestLease(appdb.NewMemStore())
+	if err != nil {
+		fmt.Fprintln(w, err.String())
+	} else {
+		fmt.Fprintln(w, "appdb.TestLease: OK<br>")
+	}
+	return nil
 }
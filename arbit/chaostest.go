@@ -0,0 +1,169 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"bytes"
+	"fmt"
+	"http"
+	"strings"
+	"xgen"
+	"restapi"
+	"simex"
+	"faults"
+	"mtgox"
+)
+
+// chaosContext is a restapi.TestContext making the HTTP requests with the default transport (for the stand-ins).
+type chaosContext struct {
+	restapi.TestContext
+}
+
+func (c chaosContext) Transport() http.RoundTripper { return http.DefaultTransport }
+
+// chaosMarkets returns two simulated exchanges with an arbitrage of 1 BTC: buying at ExchA for $10 and selling at ExchB for $12.
+func chaosMarkets() (a *simex.Exchange, b *simex.Exchange) {
+	a = simex.New("ExchA", []xgen.Pair{xgen.BTCUSD}, xgen.Balance{xgen.USD: xgen.NewDecimal(100)})
+	a.SetBook(testBook(9, 10, 1))
+	b = simex.New("ExchB", []xgen.Pair{xgen.BTCUSD}, xgen.Balance{xgen.BTC: xgen.NewDecimal(1)})
+	b.SetBook(testBook(12, 13, 1))
+	return
+}
+
+// chaosRun runs the trading loop once at exchanges |xs| (wrapped by injector |in|), returning the report of the run and its error.
+// A panic is returned as an error.
+func chaosRun(in *faults.Injector, xs ...xgen.Exchange) (report string, err os.Error) {
+	var wrapped []xgen.Exchange
+	for _, x := range xs {
+		wrapped = append(wrapped, in.Wrap(x))
+	}
+	var w bytes.Buffer
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+		report = w.String()
+	}()
+	err = run(chaosContext{restapi.NewTestContext()}, &w, wrapped)
+	return
+}
+
+// phase returns the phase of the run |err| happened in.
+func phase(err os.Error) string {
+	if e, ok := err.(*xgen.CallError); ok {
+		return e.Phase
+	}
+	return ""
+}
+
+// TestChaos runs the trading loop with faults injected into the calls to the exchanges (see package faults), and checks
+// how it reacts to each fault: a failed Sell after a successful Buy, a lost response of an order, a hanging CancelOrder,
+// a stale balance, a malformed response and a partial order book. Finally it runs the loop with random faults everywhere,
+// checking that it never panics, overdraws an account or returns an error without a phase.
+func TestChaos() os.Error {
+	savedPair, savedTimeout, savedRetries := pair, timeout, restapi.Retries
+	pair, timeout, restapi.Retries = xgen.BTCUSD, 2e9, restapi.RetryPolicy{3, 1e6, 1e6}
+	defer func() { pair, timeout, restapi.Retries = savedPair, savedTimeout, savedRetries }()
+
+	// The Sell leg fails after the Buy leg succeeded: the order is sent again only while it certainly was not placed,
+	// and the run stops in the Sell phase with the bought BTC left unhedged
+	a, b := chaosMarkets()
+	in := faults.New(1, []faults.Rule{{Exchange: "ExchB", Call: "Sell", Kind: faults.Fail, Probability: 1}})
+	report, err := chaosRun(in, a, b)
+	if phase(err) != "Sell" || len(a.Fills()) != 1 || len(b.Fills()) != 0 || in.Count("ExchB", "Sell", "") != restapi.Retries.Attempts {
+		return os.NewError(fmt.Sprint("TestChaos: failing Sell = ", err, " with ", len(a.Fills()), " buys and ", len(b.Fills()), " sells after ",
+			in.Count("ExchB", "Sell", ""), " attempts, want a Sell error, 1 buy and no sells after ", restapi.Retries.Attempts, "<br>", report))
+	}
+
+	// The response of the Sell is lost, but the order was placed: the change of the balance shows it, so it is not sent again
+	a, b = chaosMarkets()
+	in = faults.New(1, []faults.Rule{{Exchange: "ExchB", Call: "Sell", Kind: faults.Fail, Probability: 1, Sent: true}})
+	report, err = chaosRun(in, a, b)
+	if err != nil || len(a.Fills()) != 1 || len(b.Fills()) != 1 || in.Count("ExchB", "Sell", "") != 1 {
+		return os.NewError(fmt.Sprint("TestChaos: lost Sell response = ", err, " with ", len(a.Fills()), " buys and ", len(b.Fills()), " sells after ",
+			in.Count("ExchB", "Sell", ""), " attempts, want 1 of each<br>", report))
+	}
+
+	// CancelOrder hangs past the deadline of the run: the exchange is skipped, so no trades are made
+	a, b = chaosMarkets()
+	a.Buy(nil, xgen.BTCUSD, xgen.NewDecimal(5), xgen.NewDecimal(1)) // Stays open
+	timeout = 300e6
+	in = faults.New(1, []faults.Rule{{Exchange: "ExchA", Call: "CancelOrder", Kind: faults.Hang, Probability: 1, Delay: 1000}})
+	report, err = chaosRun(in, a, b)
+	timeout = 2e9
+	open, _ := a.GetOpenOrders(nil, xgen.BTCUSD)
+	if phase(err) != "CancelOrder" || len(a.Fills())+len(b.Fills()) != 0 || len(open.Buy) != 1 ||
+		strings.Index(report, "ExchA : CancelOrder failed or timed out") < 0 {
+		return os.NewError(fmt.Sprint("TestChaos: hanging CancelOrder = ", err, " with ", len(a.Fills())+len(b.Fills()), " fills and ",
+			len(open.Buy), " open orders, want a CancelOrder error, no fills and the open order<br>", report))
+	}
+
+	// GetBalance returns the balance of ExchB from before its BTC was sold: the Sell is rejected for insufficient funds,
+	// which is reported, and the run goes on
+	a, b = chaosMarkets()
+	in = faults.New(1, []faults.Rule{{Exchange: "ExchB", Call: "GetBalance", Kind: faults.Stale, Probability: 1}})
+	in.Wrap(b).GetBalance(nil)
+	b.Sell(nil, xgen.BTCUSD, xgen.NewDecimal(12), xgen.NewDecimal(1))
+	b.SetBook(testBook(12.5, 13, 1))
+	report, err = chaosRun(in, a, b)
+	funds, _ := b.GetBalance(nil)
+	if err != nil || len(a.Fills()) != 1 || len(b.Fills()) != 1 || funds[xgen.BTC] != 0 || strings.Index(report, "ExchB : Order rejected") < 0 {
+		return os.NewError(fmt.Sprint("TestChaos: stale GetBalance = ", err, " with ", len(a.Fills()), " buys, ", len(b.Fills()), " sells and ",
+			funds, " left at ExchB, want no error, 1 buy, only the earlier sell and a rejected order<br>", report))
+	}
+
+	// The market data of MtGox (paper traded against a stand-in) is malformed: MtGox is skipped, and the others trade
+	s, err := mtgox.NewStandIn()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err = s.SetBook(testBook(9.5, 10.5, 1)); err != nil {
+		return err
+	}
+	mx := simex.Simulate(&mtgox.Exchange{Client: restapi.Client{BaseURL: s.URL}}, xgen.Balance{xgen.USD: xgen.NewDecimal(100)}, 0)
+	a, b = chaosMarkets()
+	in = faults.New(1, []faults.Rule{{Exchange: "MtGox", Kind: faults.Malformed, Probability: 1}})
+	report, err = chaosRun(in, a, b, mx)
+	if err != nil || len(a.Fills()) != 1 || len(b.Fills()) != 1 || len(s.Calls(mtgox.JsonDepth)) == 0 ||
+		strings.Index(report, "MtGox : GetQuote failed or timed out") < 0 {
+		return os.NewError(fmt.Sprint("TestChaos: malformed MtGox = ", err, " with ", len(a.Fills()), " buys, ", len(b.Fills()), " sells and ",
+			len(s.Calls(mtgox.JsonDepth)), " requests to MtGox, want MtGox skipped and 1 buy and sell<br>", report))
+	}
+
+	// The order book of ExchA is partial (empty): the exchange is skipped instead of trading on the missing data
+	a, b = chaosMarkets()
+	in = faults.New(1, []faults.Rule{{Exchange: "ExchA", Call: "GetOrderBook", Kind: faults.Partial, Probability: 1}})
+	report, err = chaosRun(in, a, b)
+	if phase(err) != "GetOrderBook" || len(a.Fills())+len(b.Fills()) != 0 {
+		return os.NewError(fmt.Sprint("TestChaos: partial order book = ", err, " with ", len(a.Fills())+len(b.Fills()), " fills, want a GetOrderBook error and no fills<br>", report))
+	}
+
+	// Random faults in all the calls
+	a, b = chaosMarkets()
+	in = faults.New(1, []faults.Rule{{Kind: faults.Fail, Probability: 0.1}, {Kind: faults.Fail, Probability: 0.05, Sent: true},
+		{Kind: faults.Hang, Probability: 0.05, Delay: 10}, {Kind: faults.Partial, Probability: 0.1}, {Kind: faults.Stale, Probability: 0.1}})
+	for i := 0; i < 20; i++ {
+		p := float64(i) / 100 // New price levels, since the simulated exchanges remove the volume taken
+		a.SetBook(testBook(9, 10+p, 1))
+		b.SetBook(testBook(12+p, 13+p, 1))
+		report, err = chaosRun(in, a, b)
+		if err != nil && phase(err) == "" {
+			return os.NewError(fmt.Sprint("TestChaos: run ", i+1, " with random faults = ", err, "<br>", report))
+		}
+		for _, x := range []*simex.Exchange{a, b} {
+			funds, _ := x.GetBalance(nil)
+			for cur, v := range funds {
+				if v < 0 {
+					return os.NewError(fmt.Sprint("TestChaos: ", x.Name(), " overdrawn by ", -v, " ", cur, " after run ", i+1, "<br>", report))
+				}
+			}
+		}
+	}
+	if in.Count("", "", "") == 0 {
+		return os.NewError("TestChaos: no faults injected in the random runs")
+	}
+	return nil
+}
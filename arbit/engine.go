@@ -0,0 +1,335 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"io"
+	"sync"
+	"time"
+	"xgen"
+	"arbitrage"
+	"stream"
+)
+
+// Engine evaluates arbitrage whenever the best bid or ask of an exchange changes, instead of once per cron run.
+// The order books are fed to the engine with Update, either by polling the exchanges (Poll) or from their market data
+// streams (Follow). The changes arriving within |Debounce| of the first one are evaluated together, the evaluations start
+// at least |MinInterval| apart, and no evaluation is made while the trades of the previous one are being executed
+// (a change arriving meanwhile is evaluated once the execution has finished, with the balances read after the trades,
+// and likewise a change that couldn't be executed during a run of the /cron/ handler is evaluated again after the run).
+// The order books older than |MaxAge| are left out of the evaluations, so that the engine never trades on a book frozen
+// by a lost stream or failing polls.
+type Engine struct {
+	Debounce    int64 // Nanoseconds to wait for more changes before evaluating
+	MinInterval int64 // Minimum nanoseconds between the evaluations (1e9 / maximum evaluations per second)
+	MaxAge      int64 // Nanoseconds an order book is used for after it was received
+
+	c           xgen.Context
+	w           io.Writer
+	mu          sync.Mutex
+	ms          []*market // In the order of the exchanges
+	stale       map[string]bool
+	received    map[string]int64 // Time the order books were received in nanoseconds (by exchange name)
+	changed     chan bool
+	stop        chan bool
+	clients     []*stream.Client // Started by StartEngine
+	busy        bool             // Trades are being executed
+	missed      bool             // A change arrived while busy
+	evaluations int
+	skipped     int
+}
+
+// NewEngine returns an engine trading at exchanges |xs|, logging to |c| and writing a report of each execution to |w|.
+// The engine doesn't evaluate anything until Run is called, and it has no balances until RefreshFunds is called.
+func NewEngine(c xgen.Context, w io.Writer, xs []xgen.Exchange) *Engine {
+	e := &Engine{Debounce: debounce, MinInterval: minInterval, MaxAge: maxBookAge, c: c, w: w, stale: make(map[string]bool),
+		received: make(map[string]int64), changed: make(chan bool, 1), stop: make(chan bool)}
+	for _, x := range xs {
+		e.ms = append(e.ms, &market{x: x})
+	}
+	return e
+}
+
+// StartEngine starts an engine trading at the registered exchanges with the engine settings of the config (see Configure).
+// The exchanges with a stream URL are followed from their market data streams, and the others are polled.
+func StartEngine(c xgen.Context, w io.Writer) *Engine {
+	e := NewEngine(c, w, exchanges())
+	e.RefreshFunds()
+	for _, x := range exchanges() {
+		if url := streamURL[x.Name()]; url != "" {
+			cl := stream.NewClient(x.Name(), url)
+			cl.Start(c)
+			e.clients = append(e.clients, cl)
+			e.Follow(cl.Subscribe())
+		} else {
+			e.Poll(x.Name(), pollInterval)
+		}
+	}
+	go e.Run()
+	return e
+}
+
+// Update sets the order book of |exchange|. The arbitrage is evaluated again if the best bid or ask has changed.
+// An empty book (e.g. from a stream out of sync) leaves the exchange out of the evaluations until the next valid book.
+func (e *Engine) Update(exchange string, book xgen.OrderBook) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := e.market(exchange)
+	if m == nil || book.Pair != pair {
+		return
+	}
+	changed := e.stale[exchange] || best(m.book.BuyTree) != best(book.BuyTree) || best(m.book.SellTree) != best(book.SellTree)
+	m.book = book
+	e.received[exchange] = time.Nanoseconds()
+	e.stale[exchange] = false, false
+	if changed {
+		e.signal()
+	}
+}
+
+// Follow updates the order books from the market data stream subscription |s| until the engine is stopped.
+func (e *Engine) Follow(s *stream.Subscription) {
+	go func() {
+		for {
+			select {
+			case <-e.stop:
+				return
+			case u := <-s.C:
+				e.Update(u.Exchange, u.Book)
+			}
+		}
+	}()
+}
+
+// Poll reads the order book of |exchange| once every |interval| nanoseconds until the engine is stopped
+// (the calls also wait for the rate limits of the exchange, see restapi.Wait).
+func (e *Engine) Poll(exchange string, interval int64) {
+	e.mu.Lock()
+	m := e.market(exchange)
+	e.mu.Unlock()
+	if m == nil {
+		return
+	}
+	go func(x xgen.Exchange) {
+		for {
+			book, err := x.GetOrderBook(e.c, pair)
+			if err != nil {
+				e.c.Warningf("%s", xgen.WrapError(x.Name(), "", err))
+			} else {
+				e.Update(x.Name(), book)
+			}
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}(m.x)
+}
+
+// RefreshFunds reads the account balances of the exchanges. The exchanges whose balance could not be read keep their previous balance.
+func (e *Engine) RefreshFunds() {
+	e.mu.Lock()
+	ms := make([]market, len(e.ms))
+	for i, m := range e.ms {
+		ms[i] = market{x: m.x}
+	}
+	e.mu.Unlock()
+
+	ms = fetch(e.c, e.w, ms, "GetBalance", time.Nanoseconds()+timeout, func(m *market) (err os.Error) {
+		m.funds, err = m.x.GetBalance(e.c)
+		return
+	})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, m := range ms {
+		e.market(m.x.Name()).funds = m.funds
+	}
+}
+
+// Stats returns the number of evaluations made, and the number of evaluations skipped because trades were being executed.
+func (e *Engine) Stats() (evaluations int, skipped int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.evaluations, e.skipped
+}
+
+// Run evaluates the arbitrage after the changes of the order books until the engine is stopped.
+func (e *Engine) Run() {
+	var last int64
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.changed:
+		}
+		wait := e.Debounce
+		if d := last + e.MinInterval - time.Nanoseconds(); d > wait {
+			wait = d
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(wait):
+		}
+		select {
+		case <-e.changed: // Arrived during the wait, so it is included in this evaluation
+		default:
+		}
+		last = time.Nanoseconds()
+		e.evaluate()
+		e.mu.Lock()
+		retry := e.missed && !e.busy // Skipped for a run in progress (the executions of the engine signal when they finish)
+		if retry {
+			e.missed = false
+		}
+		e.mu.Unlock()
+		if retry {
+			e.signal()
+		}
+	}
+	panic("unreachable")
+}
+
+// Stop stops the engine and its stream clients. The trades being executed are finished, but no new evaluations are made.
+// The engine cannot be started again.
+func (e *Engine) Stop() {
+	close(e.stop)
+	for _, cl := range e.clients {
+		cl.Stop()
+	}
+}
+
+// market returns the market of |exchange|, or nil if the engine doesn't trade at it. The caller must hold the lock.
+func (e *Engine) market(exchange string) *market {
+	for _, m := range e.ms {
+		if m.x.Name() == exchange {
+			return m
+		}
+	}
+	return nil
+}
+
+// signal wakes up Run, unless a change is waiting to be evaluated already.
+func (e *Engine) signal() {
+	select {
+	case e.changed <- true:
+	default:
+	}
+}
+
+// evaluate calculates the arbitrage strategy from the latest order books and balances, and starts executing its trades.
+// The markets without a recent order book (see MaxAge) or a balance are left out, as are the markets traded in since
+// their last update (their books don't show the effect of our own orders yet).
+func (e *Engine) evaluate() {
+	e.mu.Lock()
+	if e.busy {
+		e.missed = true
+		e.skipped++
+		e.mu.Unlock()
+		return
+	}
+	var ms []market
+	now := time.Nanoseconds()
+	for _, m := range e.ms {
+		if m.book.Validate() && m.funds != nil && !e.stale[m.x.Name()] && now-e.received[m.x.Name()] <= e.MaxAge {
+			ms = append(ms, *m)
+		}
+	}
+	if len(ms) < 2 {
+		e.mu.Unlock()
+		return
+	}
+	e.evaluations++
+	e.mu.Unlock()
+
+	strategy, err := calculate(ms)
+	if err != nil {
+		e.c.Errorf("%s", err)
+		return
+	}
+	for i := range ms {
+		if strategy.Buy[i].Amount > 0 || strategy.Sell[i].Amount > 0 {
+			g := guard
+			if err = g.tryLock(); err != nil { // A run of the /cron/ handler is in progress, or shutting down
+				e.c.Warningf("Execution skipped: %s", err)
+				if err == ErrRunning {
+					e.mu.Lock()
+					e.missed = true // Evaluated again (after MinInterval) until the run has finished
+					e.mu.Unlock()
+				}
+				return
+			}
+			e.mu.Lock()
+			e.busy = true
+			e.mu.Unlock()
+			go e.execute(g, ms, strategy)
+			return
+		}
+	}
+}
+
+// execute places the orders of |strategy| at markets |ms|, stopping at the first order failing for other reasons than
+// being rejected (like run does), and reads the balances again afterwards. Like a run, it first cancels the open orders
+// at each market it trades in (e.g. the unfilled rest of an earlier execution), the execution holds the run lease
+// (see lock), and it is skipped if another instance holds it. It unlocks |g| when done.
+func (e *Engine) execute(g *runGuard, ms []market, strategy arbitrage.Strategy) {
+	defer func() {
+		if v := recover(); v != nil {
+			e.c.Criticalf("%s", panicError(v))
+		}
+		g.unlock()
+		e.mu.Lock()
+		e.busy = false
+		missed := e.missed
+		e.missed = false
+		e.mu.Unlock()
+		if missed {
+			e.signal()
+		}
+	}()
+
+	lease, err := lock(e.c, e.w, 2*timeout)
+	if lease == nil {
+		if err != nil {
+			e.c.Criticalf("%s", err)
+		}
+		return
+	}
+	defer release(e.c, lease)
+
+	for i := range ms {
+		m := &ms[i]
+		if strategy.Buy[i].Amount == 0 && strategy.Sell[i].Amount == 0 {
+			continue
+		}
+		e.mu.Lock()
+		e.stale[m.x.Name()] = true
+		e.mu.Unlock()
+		err = fence(e.c, lease)
+		if err == nil {
+			m.pending, err = m.x.GetOpenOrders(e.c, pair) // Also needed for telling whether a failed order was placed (see reconcile)
+		}
+		if err == nil {
+			err = cancelOrders(e.c, m)
+		}
+		if err == nil {
+			err = trade(e.c, e.w, m, strategy.Buy[i], strategy.Sell[i])
+		}
+		if err != nil {
+			e.c.Criticalf("%s", xgen.WrapError(m.x.Name(), "", err))
+			break
+		}
+	}
+	e.RefreshFunds()
+}
+
+// best returns the price of the first order of |orders| (the best bid or ask of a sorted order book), or zero if there are none.
+func best(orders []xgen.Order) xgen.Decimal {
+	if len(orders) == 0 {
+		return 0
+	}
+	return orders[0].Price
+}
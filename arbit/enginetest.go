@@ -0,0 +1,221 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+	"xgen"
+	"restapi"
+)
+
+// testExchange is an exchange with a fixed balance, counting the orders placed. The orders wait until |hold| is closed.
+// The open buy orders in |open| are removed when canceled.
+type testExchange struct {
+	name  string
+	funds xgen.Balance
+	hold  chan bool
+
+	mu     sync.Mutex
+	orders int
+	open   map[string]xgen.OpenOrder
+}
+
+func (x *testExchange) Name() string       { return x.name }
+func (x *testExchange) Pairs() []xgen.Pair { return []xgen.Pair{xgen.BTCUSD} }
+
+func (x *testExchange) GetQuote(c xgen.Context, pair xgen.Pair) (xgen.Quote, os.Error) {
+	return xgen.Quote{}, os.NewError("not supported")
+}
+
+func (x *testExchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (xgen.OrderBook, os.Error) {
+	return xgen.OrderBook{}, os.NewError("not supported")
+}
+
+func (x *testExchange) GetBalance(c xgen.Context) (xgen.Balance, os.Error) {
+	return x.funds.Copy(), nil
+}
+
+func (x *testExchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (xgen.OpenOrders, os.Error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	open := xgen.OpenOrders{pair, make(map[string]xgen.OpenOrder), make(map[string]xgen.OpenOrder)}
+	for oid, o := range x.open {
+		open.Buy[oid] = o
+	}
+	return open, nil
+}
+
+func (x *testExchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) os.Error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.open[oid]; !ok || orderType != xgen.BuyOrder {
+		return &xgen.ExchangeError{x.name, xgen.UnknownOrder, "no such order"}
+	}
+	x.open[oid] = xgen.OpenOrder{}, false
+	return nil
+}
+
+func (x *testExchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	x.mu.Lock()
+	x.orders++
+	x.mu.Unlock()
+	<-x.hold
+	return nil
+}
+
+func (x *testExchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	return x.Buy(c, pair, price, amount)
+}
+
+func (x *testExchange) placed() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.orders
+}
+
+// testBook returns an order book with a single bid and ask.
+func testBook(bid, ask, amount float64) xgen.OrderBook {
+	return xgen.OrderBook{Pair: xgen.BTCUSD,
+		BuyTree:  []xgen.Order{{xgen.NewDecimal(bid), xgen.NewDecimal(amount)}},
+		SellTree: []xgen.Order{{xgen.NewDecimal(ask), xgen.NewDecimal(amount)}}}
+}
+
+// waitFor waits up to two seconds for |cond| to become true.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Nanoseconds() + 2e9; time.Nanoseconds() < deadline; time.Sleep(5e6) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// TestEngine checks that the engine evaluates the arbitrage only after the best bids and asks change, debounces the changes,
+// doesn't evaluate while the trades are being executed, cancels its open orders before trading, leaves out the old books,
+// and evaluates a change again after a run holding the guard has finished.
+func TestEngine() os.Error {
+	savedPair, savedGuard := pair, guard
+	pair, guard = xgen.BTCUSD, newRunGuard()
+	defer func() { pair, guard = savedPair, savedGuard }()
+
+	hold := make(chan bool)
+	xa := &testExchange{name: "ExchA", funds: xgen.Balance{xgen.USD: xgen.NewDecimal(100)}, hold: hold}
+	xb := &testExchange{name: "ExchB", funds: xgen.Balance{xgen.BTC: xgen.NewDecimal(5)}, hold: hold}
+	e := NewEngine(restapi.NewTestContext(), ioutil.Discard, []xgen.Exchange{xa, xb})
+	e.Debounce, e.MinInterval = 20e6, 50e6
+	e.RefreshFunds()
+	go e.Run()
+	defer e.Stop()
+	stats := func(evaluations, skipped int) func() bool {
+		return func() bool {
+			ev, sk := e.Stats()
+			return ev == evaluations && sk == skipped
+		}
+	}
+
+	// No arbitrage
+	e.Update("ExchA", testBook(10, 11, 1))
+	e.Update("ExchB", testBook(10.5, 13, 1))
+	if !waitFor(stats(1, 0)) {
+		ev, sk := e.Stats()
+		return os.NewError(fmt.Sprint("TestEngine: ", ev, " evaluations and ", sk, " skipped after the first books, want 1 and 0"))
+	}
+
+	// Changes deeper in the book don't matter
+	e.Update("ExchA", testBook(10, 11, 2))
+	time.Sleep(200e6)
+	if ev, _ := e.Stats(); ev != 1 {
+		return os.NewError(fmt.Sprint("TestEngine: ", ev, " evaluations after a change of depth only, want 1"))
+	}
+
+	// Changes in quick succession are evaluated together, and buying at ExchA for 11 and selling at ExchB for 12+ is profitable
+	e.Update("ExchB", testBook(12, 13, 1))
+	e.Update("ExchB", testBook(12.1, 13, 1))
+	e.Update("ExchB", testBook(12.2, 13, 1))
+	if !waitFor(func() bool { return xa.placed() == 1 }) {
+		return os.NewError("TestEngine: no order placed at ExchA")
+	}
+	if ev, _ := e.Stats(); ev != 2 {
+		return os.NewError(fmt.Sprint("TestEngine: ", ev, " evaluations after three quick changes, want 2"))
+	}
+
+	// The order at ExchA is still being placed, so the change is not evaluated
+	e.Update("ExchB", testBook(12.3, 13, 1))
+	if !waitFor(stats(2, 1)) {
+		ev, sk := e.Stats()
+		return os.NewError(fmt.Sprint("TestEngine: ", ev, " evaluations and ", sk, " skipped during the execution, want 2 and 1"))
+	}
+
+	// Once the trades are done, both books are stale until they are updated again
+	close(hold)
+	if !waitFor(func() bool { return xb.placed() == 1 }) {
+		return os.NewError("TestEngine: no order placed at ExchB")
+	}
+	time.Sleep(200e6)
+	if ev, _ := e.Stats(); ev != 2 || xa.placed() != 1 {
+		return os.NewError(fmt.Sprint("TestEngine: ", ev, " evaluations and ", xa.placed(), " orders at ExchA with stale books, want 2 and 1"))
+	}
+	// The open order left at ExchA is canceled before the next trades
+	xa.mu.Lock()
+	xa.open = map[string]xgen.OpenOrder{"1": {}}
+	xa.mu.Unlock()
+	e.Update("ExchA", testBook(10, 11, 1))
+	e.Update("ExchB", testBook(12.3, 13, 1))
+	if !waitFor(func() bool { return xa.placed() == 2 && xb.placed() == 2 }) {
+		return os.NewError("TestEngine: no orders placed after the books were updated")
+	}
+	xa.mu.Lock()
+	open := len(xa.open)
+	xa.mu.Unlock()
+	if open != 0 {
+		return os.NewError(fmt.Sprint("TestEngine: ", open, " open orders left at ExchA after trading, want 0"))
+	}
+
+	// The book of ExchA is too old to be traded on, until it is updated again
+	if !waitFor(func() bool { e.mu.Lock(); defer e.mu.Unlock(); return !e.busy }) {
+		return os.NewError("TestEngine: the execution didn't finish")
+	}
+	e.mu.Lock()
+	e.MaxAge = 100e6
+	e.mu.Unlock()
+	e.Update("ExchA", testBook(10, 11, 1))
+	time.Sleep(200e6)
+	e.Update("ExchB", testBook(12.3, 13, 1))
+	time.Sleep(200e6)
+	if xa.placed() != 2 || xb.placed() != 2 {
+		return os.NewError(fmt.Sprint("TestEngine: ", xa.placed(), " and ", xb.placed(), " orders at ExchA and ExchB with an old book, want 2 and 2"))
+	}
+	e.Update("ExchA", testBook(10, 11.1, 1))
+	if !waitFor(func() bool { return xa.placed() == 3 && xb.placed() == 3 }) {
+		return os.NewError("TestEngine: no orders placed after the old book was updated")
+	}
+
+	// A change arriving while a run holds the guard is evaluated once the run has finished
+	if !waitFor(func() bool { e.mu.Lock(); defer e.mu.Unlock(); return !e.busy }) {
+		return os.NewError("TestEngine: the execution didn't finish")
+	}
+	e.mu.Lock()
+	e.MaxAge = 60e9
+	e.mu.Unlock()
+	e.Update("ExchA", testBook(10, 11, 1))
+	g := guard
+	if err := g.tryLock(); err != nil {
+		return err
+	}
+	e.Update("ExchB", testBook(12.4, 13, 1))
+	time.Sleep(200e6)
+	placed := xa.placed()
+	g.unlock()
+	if placed != 3 {
+		return os.NewError(fmt.Sprint("TestEngine: ", placed, " orders at ExchA while a run held the guard, want 3"))
+	}
+	if !waitFor(func() bool { return xa.placed() == 4 && xb.placed() == 4 }) {
+		return os.NewError("TestEngine: the change made during a run was not evaluated after it")
+	}
+	return nil
+}
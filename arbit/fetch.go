@@ -0,0 +1,146 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"xgen"
+	"appdb"
+	"restapi"
+)
+
+// market contains the data fetched from one exchange during a run.
+type market struct {
+	x       xgen.Exchange
+	quote   xgen.Quote
+	funds   xgen.Balance
+	pending xgen.OpenOrders
+	book    xgen.OrderBook
+}
+
+// Timing records how long an API call to an exchange (or a series of calls, such as canceling all the open orders) took.
+// The timings of each run are stored in the datastore (kind "Timing"), keeping the latest ones (see keep).
+type Timing struct {
+	Date     int64 // Unix timestamp of the start of the call
+	Exchange string
+	Call     string // E.g. "GetQuote"
+	Elapsed  int64  // Milliseconds
+	Waited   int64  // Milliseconds of Elapsed spent waiting for the rate limits of the exchange (see restapi.Wait)
+	Error    string // Empty if the call succeeded
+}
+
+type result struct {
+	i      int
+	m      market
+	timing Timing
+}
+
+// fetch runs |call| concurrently for each of the markets and waits until all the calls have returned, or until the |deadline|
+// (in nanoseconds, see time.Nanoseconds) has passed. Each call fills in its own copy of the market, so the calls still running
+// after the deadline don't change the markets returned, but they do go on at the exchanges: e.g. a late CancelOrder may still
+// cancel the order (see gather). The markets of the successful calls are returned in the original order, while the failed
+// and timed out calls are reported to |w| and logged. The timings of all the calls are stored.
+func fetch(c xgen.Context, w io.Writer, ms []market, name string, deadline int64, call func(m *market) os.Error) []market {
+	fetched, _ := gather(c, w, ms, name, deadline, call)
+	return fetched
+}
+
+// gather is fetch also returning the markets whose calls had not returned by the deadline, whose state at the exchange is
+// unknown for calls that change it (like canceling the open orders).
+func gather(c xgen.Context, w io.Writer, ms []market, name string, deadline int64, call func(m *market) os.Error) (fetched []market, late []market) {
+	start := time.Nanoseconds()
+	done := make(chan result, len(ms)) // Buffered, so that the calls returning after the deadline don't block forever
+	for i, m := range ms {
+		go func(i int, m market) {
+			start, waited := time.Nanoseconds(), restapi.Waited(m.x.Name())
+			err := protect(call, &m)
+			t := Timing{start / 1e9, m.x.Name(), name, (time.Nanoseconds() - start) / 1e6, (restapi.Waited(m.x.Name()) - waited) / 1e6, ""}
+			if err != nil {
+				t.Error = err.String()
+			}
+			done <- result{i, m, t}
+		}(i, m)
+	}
+
+	ok := make([]bool, len(ms))
+	returned := make([]bool, len(ms))
+	expired := time.After(deadline - time.Nanoseconds())
+	for n := 0; n < len(ms); n++ {
+		select {
+		case r := <-done:
+			record(c, w, r.timing)
+			returned[r.i] = true
+			if r.timing.Error == "" {
+				ms[r.i] = r.m
+				ok[r.i] = true
+			}
+		case <-expired:
+			n = len(ms) // Stop waiting
+		}
+	}
+
+	for i, m := range ms {
+		if ok[i] {
+			fetched = append(fetched, m)
+		} else {
+			if !returned[i] {
+				record(c, w, Timing{start / 1e9, m.x.Name(), name, (time.Nanoseconds() - start) / 1e6, 0, "deadline exceeded"})
+				late = append(late, m)
+			}
+			fmt.Fprintln(w, m.x.Name(), ":", name, "failed or timed out, skipping the exchange in this run<br>")
+		}
+	}
+	return
+}
+
+// protect runs |call|, returning a panic caused by a bug as an error (a panic in the goroutines of fetch would stop the whole program).
+func protect(call func(m *market) os.Error, m *market) (err os.Error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+	}()
+	return call(m)
+}
+
+// record stores the timing of a call (see keep) and reports it to |w| (and to the log if the call failed).
+func record(c xgen.Context, w io.Writer, t Timing) {
+	fmt.Fprintln(w, t.Exchange, ":", t.Call, "took", t.Elapsed, "ms, of which", t.Waited, "ms waiting for the rate limit<br>")
+	if t.Error != "" {
+		c.Errorf("%s: %s: %s", t.Exchange, t.Call, t.Error)
+	}
+	err := keep(c.Store(), "Timing", &t)
+	if err != nil {
+		c.Errorf("Storing the timing of %s: %s: %s", t.Exchange, t.Call, err)
+	}
+}
+
+// ring is the slot of the latest entity of a kind kept by keep (kind "Ring", keyed by the kind).
+type ring struct {
+	Slot int64
+}
+
+var ringMu sync.Mutex
+
+// keep stores |data| as the latest entity of |kind|, which keeps only the latest |history| entities (a ring of the integer
+// keys from 1 to |history|, the oldest entity being overwritten), so that the records of every run don't grow without bound.
+func keep(s appdb.Store, kind string, data interface{}) os.Error {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	var r ring
+	err := appdb.KeyGet(s, "Ring", &r, kind, 0)
+	if err != nil && err != appdb.ErrNoSuchEntity {
+		return err
+	}
+	r.Slot = r.Slot%history + 1
+	err = appdb.KeyPut(s, kind, data, "", r.Slot)
+	if err != nil {
+		return err
+	}
+	return appdb.KeyPut(s, "Ring", &r, kind, 0)
+}
@@ -0,0 +1,68 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"rand"
+	"strconv"
+	"time"
+	"xgen"
+	"appdb"
+)
+
+// runLease is the name of the lease (see appdb.Lease) held in the storage during a run or an execution of the engine,
+// so that the runs of different instances (e.g. two App Engine instances serving /cron/) never trade at the same time.
+// The runGuard only keeps the runs of the same instance from overlapping.
+const runLease = "Run"
+
+// instance identifies this instance of ArBit as the holder of the run lease.
+var instance = strconv.Itob64(rand.New(rand.NewSource(time.Nanoseconds())).Int63(), 36)
+
+// Skip records a run skipped because another instance held the run lease (kind "Skip", keeping the latest ones, see keep).
+type Skip struct {
+	Date    int64  // Unix timestamp of the skipped run
+	Holder  string // Instance holding the lease (empty if it was being taken at the same time)
+	Token   int64  // Fencing token of the lease
+	Expires int64  // Unix timestamp the lease expires at
+}
+
+// lock takes the run lease for |duration| nanoseconds. If another instance holds the lease, the skipped run is reported to |w|,
+// logged and stored, and nil is returned without an error.
+func lock(c xgen.Context, w io.Writer, duration int64) (*appdb.Lease, os.Error) {
+	l, err := appdb.AcquireLease(c.Store(), runLease, instance, duration)
+	if err == appdb.ErrLeaseHeld {
+		s := Skip{Date: time.Seconds()}
+		if l != nil {
+			s.Holder, s.Token, s.Expires = l.Holder, l.Token, l.Expires/1e9
+		}
+		fmt.Fprintln(w, "Another run is in progress, skipping this run<br>")
+		c.Warningf("Run skipped: lease held by %q (token %d) until %s", s.Holder, s.Token, time.SecondsToUTC(s.Expires))
+		err = keep(c.Store(), "Skip", &s)
+		if err != nil {
+			c.Errorf("Storing the skipped run: %s", err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xgen.InPhase("Lock", err)
+	}
+	return l, nil
+}
+
+// release releases run lease |l|. A failure is only logged, since the lease expires anyway.
+func release(c xgen.Context, l *appdb.Lease) {
+	err := l.Release(c.Store())
+	if err != nil {
+		c.Errorf("Releasing the run lease: %s", err)
+	}
+}
+
+// fence returns an error unless run lease |l| is still held. It is called before each order is canceled or placed, so that
+// a run whose lease has expired (e.g. after a long stall) stops trading before it collides with the run that took the lease over.
+func fence(c xgen.Context, l *appdb.Lease) os.Error {
+	return xgen.InPhase("Lock", l.Check(c.Store()))
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"time"
+	"xgen"
+	"appdb"
+	"restapi"
+)
+
+// TestLock checks that a run cannot take the run lease while another instance holds it, that the skipped run is recorded,
+// that a run whose lease has been taken over is fenced off, and that only the latest skipped runs are kept.
+func TestLock() os.Error {
+	c := restapi.NewTestContext()
+	l, err := lock(c, ioutil.Discard, 50e6)
+	if err != nil || l == nil {
+		return os.NewError(fmt.Sprint("TestLock: lock = ", l, ", ", err, ", want a lease"))
+	}
+	if err = fence(c, l); err != nil {
+		return os.NewError("TestLock: fence: " + err.String())
+	}
+
+	// Another run is skipped while the lease is held
+	l2, err := lock(c, ioutil.Discard, 10e9)
+	if err != nil || l2 != nil {
+		return os.NewError(fmt.Sprint("TestLock: lock of a held lease = ", l2, ", ", err, ", want nil and no error"))
+	}
+	skips, err := appdb.Query(c.Store(), "Skip", "", nil, "", 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(skips) != 1 || skips[0]["Holder"] != instance {
+		return os.NewError(fmt.Sprint("TestLock: skipped runs<br>=<br>", skips, "<br>want one held by ", instance))
+	}
+
+	// Once the lease has expired and another instance has taken it, the run holding the old lease is fenced off
+	time.Sleep(60e6)
+	_, err = appdb.AcquireLease(c.Store(), runLease, "other", 10e9)
+	if err != nil {
+		return err
+	}
+	if err = fence(c, l); xgen.Unwrap(err) != appdb.ErrLeaseLost {
+		return os.NewError(fmt.Sprint("TestLock: fence after takeover = ", err, ", want ", appdb.ErrLeaseLost))
+	}
+	release(c, l)
+	if l2, _ = lock(c, ioutil.Discard, 10e9); l2 != nil {
+		return os.NewError("TestLock: lease taken over was released by the old holder")
+	}
+
+	savedHistory := history
+	history = 3
+	defer func() { history = savedHistory }()
+	for i := 0; i < 5; i++ {
+		lock(c, ioutil.Discard, 10e9)
+	}
+	skips, err = appdb.Query(c.Store(), "Skip", "", nil, "", 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(skips) != 3 {
+		return os.NewError(fmt.Sprint("TestLock: ", len(skips), " skipped runs kept of 7, want the latest 3"))
+	}
+	return nil
+}
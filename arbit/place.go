@@ -0,0 +1,97 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"xgen"
+	"restapi"
+)
+
+// place opens an order of type |t| for |o.Amount| at |o.Price| at the exchange of market |m|.
+// Orders are not idempotent, so a failed order is never sent again blindly: after a temporary error (see restapi.Temporary)
+// the order may have reached the exchange anyway, and it is only sent again once reconcile has shown that it was not placed.
+// Orders rejected by the exchange (see xgen.ExchangeError) are only sent again if the exchange was rate limited or unavailable.
+// The balance is read before the first attempt, so that orders filled at once (which never show up as open orders) are noticed too.
+// Failed orders are not sent again once the program is shutting down (see Shutdown).
+func place(c xgen.Context, m *market, t xgen.OrderType, o xgen.Order) os.Error {
+	x := m.x
+	before, err := x.GetBalance(c)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		if t == xgen.BuyOrder {
+			err = x.Buy(c, pair, o.Price, o.Amount)
+		} else {
+			err = x.Sell(c, pair, o.Price, o.Amount)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, ok := xgen.Unwrap(err).(*xgen.ExchangeError); ok { // The exchange answered and rejected the order, so it was not placed
+			if !restapi.Temporary(err) || attempt >= restapi.Retries.Attempts {
+				return err
+			}
+			if guard.shuttingDown() {
+				return err
+			}
+			c.Warningf("%s: order was rejected, sending it again: %s", x.Name(), err)
+			time.Sleep(restapi.Retries.Delay(attempt))
+			continue
+		}
+		if !restapi.Temporary(err) {
+			return err
+		}
+		if attempt >= restapi.Retries.Attempts {
+			return os.NewError(fmt.Sprint("order may or may not have been placed after ", attempt, " attempts: ", err))
+		}
+		time.Sleep(restapi.Retries.Delay(attempt)) // Give the exchange time to show the order, if it was placed
+		placed, rerr := reconcile(c, m, t, before)
+		if rerr != nil {
+			return os.NewError(fmt.Sprint("order may or may not have been placed: ", err, " (checking the account failed: ", rerr, ")"))
+		}
+		if placed {
+			c.Warningf("%s: order was placed despite the error: %s", x.Name(), err)
+			return nil
+		}
+		if guard.shuttingDown() {
+			return os.NewError(fmt.Sprint("order was not placed, and not sent again when shutting down: ", err))
+		}
+		c.Warningf("%s: order was not placed, sending it again: %s", x.Name(), err)
+	}
+	panic("unreachable")
+}
+
+// reconcile tells whether an order of type |t| at the exchange of market |m| was placed after all, although sending it failed.
+// The order was placed if a new open order of the same type has appeared (compared to the open orders read earlier in the run),
+// or if the balance has changed from |before|.
+func reconcile(c xgen.Context, m *market, t xgen.OrderType, before xgen.Balance) (bool, os.Error) {
+	pending, err := m.x.GetOpenOrders(c, pair)
+	if err != nil {
+		return false, err
+	}
+	orders, known := pending.Buy, m.pending.Buy
+	if t == xgen.SellOrder {
+		orders, known = pending.Sell, m.pending.Sell
+	}
+	for oid, _ := range orders {
+		if _, ok := known[oid]; !ok {
+			return true, nil
+		}
+	}
+
+	after, err := m.x.GetBalance(c)
+	if err != nil {
+		return false, err
+	}
+	for _, cur := range []xgen.Currency{pair.Base, pair.Quote} {
+		if after[cur] != before[cur] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
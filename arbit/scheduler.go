@@ -0,0 +1,193 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"rand"
+	"sync"
+	"time"
+	"xgen"
+)
+
+// ErrRunning is returned by RunOnce when the previous run (or an execution of the engine) has not finished yet.
+var ErrRunning = os.NewError("previous run has not finished yet")
+
+// ErrShutdown is returned by RunOnce after Shutdown has been called.
+var ErrShutdown = os.NewError("shutting down")
+
+// ErrAborted is returned for the orders of a run that were not placed, because the run didn't finish within the grace
+// period of Shutdown and the open orders are being canceled.
+var ErrAborted = os.NewError("shutting down, the open orders are being canceled")
+
+// runGuard keeps the runs (and the executions of the engine) from overlapping, and tells when the program is shutting down.
+type runGuard struct {
+	lock     chan bool // Holds a value while a run is in progress
+	stopping chan bool // Closed by Shutdown
+	abort    chan bool // Closed by Shutdown when the grace period has passed, before canceling the open orders
+	once     sync.Once
+}
+
+func newRunGuard() *runGuard {
+	return &runGuard{lock: make(chan bool, 1), stopping: make(chan bool), abort: make(chan bool)}
+}
+
+var guard = newRunGuard()
+
+// tryLock starts a run, unless another one is in progress or the program is shutting down.
+func (g *runGuard) tryLock() os.Error {
+	if g.shuttingDown() {
+		return ErrShutdown
+	}
+	select {
+	case g.lock <- true:
+		return nil
+	default:
+	}
+	return ErrRunning
+}
+
+func (g *runGuard) unlock() {
+	<-g.lock
+}
+
+func (g *runGuard) shuttingDown() bool {
+	select {
+	case <-g.stopping:
+		return true
+	default:
+	}
+	return false
+}
+
+// aborted tells whether the run in progress must not place any more orders (see Shutdown).
+func (g *runGuard) aborted() bool {
+	select {
+	case <-g.abort:
+		return true
+	default:
+	}
+	return false
+}
+
+// Shutdown prepares for exiting the program: no new runs or trades are started after it has been called, and it waits up to
+// |grace| nanoseconds for the run (or the execution of the engine) in progress to finish. A run that doesn't finish in time
+// is stopped from placing any more orders (see trade), and the open orders are canceled at all the exchanges, so that no
+// orders are left behind unattended. Shutdown then waits up to |grace| again for the run to stop, and cancels the orders
+// once more, in case the run placed an order while they were being canceled. If the run still hasn't stopped, its orders
+// may be left open (the canceling is best effort), which the returned error tells.
+func Shutdown(c xgen.Context, w io.Writer, grace int64) os.Error {
+	return shutdown(c, w, grace, exchanges())
+}
+
+// shutdown is Shutdown canceling the open orders at exchanges |xs|.
+func shutdown(c xgen.Context, w io.Writer, grace int64, xs []xgen.Exchange) os.Error {
+	g := guard
+	g.once.Do(func() { close(g.stopping) })
+	select {
+	case g.lock <- true: // Never unlocked, so that nothing runs after the shutdown
+		return nil
+	case <-time.After(grace):
+	}
+	c.Warningf("Run did not finish in %d seconds, canceling the open orders", grace/1e9)
+	close(g.abort)
+	err := cancelAll(c, w, xs)
+	select {
+	case g.lock <- true:
+		return cancelAll(c, w, xs)
+	case <-time.After(grace):
+	}
+	if err != nil {
+		return err
+	}
+	return os.NewError("Run did not stop after canceling the open orders, so the orders it placed since may be left open")
+}
+
+// cancelAll cancels the open orders at exchanges |xs|.
+func cancelAll(c xgen.Context, w io.Writer, xs []xgen.Exchange) os.Error {
+	ms := make([]market, len(xs))
+	for i, x := range xs {
+		ms[i] = market{x: x}
+	}
+	canceled, late := gather(c, w, ms, "GetOpenOrders+CancelOrder", time.Nanoseconds()+timeout, func(m *market) (err os.Error) {
+		m.pending, err = m.x.GetOpenOrders(c, pair)
+		if err != nil {
+			return
+		}
+		return cancelOrders(c, m)
+	})
+	if len(canceled) < len(ms) {
+		return os.NewError(fmt.Sprint("Canceling the open orders failed at ", len(ms)-len(canceled), " of ", len(ms),
+			" exchanges (", len(late), " of them did not finish in time, so their orders may still be canceled)"))
+	}
+	return nil
+}
+
+// Scheduler runs the arbitrage once per |Interval|, moved randomly by up to |Jitter| either way (so that the runs don't hit
+// the exchanges at the same second every time). The interval is counted from the start of a run, and a run taking longer
+// than the interval delays the next one, so the runs never overlap (nor with the runs of the /cron/ handler, see RunOnce).
+type Scheduler struct {
+	Interval int64 // Nanoseconds
+	Jitter   int64 // Nanoseconds
+
+	c    xgen.Context
+	w    io.Writer
+	rnd  *rand.Rand
+	stop chan bool
+}
+
+// NewScheduler returns a scheduler for running the arbitrage once per |interval| nanoseconds (with up to |jitter| nanoseconds
+// of random variation), logging to |c| and writing the reports of the runs to |w|. It doesn't run anything until Start is called.
+func NewScheduler(c xgen.Context, w io.Writer, interval int64, jitter int64) *Scheduler {
+	return &Scheduler{Interval: interval, Jitter: jitter, c: c, w: w,
+		rnd: rand.New(rand.NewSource(time.Nanoseconds())), stop: make(chan bool)}
+}
+
+// Start starts the runs in the background, the first one at once.
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// Stop stops the scheduler from starting new runs (see Shutdown for waiting for the run in progress). It cannot be started again.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) run() {
+	next := time.Nanoseconds()
+	for {
+		wait := next - time.Nanoseconds()
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+		start := time.Nanoseconds()
+		switch err := RunOnce(s.c, s.w); err {
+		case nil:
+		case ErrRunning:
+			s.c.Warningf("Scheduled run skipped: %s", err)
+		case ErrShutdown:
+			return
+		default:
+			s.c.Criticalf("%s", err)
+		}
+		next = start + s.delay()
+	}
+	panic("unreachable")
+}
+
+// delay returns the time from the start of a run to the start of the next one.
+func (s *Scheduler) delay() int64 {
+	d := s.Interval
+	if s.Jitter > 0 {
+		d += s.rnd.Int63n(2*s.Jitter+1) - s.Jitter
+	}
+	return d
+}
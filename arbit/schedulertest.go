@@ -0,0 +1,95 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"time"
+	"xgen"
+	"restapi"
+)
+
+// TestScheduler checks the jitter of the scheduler, that the runs don't overlap, and that Shutdown waits for the run in progress
+// (and that the open orders can be canceled if it doesn't finish).
+func TestScheduler() os.Error {
+	s := NewScheduler(nil, nil, 10e9, 2e9)
+	min, max := s.Interval, s.Interval
+	for i := 0; i < 100; i++ {
+		d := s.delay()
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if min < 8e9 || max > 12e9 || min == max {
+		return os.NewError(fmt.Sprint("TestScheduler: delays between ", min, " and ", max, " ns, want between 8e9 and 12e9"))
+	}
+
+	savedGuard := guard
+	guard = newRunGuard()
+	defer func() { guard = savedGuard }()
+	c := restapi.NewTestContext()
+
+	// A run in progress (e.g. started by the /cron/ handler) keeps the next one from starting
+	if err := guard.tryLock(); err != nil {
+		return os.NewError("TestScheduler: tryLock: " + err.String())
+	}
+	if err := RunOnce(c, ioutil.Discard); err != ErrRunning {
+		return os.NewError(fmt.Sprint("TestScheduler: RunOnce during a run returned ", err, ", want ", ErrRunning))
+	}
+
+	// Shutdown waits for the run to finish, after which no runs are started
+	go func() {
+		time.Sleep(50e6)
+		guard.unlock()
+	}()
+	start := time.Nanoseconds()
+	if err := Shutdown(c, ioutil.Discard, 2e9); err != nil {
+		return os.NewError("TestScheduler: Shutdown: " + err.String())
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed < 50e6 || elapsed >= 2e9 {
+		return os.NewError(fmt.Sprint("TestScheduler: Shutdown returned after ", elapsed/1e6, " ms, want when the run finished (50 ms)"))
+	}
+	if err := RunOnce(c, ioutil.Discard); err != ErrShutdown {
+		return os.NewError(fmt.Sprint("TestScheduler: RunOnce after Shutdown returned ", err, ", want ", ErrShutdown))
+	}
+
+	// The open orders left behind by a run not finishing in time are canceled
+	x := &testExchange{name: "ExchA", open: map[string]xgen.OpenOrder{"1": {}, "2": {}}}
+	if err := cancelAll(c, ioutil.Discard, []xgen.Exchange{x}); err != nil {
+		return os.NewError("TestScheduler: cancelAll: " + err.String())
+	}
+	if len(x.open) != 0 {
+		return os.NewError(fmt.Sprint("TestScheduler: ", len(x.open), " orders left open after cancelAll"))
+	}
+
+	// A run not finishing in time places no more orders once the open orders are being canceled, and Shutdown waits for it
+	// to stop before canceling them once more
+	guard = newRunGuard()
+	if err := guard.tryLock(); err != nil {
+		return os.NewError("TestScheduler: tryLock: " + err.String())
+	}
+	x = &testExchange{name: "ExchA", open: map[string]xgen.OpenOrder{"1": {}}}
+	aborted := make(chan os.Error, 1)
+	go func() {
+		for !guard.aborted() {
+			time.Sleep(5e6)
+		}
+		aborted <- trade(c, ioutil.Discard, &market{x: x}, xgen.Order{xgen.NewDecimal(10), xgen.One}, xgen.Order{})
+		time.Sleep(20e6)
+		guard.unlock()
+	}()
+	if err := shutdown(c, ioutil.Discard, 50e6, []xgen.Exchange{x}); err != nil {
+		return os.NewError("TestScheduler: Shutdown after the grace period: " + err.String())
+	}
+	if err := xgen.Unwrap(<-aborted); err != ErrAborted || x.placed() != 0 || len(x.open) != 0 {
+		return os.NewError(fmt.Sprint("TestScheduler: order during the cancel = ", err, " with ", x.placed(), " orders placed and ",
+			len(x.open), " left open, want ", ErrAborted, " and none"))
+	}
+	return nil
+}
@@ -3,38 +3,462 @@
 
 package arbit
 
-import "xgen"
-
-func init() {
-	// Login credentials
-	login[mtGox] = xgen.Credentials{Username: "<username>", Password: "<password>"}
-	login[tradeHill] = xgen.Credentials{Username: "<username>", Password: "<password>"}
-	//	login[campBx] = xgen.Credentials{Username: "<username>", Password: "<password>"}
-	//	login[bitcoinica] = xgen.Credentials{Username: "<username>", Password: "<password>"}
-
-	// Commissions per trade (volume discounts may be available, so adjust these to reflect your commission level)
-	commission[mtGox] = 0.0060           // MtGox commission without volume discounts is currently 0.6% (=0.0060)
-	commission[tradeHill] = 0.0060 * 0.9 // TradeHill commissions reduced by 10% if account is created via referral code/link
-	//	commission[campBx] = 0.0055 * 0.9 // CampBX commissions reduced by 10% if account is created via referral code/link
-	//	commission[bitcoinica] = 0 // Bitcoinica doesn't have a fixed commission - they adjust the spread between buy and sell instead
-
-	/*
-		If you don't have referral codes for TradeHill or CampBX but want to get the reduced commissions, feel free to use these:
-		TradeHill: TH-R115773
-		CampBX: https://CampBX.com/register.php?r=IPxoWpqzIq0
-		Disclaimer! If you do use either of these codes, I will also receive 10% of the commissions you generate.
-	*/
-
-	// Minimum transaction sizes
-	minTrade[mtGox][xgen.USD] = 0.01
-	minTrade[mtGox][xgen.BTC] = 0.01
-	minTrade[tradeHill][xgen.USD] = 1 // TradeHill's minimum transaction size is $1
-	minTrade[tradeHill][xgen.BTC] = 0
-	//	minTrade[campBx][xgen.USD] = 0
-	//	minTrade[campBx][xgen.BTC] = 0.1 // CampBX's minimum transaction size is 0.1 BTC
-	//	minTrade[bitcoinica][xgen.USD] = 0.02
-	//	minTrade[bitcoinica][xgen.BTC] = 0.02 // Bitcoinica's minimum transaction size is 0.02 units
-
-	onesidedArb = true
-	paperTrade = false // Set true for testing/debugging only
+import (
+	"os"
+	"fmt"
+	"json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"xgen"
+	"restapi"
+	"secrets"
+	"mtgox"
+	"tradehill"
+	"campbx"
+	"simex"
+	"faults"
+)
+
+// Config contains the settings of ArBit, read from a JSON file (see arbit.json.example).
+type Config struct {
+	Pair        string // Trading pair to arbitrage, e.g. "BTC/USD" (the default)
+	OnesidedArb bool   // See onesidedArb
+	PaperTrade  bool   // Trade at simulated exchanges (see package simex) with the order books of the real ones
+	Timeout     int64  // Seconds allowed for fetching the data of a run (30 if zero)
+	Retry       RetryConfig
+	Engine      EngineConfig
+	Secrets     SecretsConfig
+	Faults      FaultsConfig
+	Exchanges   []ExchangeConfig
+}
+
+// RetryConfig tells how the failed API calls are retried (see restapi.RetryPolicy). The defaults of restapi.Retries are used for zero values.
+type RetryConfig struct {
+	Attempts   int   // Total number of attempts of each call
+	Backoff    int64 // Milliseconds to wait after the first failed attempt (doubled after each attempt)
+	MaxBackoff int64 // Maximum milliseconds to wait between the attempts
+}
+
+// EngineConfig contains the settings of the event-driven engine (see Engine). The defaults are used for zero values.
+type EngineConfig struct {
+	Debounce int64 // Milliseconds to wait for more order book changes before evaluating (100 by default)
+	MaxRate  int   // Maximum evaluations per second (1 by default)
+	Poll     int64 // Milliseconds between polling the order books of the exchanges without a stream (10000 by default)
+	MaxAge   int64 // Milliseconds an order book is used for after it was received (60000 by default)
+}
+
+// SecretsConfig tells where to look for the exchange credentials missing from the config. The configured providers are
+// asked in the order below, for secrets named by the exchange and the field, e.g. "MtGox.Username" and "MtGox.Password".
+type SecretsConfig struct {
+	Env      string   // Prefix of the environment variables, e.g. "ARBIT" for ARBIT_MTGOX_PASSWORD
+	Keystore string   // Path of an encrypted keystore file (see cmd/arbitkeys), with the passphrase in the environment variable secrets.PassphraseVar
+	Command  []string // External program and its arguments, run with the name of the secret as the last argument
+}
+
+// FaultsConfig injects faults into the calls to the exchanges for chaos testing (see package faults). The faults are only allowed
+// in paper trade mode, or for the exchanges whose URL is set (e.g. to a stand-in), so that they are never injected when trading real money.
+type FaultsConfig struct {
+	Seed  int64         // Seed of the random faults, for repeating a test (the time if zero)
+	Rules []faults.Rule // E.g. {"Exchange": "MtGox", "Call": "Sell", "Kind": "Fail", "Probability": 0.2}
+}
+
+func (sc *SecretsConfig) enabled() bool {
+	return sc.Env != "" || sc.Keystore != "" || len(sc.Command) > 0
+}
+
+// provider returns the configured secrets providers chained together.
+func (sc *SecretsConfig) provider() (secrets.Provider, os.Error) {
+	var chain secrets.Chain
+	if sc.Env != "" {
+		chain = append(chain, &secrets.Env{Prefix: sc.Env})
+	}
+	if sc.Keystore != "" {
+		k, err := secrets.OpenKeystore(sc.Keystore, os.Getenv(secrets.PassphraseVar))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, k)
+	}
+	if len(sc.Command) > 0 {
+		chain = append(chain, &secrets.Command{Path: sc.Command[0], Args: sc.Command[1:]})
+	}
+	return chain, nil
+}
+
+// ExchangeConfig contains the settings of a single exchange. Exchanges are used in the order they are listed in the config.
+type ExchangeConfig struct {
+	Name       string // One of the names in adapters, e.g. "MtGox"
+	Enabled    bool
+	Username   string // Username and Password (or Key and Secret) are read from the secrets providers if not given here
+	Password   string
+	Key        string                  // API key for signed requests, used instead of the password by the exchanges supporting it
+	Secret     string                  // API secret, as given by the exchange
+	Commission xgen.Decimal            // Commission per trade, e.g. 0.006 for 0.6%
+	MinTrade   map[string]xgen.Decimal // Minimum transaction size by currency code, e.g. {"BTC": 0.01, "USD": 1}
+	Public     LimitConfig             // Rate limit of the market data API
+	Private    LimitConfig             // Rate limit of the authenticated API
+	URL        string                  // Base URL of the API, e.g. of a sandbox, a mirror or a local stand-in (the real exchange if empty)
+	HTTP       HTTPConfig              // Middleware of the HTTP requests
+	Stream     string                  // URL of the market data stream used by the engine, e.g. "ws://localhost:8081/" (polled if empty)
+	PaperFunds map[string]xgen.Decimal // Starting balance of the simulated account in paper trade mode by currency code, e.g. {"BTC": 10, "USD": 1000}
+}
+
+// LimitConfig is the rate limit of an API (see restapi.Limiter).
+type LimitConfig struct {
+	Interval int64 // Milliseconds between calls on average (defaultInterval if zero)
+	Burst    int   // Number of calls allowed at once (1 if zero)
+}
+
+// HTTPConfig sets the middleware the HTTP requests to an exchange go through (see restapi.Middleware).
+type HTTPConfig struct {
+	UserAgent string            // User-Agent header of the requests (the default of the HTTP library if empty)
+	Headers   map[string]string // Other headers of the requests
+	Gzip      bool              // Ask for compressed responses
+	MaxBytes  int64             // Maximum size of a response in bytes (unlimited if zero)
+}
+
+// middleware returns the middleware set by the config. MaxBytes comes before Gzip, so that it limits the decompressed
+// responses (a small compressed response could otherwise expand without limit).
+func (h *HTTPConfig) middleware() (ms []restapi.Middleware) {
+	if h.MaxBytes > 0 {
+		ms = append(ms, restapi.MaxBytes(h.MaxBytes))
+	}
+	if h.UserAgent != "" {
+		ms = append(ms, restapi.UserAgent(h.UserAgent))
+	}
+	for k, v := range h.Headers {
+		ms = append(ms, restapi.Header(k, v))
+	}
+	if h.Gzip {
+		ms = append(ms, restapi.Gzip())
+	}
+	return
+}
+
+// adapter creates the API client of an exchange.
+type adapter struct {
+	newExchange func(login xgen.Credentials, client restapi.Client) xgen.Exchange
+	keyAuth     bool // Supports API keys (signed requests) in addition to the password
+}
+
+// adapters contains the supported exchanges by exchange name.
+var adapters = map[string]adapter{
+	"MtGox":     {func(login xgen.Credentials, cl restapi.Client) xgen.Exchange { return &mtgox.Exchange{login, cl} }, true},
+	"TradeHill": {func(login xgen.Credentials, cl restapi.Client) xgen.Exchange { return &tradehill.Exchange{login, cl} }, false},
+	"CampBX":    {func(login xgen.Credentials, cl restapi.Client) xgen.Exchange { return &campbx.Exchange{login, cl} }, false},
+}
+
+const defaultInterval = 500 // Milliseconds between API calls, unless configured otherwise
+
+// LoadConfig reads and validates the config file |path|.
+func LoadConfig(path string) (*Config, os.Error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(b)
+	if err != nil {
+		return nil, os.NewError(path + ": " + err.String())
+	}
+	return cfg, nil
+}
+
+// ParseConfig decodes a JSON encoded config and validates it.
+func ParseConfig(b []byte) (*Config, os.Error) {
+	cfg := new(Config)
+	err := json.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the config for missing and inconsistent values, and returns an error listing all the problems found.
+func (cfg *Config) Validate() os.Error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	pair := xgen.BTCUSD
+	if cfg.Pair != "" {
+		p, err := xgen.ParsePair(cfg.Pair)
+		if err != nil {
+			problem("%s", err)
+		} else {
+			pair = p
+		}
+	}
+
+	enabled := 0
+	seen := make(map[string]bool)
+	for i, x := range cfg.Exchanges {
+		name := x.Name
+		if name == "" {
+			problem("exchange #%d: missing name", i+1)
+			continue
+		}
+		if seen[name] {
+			problem("exchange %s: listed more than once", name)
+		}
+		seen[name] = true
+		a, ok := adapters[name]
+		if !ok {
+			problem("exchange %s: unknown exchange (supported exchanges are %s)", name, strings.Join(adapterNames(), ", "))
+			continue
+		}
+		if !x.Enabled {
+			continue
+		}
+		enabled++
+		if !cfg.PaperTrade { // The simulated exchanges only read the public order books, so they need no credentials
+			for _, v := range []string{x.Username, x.Password, x.Key, x.Secret} {
+				if strings.HasPrefix(v, "<") {
+					problem("exchange %s: placeholder credentials", name)
+					break
+				}
+			}
+			hasKey, hasPassword := x.Key != "" || x.Secret != "", x.Username != "" && x.Password != ""
+			switch {
+			case hasKey && !a.keyAuth:
+				problem("exchange %s: API keys are not supported (use the username and password)", name)
+			case hasKey && (x.Key == "" || x.Secret == ""):
+				problem("exchange %s: API key given without secret, or secret without key", name)
+			case !hasKey && !hasPassword && !cfg.Secrets.enabled():
+				problem("exchange %s: missing username or password (and no secrets provider configured)", name)
+			}
+		}
+		if x.Commission < 0 || x.Commission >= xgen.One {
+			problem("exchange %s: commission %s is not between 0 and 1", name, x.Commission)
+		}
+		for c, v := range x.MinTrade {
+			if xgen.Currency(c) != pair.Base && xgen.Currency(c) != pair.Quote {
+				problem("exchange %s: minimum trade size given for %s, which is not traded in %s", name, c, pair)
+			}
+			if v < 0 {
+				problem("exchange %s: negative minimum trade size for %s", name, c)
+			}
+		}
+		for c, v := range x.PaperFunds {
+			if xgen.Currency(c) != pair.Base && xgen.Currency(c) != pair.Quote {
+				problem("exchange %s: paper trade funds given for %s, which is not traded in %s", name, c, pair)
+			}
+			if v < 0 {
+				problem("exchange %s: negative paper trade funds for %s", name, c)
+			}
+		}
+		for _, l := range []LimitConfig{x.Public, x.Private} {
+			if l.Interval < 0 || l.Burst < 0 {
+				problem("exchange %s: negative rate limit", name)
+				break
+			}
+		}
+		if x.URL != "" && !strings.HasPrefix(x.URL, "http://") && !strings.HasPrefix(x.URL, "https://") {
+			problem("exchange %s: API URL %s is not an HTTP URL", name, x.URL)
+		}
+		if x.HTTP.MaxBytes < 0 {
+			problem("exchange %s: negative maximum response size", name)
+		}
+		if x.Stream != "" && !strings.HasPrefix(x.Stream, "ws://") && !strings.HasPrefix(x.Stream, "wss://") {
+			problem("exchange %s: stream URL %s is not a websocket URL", name, x.Stream)
+		}
+		if !xgen.Supports(a.newExchange(xgen.Credentials{}, restapi.Client{}), pair) {
+			problem("exchange %s: trading pair %s is not supported", name, pair)
+		}
+	}
+	if enabled < 2 {
+		problem("at least two exchanges must be enabled for arbitrage (%d enabled)", enabled)
+	}
+	if cfg.Timeout < 0 {
+		problem("negative timeout")
+	}
+	if r := cfg.Retry; r.Attempts < 0 || r.Backoff < 0 || r.MaxBackoff < 0 {
+		problem("retry: negative attempts or backoff")
+	} else if r.MaxBackoff > 0 && r.MaxBackoff < r.Backoff {
+		problem("retry: maximum backoff is less than the backoff")
+	}
+	if e := cfg.Engine; e.Debounce < 0 || e.MaxRate < 0 || e.Poll < 0 || e.MaxAge < 0 {
+		problem("engine: negative debounce, rate, poll interval or book age")
+	}
+	for i, r := range cfg.Faults.Rules {
+		if err := r.Validate(); err != nil {
+			problem("faults: rule #%d: %s", i+1, err)
+		}
+		known := r.Exchange == ""
+		for _, x := range cfg.Exchanges {
+			if x.Enabled && (r.Exchange == "" || r.Exchange == x.Name) {
+				known = true
+				if !cfg.PaperTrade && x.URL == "" {
+					problem("faults: rule #%d: exchange %s trades real money (enable PaperTrade or set the URL of a stand-in)", i+1, x.Name)
+				}
+			}
+		}
+		if !known {
+			problem("faults: rule #%d: exchange %s is not enabled", i+1, r.Exchange)
+		}
+	}
+	if len(cfg.Secrets.Command) > 0 && cfg.Secrets.Command[0] == "" {
+		problem("secrets: empty command")
+	}
+	if cfg.Secrets.Keystore != "" && os.Getenv(secrets.PassphraseVar) == "" {
+		problem("secrets: keystore %s configured but %s is not set", cfg.Secrets.Keystore, secrets.PassphraseVar)
+	}
+
+	if len(problems) > 0 {
+		return os.NewError("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Configure reads the missing credentials from the secrets providers (except in paper trade mode), registers the enabled
+// exchanges and applies the settings of |cfg|, which must have been validated. It can only be called once, since exchanges
+// cannot be registered twice.
+func Configure(cfg *Config) os.Error {
+	p, err := cfg.Secrets.provider()
+	if err != nil {
+		return err
+	}
+	logins := make([]xgen.Credentials, len(cfg.Exchanges))
+	for i, x := range cfg.Exchanges {
+		if x.Enabled && !cfg.PaperTrade {
+			logins[i], err = credentials(p, x, adapters[x.Name].keyAuth)
+			if err != nil {
+				return os.NewError("exchange " + x.Name + ": " + err.String())
+			}
+		}
+	}
+
+	pair = xgen.BTCUSD
+	if cfg.Pair != "" {
+		pair, _ = xgen.ParsePair(cfg.Pair)
+	}
+	onesidedArb = cfg.OnesidedArb
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout * 1e9
+	}
+	if cfg.Retry.Attempts > 0 {
+		restapi.Retries.Attempts = cfg.Retry.Attempts
+	}
+	if cfg.Retry.Backoff > 0 {
+		restapi.Retries.Backoff = cfg.Retry.Backoff * 1e6
+	}
+	if cfg.Retry.MaxBackoff > 0 {
+		restapi.Retries.MaxBackoff = cfg.Retry.MaxBackoff * 1e6
+	}
+	if cfg.Engine.Debounce > 0 {
+		debounce = cfg.Engine.Debounce * 1e6
+	}
+	if cfg.Engine.MaxRate > 0 {
+		minInterval = 1e9 / int64(cfg.Engine.MaxRate)
+	}
+	if cfg.Engine.Poll > 0 {
+		pollInterval = cfg.Engine.Poll * 1e6
+	}
+	if cfg.Engine.MaxAge > 0 {
+		maxBookAge = cfg.Engine.MaxAge * 1e6
+	}
+
+	var injector *faults.Injector
+	if len(cfg.Faults.Rules) > 0 {
+		seed := cfg.Faults.Seed
+		if seed == 0 {
+			seed = time.Nanoseconds()
+		}
+		injector = faults.New(seed, cfg.Faults.Rules)
+	}
+	for i, x := range cfg.Exchanges {
+		if !x.Enabled {
+			continue
+		}
+		commission[x.Name] = x.Commission
+		limit := make(xgen.Balance)
+		for c, v := range x.MinTrade {
+			limit[xgen.Currency(c)] = v
+		}
+		minTrade[x.Name] = limit
+		e := adapters[x.Name].newExchange(logins[i], restapi.Client{BaseURL: x.URL, Middleware: x.HTTP.middleware()})
+		if cfg.PaperTrade {
+			funds := make(xgen.Balance)
+			for c, v := range x.PaperFunds {
+				funds[xgen.Currency(c)] = v
+			}
+			sim := simex.Simulate(e, funds, x.Commission)
+			sim.MinTrade = limit
+			e = sim
+		}
+		if injector != nil {
+			e = injector.Wrap(e)
+		}
+		xgen.Register(e)
+		setLimit(x.Name, restapi.Public, x.Public)
+		setLimit(x.Name, restapi.Private, x.Private)
+		if x.Stream != "" {
+			streamURL[x.Name] = x.Stream
+		}
+	}
+	return nil
+}
+
+// credentials returns the login of exchange |x|, reading the values missing from the config from provider |p|.
+// If the exchange supports API keys (|keyAuth|) and a key is available, the username and password are not needed.
+// The key is only looked up if the config doesn't give both the username and password, and since it is optional,
+// failing to read it only matters if the username or password is missing too (some providers, like a secrets command,
+// fail for the entries they don't have). All the values are registered to be redacted from the logs and error messages.
+func credentials(p secrets.Provider, x ExchangeConfig, keyAuth bool) (login xgen.Credentials, err os.Error) {
+	login = xgen.Credentials{x.Username, x.Password, x.Key, x.Secret}
+	var keyErr os.Error
+	if keyAuth && login.Key == "" && (login.Username == "" || login.Password == "") {
+		login.Key, keyErr = p.Secret(x.Name + ".Key")
+		if keyErr != nil {
+			login.Key = ""
+		}
+	}
+	if login.Key != "" {
+		if login.Secret == "" {
+			login.Secret, err = secrets.Get(p, x.Name+".Secret")
+			if err != nil {
+				return
+			}
+		}
+		secrets.Register(login.Key)
+		secrets.Register(login.Secret)
+		return
+	}
+	if login.Username == "" {
+		login.Username, err = secrets.Get(p, x.Name+".Username")
+	}
+	if err == nil && login.Password == "" {
+		login.Password, err = secrets.Get(p, x.Name+".Password")
+	}
+	if err != nil {
+		if keyErr != nil && keyErr != secrets.ErrNotFound {
+			err = os.NewError(err.String() + " (and " + x.Name + ".Key: " + keyErr.String() + ")")
+		}
+		return
+	}
+	secrets.Register(login.Username)
+	secrets.Register(login.Password)
+	return
+}
+
+func setLimit(exchange string, class restapi.Class, l LimitConfig) {
+	interval := l.Interval
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	restapi.SetLimit(exchange, class, interval*1e6, l.Burst)
+}
+
+func adapterNames() (names []string) {
+	for name := range adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
 }
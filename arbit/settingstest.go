@@ -0,0 +1,138 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+package arbit
+
+import (
+	"os"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"strings"
+	"restapi"
+)
+
+type configTest struct {
+	in  string
+	out []string // Problems that must be reported (empty if the config is valid)
+}
+
+var configTests = []configTest{
+	{`{"Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p", "Commission": "0.006", "MinTrade": {"BTC": "0.01"}},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p", "Commission": 0.0054}]}`,
+		nil},
+	{`{"Pair": "BTC/JPY", "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "<username>", "Password": "p", "MinTrade": {"USD": "1"}},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p", "Commission": "1.5", "Private": {"Interval": -1}}, {"Name": "ExchB"}]}`,
+		[]string{"MtGox: placeholder credentials", "MtGox: minimum trade size given for USD", "TradeHill: commission 1.5 is not between 0 and 1",
+			"TradeHill: negative rate limit", "TradeHill: trading pair BTC/JPY is not supported", "ExchB: unknown exchange"}},
+	{`{"Retry": {"Attempts": -1}, "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p"},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p"}]}`,
+		[]string{"retry: negative attempts"}},
+	{`{"Engine": {"MaxRate": -1}, "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p", "Stream": "http://localhost/"},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p", "Stream": "ws://localhost:8081/"}]}`,
+		[]string{"engine: negative", "MtGox: stream URL http://localhost/ is not a websocket URL"}},
+	{`{"Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p", "URL": "http://localhost:8080/api/0"},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p", "URL": "localhost", "HTTP": {"MaxBytes": -1}}]}`,
+		[]string{"TradeHill: API URL localhost is not an HTTP URL", "TradeHill: negative maximum response size"}},
+	{`{"PaperTrade": true, "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p", "PaperFunds": {"BTC": "10", "EUR": "100"}},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p", "PaperFunds": {"USD": "-1"}}]}`,
+		[]string{"MtGox: paper trade funds given for EUR", "TradeHill: negative paper trade funds for USD"}},
+	{`{"Faults": {"Rules": [{"Call": "Sell", "Kind": "Hang", "Probability": 0.5}, {"Exchange": "CampBX", "Kind": "Fail"}, {"Kind": "Stale", "Call": "Buy"}]},
+		"Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p", "URL": "http://localhost:8080/api/0"},
+		{"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p"}]}`,
+		[]string{"rule #1: exchange TradeHill trades real money", "rule #2: exchange CampBX is not enabled", "rule #3: Stale fault in Buy"}},
+	{`{"PaperTrade": true, "Faults": {"Seed": 1, "Rules": [{"Exchange": "MtGox", "Call": "GetBalance", "Kind": "Stale", "Probability": 0.2}]},
+		"Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u", "Password": "p"}, {"Name": "TradeHill", "Enabled": true, "Username": "u", "Password": "p"}]}`,
+		nil},
+	{`{"PaperTrade": true, "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "<username>"}, {"Name": "TradeHill", "Enabled": true}]}`,
+		nil},
+	{`{"Pair": "BTC", "Exchanges": [{"Name": "MtGox", "Enabled": true, "Username": "u"}]}`,
+		[]string{"invalid trading pair", "at least two exchanges", "MtGox: missing username or password"}},
+	{`{"Exchanges": [{"Name": "MtGox", "Enabled": true, "Key": "k"}, {"Name": "TradeHill", "Enabled": true, "Key": "k", "Secret": "s"}]}`,
+		[]string{"MtGox: API key given without secret", "TradeHill: API keys are not supported"}},
+	{`{"Secrets": {"Env": "ARBIT"}, "Exchanges": [{"Name": "MtGox", "Enabled": true}, {"Name": "TradeHill", "Enabled": true}]}`,
+		nil},
+}
+
+// TestConfig checks that ParseConfig accepts valid configs and reports the problems of invalid ones.
+func TestConfig() os.Error {
+	for i, ct := range configTests {
+		_, err := ParseConfig([]byte(ct.in))
+		if len(ct.out) == 0 {
+			if err != nil {
+				return os.NewError(fmt.Sprint("ParseConfig (#", (i + 1), "): ", err))
+			}
+			continue
+		}
+		if err == nil {
+			return os.NewError(fmt.Sprint("ParseConfig (#", (i + 1), "): invalid config accepted"))
+		}
+		for _, p := range ct.out {
+			if strings.Index(err.String(), p) < 0 {
+				return os.NewError(fmt.Sprint("ParseConfig (#", (i + 1), ")<br>=<br>", err, "<br>want<br>", p))
+			}
+		}
+	}
+	return nil
+}
+
+// testProvider has the secrets of |values|, and fails for the others like a secrets command without the entry.
+type testProvider map[string]string
+
+func (p testProvider) Secret(name string) (string, os.Error) {
+	if s, ok := p[name]; ok {
+		return s, nil
+	}
+	return "", os.NewError("secrets: no entry for " + name)
+}
+
+// TestCredentials checks that a failure to read the optional API key doesn't stop a login with the username and password.
+func TestCredentials() os.Error {
+	p := testProvider{"MtGox.Password": "testpassword"}
+	login, err := credentials(p, ExchangeConfig{Name: "MtGox", Username: "testuser"}, true)
+	if err != nil || login.Username != "testuser" || login.Password != "testpassword" || login.Key != "" {
+		return os.NewError(fmt.Sprint("credentials (password from provider) = ", login.Username, ", ", login.Key, ", ", err,
+			", want the username and password and no key"))
+	}
+	p = testProvider{"MtGox.Key": "testkey", "MtGox.Secret": "testsecret"}
+	login, err = credentials(p, ExchangeConfig{Name: "MtGox"}, true)
+	if err != nil || login.Key != "testkey" || login.Secret != "testsecret" {
+		return os.NewError(fmt.Sprint("credentials (key from provider) = ", login.Key, ", ", err, ", want the key and secret"))
+	}
+	_, err = credentials(testProvider{}, ExchangeConfig{Name: "MtGox", Username: "testuser"}, true)
+	if err == nil || strings.Index(err.String(), "MtGox.Password") < 0 || strings.Index(err.String(), "MtGox.Key") < 0 {
+		return os.NewError(fmt.Sprint("credentials (nothing in provider) = ", err, ", want errors for the password and the key"))
+	}
+	return nil
+}
+
+// TestHTTPConfig checks that the maximum response size of the HTTP settings limits the decompressed responses,
+// with a compressed response much smaller than the limit expanding far beyond it.
+func TestHTTPConfig() os.Error {
+	var buf bytes.Buffer
+	z, err := gzip.NewWriter(&buf)
+	if err != nil {
+		return err
+	}
+	z.Write([]byte(`{"last": "`))
+	z.Write(make([]byte, 1<<20)) // 1 MB of zeros
+	z.Write([]byte(`"}`))
+	z.Close()
+	if buf.Len() >= 10000 {
+		return os.NewError(fmt.Sprint("TestHTTPConfig: compressed response of ", buf.Len(), " bytes, want less than the limit"))
+	}
+	server := restapi.TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+		h := make(http.Header)
+		h.Set("Content-Encoding", "gzip")
+		return &http.Response{StatusCode: 200, Header: h, Body: ioutil.NopCloser(bytes.NewBuffer(buf.Bytes())), ContentLength: int64(buf.Len())}, nil
+	})
+	h := HTTPConfig{Gzip: true, MaxBytes: 10000}
+	cl := restapi.Client{Transport: server, Middleware: h.middleware()}
+	var a map[string]string
+	if err = restapi.GetJson(cl.Context(restapi.TestContext{}), "http://example.com/ticker", &a); err != restapi.ErrTooLarge {
+		return os.NewError(fmt.Sprint("TestHTTPConfig: compressed response over MaxBytes = ", err, ", want ", restapi.ErrTooLarge))
+	}
+	return nil
+}
@@ -36,15 +36,16 @@ func (m arbOrders) Reverse() {
 	}
 }
 
-// Calculate calculates an optimal arbitrage strategy.
-func Calculate(book []xgen.OrderBook, funds []xgen.Balance, commission []float64, minTrade [][xgen.NumCurrencies]float64) (arb Strategy) {
+// Calculate calculates an optimal arbitrage strategy for trading |pair| (order books of other trading pairs are ignored).
+func Calculate(pair xgen.Pair, book []xgen.OrderBook, funds []xgen.Balance, commission []xgen.Decimal, minTrade []xgen.Balance) (arb Strategy) {
+	base, quote := pair.Base, pair.Quote
 	arb.Buy = make([]xgen.Order, len(book))
 	arb.Sell = make([]xgen.Order, len(book))
 
 	// Combine all order books into one
 	var arbBook arbOrderBook
 	for i, b := range book {
-		if !b.Validate() {
+		if b.Pair != pair || !b.Validate() {
 			continue
 		}
 		for _, o := range b.BuyTree {
@@ -60,12 +61,17 @@ func Calculate(book []xgen.OrderBook, funds []xgen.Balance, commission []float64
 			arbBook.sellTree = append(arbBook.sellTree, a)
 		}
 	}
+	if len(arbBook.buyTree) == 0 || len(arbBook.sellTree) == 0 {
+		return // Nothing to arbitrage (e.g. all the order books were left out)
+	}
 	sort.Sort(arbBook.buyTree)
 	sort.Sort(arbBook.sellTree)
 	arbBook.buyTree.Reverse()
 
 	fundsLeft := make([]xgen.Balance, len(funds))
-	copy(fundsLeft, funds)
+	for i, f := range funds {
+		fundsLeft[i] = f.Copy()
+	}
 
 	// Find the arbitrage trades
 	buyer, seller := 0, 0
@@ -73,56 +79,56 @@ func Calculate(book []xgen.OrderBook, funds []xgen.Balance, commission []float64
 	sellerExchange := arbBook.sellTree[seller].exchange
 	buyerAmount := arbBook.buyTree[buyer].order.Amount
 	sellerAmount := arbBook.sellTree[seller].order.Amount
-	for arbBook.buyTree[buyer].order.Price*(1-commission[buyerExchange]) > arbBook.sellTree[seller].order.Price/(1-commission[sellerExchange]) {
-		// If not enough BTC in the account for the minimum allowed trade size (sell), it's the same as if the account was empty of BTC
-		if fundsLeft[buyerExchange][xgen.BTC] < minTrade[buyerExchange][xgen.BTC] ||
-			fundsLeft[buyerExchange][xgen.BTC] < minTrade[buyerExchange][xgen.USD]/arbBook.buyTree[buyer].order.Price {
-			fundsLeft[buyerExchange][xgen.BTC] = 0
+	for arbBook.buyTree[buyer].order.Price.Mul(xgen.One-commission[buyerExchange]) > arbBook.sellTree[seller].order.Price.Div(xgen.One-commission[sellerExchange]) {
+		// If not enough of the base currency in the account for the minimum allowed trade size (sell), it's the same as if the account was empty of it
+		if fundsLeft[buyerExchange][base] < minTrade[buyerExchange][base] ||
+			fundsLeft[buyerExchange][base] < minTrade[buyerExchange][quote].Div(arbBook.buyTree[buyer].order.Price) {
+			fundsLeft[buyerExchange][base] = 0
 		}
-		// If not enough USD in the account for the minimum allowed trade size (buy), it's the same as if the account was empty of USD
-		if fundsLeft[sellerExchange][xgen.USD] < minTrade[sellerExchange][xgen.USD] ||
-			fundsLeft[sellerExchange][xgen.USD] < minTrade[sellerExchange][xgen.BTC]*arbBook.sellTree[seller].order.Price {
-			fundsLeft[sellerExchange][xgen.USD] = 0
+		// If not enough of the quote currency in the account for the minimum allowed trade size (buy), it's the same as if the account was empty of it
+		if fundsLeft[sellerExchange][quote] < minTrade[sellerExchange][quote] ||
+			fundsLeft[sellerExchange][quote] < minTrade[sellerExchange][base].Mul(arbBook.sellTree[seller].order.Price) {
+			fundsLeft[sellerExchange][quote] = 0
 		}
 
 		// Arbitrage found -> update the execution plan as long as funds still left
-		if fundsLeft[buyerExchange][xgen.BTC] > 0 {
+		if fundsLeft[buyerExchange][base] > 0 {
 			arb.Sell[buyerExchange].Price = arbBook.buyTree[buyer].order.Price
 		}
-		if fundsLeft[sellerExchange][xgen.USD] > 0 {
+		if fundsLeft[sellerExchange][quote] > 0 {
 			arb.Buy[sellerExchange].Price = arbBook.sellTree[seller].order.Price
 		}
 
-		// Can't make a bigger trades than we have funds for
-		if buyerAmount > fundsLeft[buyerExchange][xgen.BTC] {
-			buyerAmount = fundsLeft[buyerExchange][xgen.BTC]
+		// Can't make a bigger trades than we have funds for (the amounts limited by funds are rounded down, so that the cost never exceeds the funds)
+		if buyerAmount > fundsLeft[buyerExchange][base] {
+			buyerAmount = fundsLeft[buyerExchange][base]
 		}
-		if sellerAmount*arbBook.sellTree[seller].order.Price > fundsLeft[sellerExchange][xgen.USD] {
-			sellerAmount = fundsLeft[sellerExchange][xgen.USD] / arbBook.sellTree[seller].order.Price
+		if sellerAmount.Mul(arbBook.sellTree[seller].order.Price) > fundsLeft[sellerExchange][quote] {
+			sellerAmount = fundsLeft[sellerExchange][quote].DivTrunc(arbBook.sellTree[seller].order.Price)
 		}
 
 		// Available arbitrage is limited to the volume of the smaller side (buyer/seller).
-		// For the sake of simplicity, we keep the (absolute) amount of BTC same after the trade as it was before the trade (i.e. all the profit will be in USD),
+		// For the sake of simplicity, we keep the (absolute) amount of the base currency same after the trade as it was before the trade (i.e. all the profit will be in the quote currency),
 		// (even though theoretically a more correct way might be to keep the relative balances the same for all currencies).
 		switch {
-		case buyerAmount > sellerAmount*(1-commission[buyerExchange]):
-			buyerCapped := sellerAmount * (1 - commission[buyerExchange])
+		case buyerAmount > sellerAmount.Mul(xgen.One-commission[buyerExchange]):
+			buyerCapped := sellerAmount.Mul(xgen.One - commission[buyerExchange])
 			arb.Sell[buyerExchange].Amount += buyerCapped
 			arb.Buy[sellerExchange].Amount += sellerAmount
-			fundsLeft[buyerExchange][xgen.BTC] -= buyerCapped
-			fundsLeft[sellerExchange][xgen.USD] -= sellerAmount * arb.Buy[sellerExchange].Price
+			fundsLeft[buyerExchange][base] -= buyerCapped
+			fundsLeft[sellerExchange][quote] -= sellerAmount.Mul(arb.Buy[sellerExchange].Price)
 			buyerAmount -= buyerCapped
 			seller++
 			if seller == len(arbBook.sellTree) {
 				return
 			}
 			sellerAmount = arbBook.sellTree[seller].order.Amount
-		case buyerAmount < sellerAmount*(1-commission[buyerExchange]):
-			sellerCapped := buyerAmount / (1 - commission[buyerExchange])
+		case buyerAmount < sellerAmount.Mul(xgen.One-commission[buyerExchange]):
+			sellerCapped := buyerAmount.DivTrunc(xgen.One - commission[buyerExchange])
 			arb.Sell[buyerExchange].Amount += buyerAmount
 			arb.Buy[sellerExchange].Amount += sellerCapped
-			fundsLeft[buyerExchange][xgen.BTC] -= buyerAmount
-			fundsLeft[sellerExchange][xgen.USD] -= sellerCapped * arb.Buy[sellerExchange].Price
+			fundsLeft[buyerExchange][base] -= buyerAmount
+			fundsLeft[sellerExchange][quote] -= sellerCapped.Mul(arb.Buy[sellerExchange].Price)
 			sellerAmount -= sellerCapped
 			buyer++
 			if buyer == len(arbBook.buyTree) {
@@ -132,8 +138,8 @@ func Calculate(book []xgen.OrderBook, funds []xgen.Balance, commission []float64
 		default:
 			arb.Sell[buyerExchange].Amount += buyerAmount
 			arb.Buy[sellerExchange].Amount += sellerAmount
-			fundsLeft[buyerExchange][xgen.BTC] -= buyerAmount
-			fundsLeft[sellerExchange][xgen.USD] -= sellerAmount * arb.Buy[sellerExchange].Price
+			fundsLeft[buyerExchange][base] -= buyerAmount
+			fundsLeft[sellerExchange][quote] -= sellerAmount.Mul(arb.Buy[sellerExchange].Price)
 			buyer++
 			seller++
 			if buyer == len(arbBook.buyTree) || seller == len(arbBook.sellTree) {
@@ -148,21 +154,22 @@ func Calculate(book []xgen.OrderBook, funds []xgen.Balance, commission []float64
 	return
 }
 
-// Onesided adjusts the amounts in an existing strategy to balance the USD and BTC amounts within each exchange.
-func Onesided(strategy Strategy, funds []xgen.Balance, commission []float64) (newStgy Strategy) {
+// Onesided adjusts the amounts in an existing strategy to balance the base and quote currency amounts (e.g. BTC and USD) within each exchange.
+func Onesided(pair xgen.Pair, strategy Strategy, funds []xgen.Balance, commission []xgen.Decimal) (newStgy Strategy) {
+	base, quote := pair.Base, pair.Quote
 	newStgy.Buy = make([]xgen.Order, len(strategy.Buy))
 	newStgy.Sell = make([]xgen.Order, len(strategy.Sell))
 	copy(newStgy.Buy, strategy.Buy)
 	copy(newStgy.Sell, strategy.Sell)
 
 	for i := 0; i < len(funds); i++ {
-		usdLeft := funds[i][xgen.USD] + strategy.Sell[i].Amount*strategy.Sell[i].Price*(1-commission[i]) - strategy.Buy[i].Amount*strategy.Buy[i].Price
-		btcLeft := funds[i][xgen.BTC] + strategy.Buy[i].Amount*(1-commission[i]) - strategy.Sell[i].Amount
-		if strategy.Buy[i].Price > 0 && usdLeft > btcLeft*strategy.Buy[i].Price {
-			newStgy.Buy[i].Amount = strategy.Buy[i].Amount + (usdLeft/strategy.Buy[i].Price-btcLeft)/(2-commission[i])
+		quoteLeft := funds[i][quote] + strategy.Sell[i].Amount.Mul(strategy.Sell[i].Price).Mul(xgen.One-commission[i]) - strategy.Buy[i].Amount.Mul(strategy.Buy[i].Price)
+		baseLeft := funds[i][base] + strategy.Buy[i].Amount.Mul(xgen.One-commission[i]) - strategy.Sell[i].Amount
+		if strategy.Buy[i].Price > 0 && quoteLeft > baseLeft.Mul(strategy.Buy[i].Price) {
+			newStgy.Buy[i].Amount = strategy.Buy[i].Amount + (quoteLeft.DivTrunc(strategy.Buy[i].Price) - baseLeft).DivTrunc(2*xgen.One-commission[i])
 		}
-		if strategy.Sell[i].Price > 0 && btcLeft*strategy.Sell[i].Price > usdLeft {
-			newStgy.Sell[i].Amount = strategy.Sell[i].Amount + (btcLeft-usdLeft/strategy.Sell[i].Price)/(2-commission[i])
+		if strategy.Sell[i].Price > 0 && baseLeft.Mul(strategy.Sell[i].Price) > quoteLeft {
+			newStgy.Sell[i].Amount = strategy.Sell[i].Amount + (baseLeft - quoteLeft.Div(strategy.Sell[i].Price)).DivTrunc(2*xgen.One-commission[i])
 		}
 	}
 	return
@@ -15,83 +15,147 @@ import (
 type arbTest struct {
 	book       []xgen.OrderBook
 	funds      []xgen.Balance
-	commission []float64
-	minTrade   [][xgen.NumCurrencies]float64
+	commission []xgen.Decimal
+	minTrade   []xgen.Balance
 	out        Strategy
 }
 
 type onesidedTest struct {
 	funds      []xgen.Balance
-	commission []float64
+	commission []xgen.Decimal
 	in         Strategy
 	out        Strategy
 }
 
+// Helpers for writing the test data as floating point numbers.
+func o(price, amount float64) xgen.Order {
+	return xgen.Order{xgen.NewDecimal(price), xgen.NewDecimal(amount)}
+}
+
+func b(btc, usd float64) xgen.Balance {
+	return xgen.Balance{xgen.BTC: xgen.NewDecimal(btc), xgen.USD: xgen.NewDecimal(usd)}
+}
+
+func d(f ...float64) []xgen.Decimal {
+	x := make([]xgen.Decimal, len(f))
+	for i, v := range f {
+		x[i] = xgen.NewDecimal(v)
+	}
+	return x
+}
+
 var arbTests = []arbTest{
 	// Test #1: Arbitrage between 2 exchanges with 20% commissions: After commissions we would pay $7.50 to get 1.5 BTC, and sell 1.5 BTC for $8.40.
 	arbTest{
 		[]xgen.OrderBook{
-			{BuyTree: []xgen.Order{{8.0, 1.0}, {7.0, 2.0}}, SellTree: []xgen.Order{{9.0, 10.0}}}, // Price, Amount
-			{BuyTree: []xgen.Order{{1.0, 10.0}}, SellTree: []xgen.Order{{4.0, 2.0}}},
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(8.0, 1.0), o(7.0, 2.0)}, SellTree: []xgen.Order{o(9.0, 10.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(1.0, 10.0)}, SellTree: []xgen.Order{o(4.0, 2.0)}},
 		},
 		[]xgen.Balance{
-			[xgen.NumCurrencies]float64{1.5, 10.0}, // BTC, USD
-			[xgen.NumCurrencies]float64{10.0, 10.0},
+			b(1.5, 10.0), // BTC, USD
+			b(10.0, 10.0),
 		},
-		[]float64{0.2, 0.2},                           // commissions
-		[][xgen.NumCurrencies]float64{{0, 0}, {0, 0}}, // minimum allowed trade amounts
-		Strategy{Buy: []xgen.Order{{0, 0}, {4.0, 1.875}}, Sell: []xgen.Order{{7.0, 1.5}, {0, 0}}},
+		d(0.2, 0.2),            // commissions
+		[]xgen.Balance{{}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.0, 1.875)}, Sell: []xgen.Order{o(7.0, 1.5), o(0, 0)}},
 	},
 	// Test #2: 3-way arbitrage with no commissions (for simplicity).
 	arbTest{
 		[]xgen.OrderBook{
-			{BuyTree: []xgen.Order{{6.5, 1.0}, {5.5, 2.0}, {4.5, 4.0}}, SellTree: []xgen.Order{{10.0, 100.0}}}, // Price, Amount
-			{BuyTree: []xgen.Order{{1.0, 100.0}}, SellTree: []xgen.Order{{4.5, 1.0}, {5.5, 2.0}, {6.5, 4.0}}},
-			{BuyTree: []xgen.Order{{4.9, 2.0}, {4.8, 4.0}, {4.7, 8.0}}, SellTree: []xgen.Order{{5.0, 2.0}, {5.1, 4.0}, {5.2, 8.0}}},
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(6.5, 1.0), o(5.5, 2.0), o(4.5, 4.0)}, SellTree: []xgen.Order{o(10.0, 100.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(1.0, 100.0)}, SellTree: []xgen.Order{o(4.5, 1.0), o(5.5, 2.0), o(6.5, 4.0)}},
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(4.9, 2.0), o(4.8, 4.0), o(4.7, 8.0)}, SellTree: []xgen.Order{o(5.0, 2.0), o(5.1, 4.0), o(5.2, 8.0)}},
 		},
 		[]xgen.Balance{
-			[xgen.NumCurrencies]float64{2.0, 0.0}, // BTC, USD
-			[xgen.NumCurrencies]float64{0.0, 20.0},
-			[xgen.NumCurrencies]float64{0.5, 10.0},
+			b(2.0, 0.0), // BTC, USD
+			b(0.0, 20.0),
+			b(0.5, 10.0),
 		},
-		[]float64{0.0, 0.0, 0.0},                              // commissions
-		[][xgen.NumCurrencies]float64{{0, 0}, {0, 0}, {0, 0}}, // minimum allowed trade amounts
-		Strategy{Buy: []xgen.Order{{0, 0}, {4.5, 1.0}, {5.0, 1.0}}, Sell: []xgen.Order{{5.5, 2.0}, {0, 0}, {0, 0}}},
+		d(0.0, 0.0, 0.0),           // commissions
+		[]xgen.Balance{{}, {}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.5, 1.0), o(5.0, 1.0)}, Sell: []xgen.Order{o(5.5, 2.0), o(0, 0), o(0, 0)}},
 	},
 	// Test #3: Same as test #2 but adjusted account balances enough to change to output
 	arbTest{
 		[]xgen.OrderBook{
-			{BuyTree: []xgen.Order{{6.5, 1.0}, {5.5, 2.0}, {4.5, 4.0}}, SellTree: []xgen.Order{{10.0, 100.0}}}, // Price, Amount
-			{BuyTree: []xgen.Order{{1.0, 100.0}}, SellTree: []xgen.Order{{4.5, 1.0}, {5.5, 2.0}, {6.5, 4.0}}},
-			{BuyTree: []xgen.Order{{4.9, 2.0}, {4.8, 4.0}, {4.7, 8.0}}, SellTree: []xgen.Order{{5.0, 2.0}, {5.1, 4.0}, {5.2, 8.0}}},
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(6.5, 1.0), o(5.5, 2.0), o(4.5, 4.0)}, SellTree: []xgen.Order{o(10.0, 100.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(1.0, 100.0)}, SellTree: []xgen.Order{o(4.5, 1.0), o(5.5, 2.0), o(6.5, 4.0)}},
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(4.9, 2.0), o(4.8, 4.0), o(4.7, 8.0)}, SellTree: []xgen.Order{o(5.0, 2.0), o(5.1, 4.0), o(5.2, 8.0)}},
+		},
+		[]xgen.Balance{
+			b(2.0, 0.0), // BTC, USD
+			b(0.0, 20.0),
+			b(0.5, 2.5),
+		},
+		d(0.0, 0.0, 0.0),           // commissions
+		[]xgen.Balance{{}, {}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.5, 1.0), o(5.0, 0.5)}, Sell: []xgen.Order{o(5.5, 1.5), o(0, 0), o(0, 0)}},
+	},
+	// Test #4: Same as test #1 but with a BTC/EUR order book, which must not be arbitraged against the BTC/USD order books.
+	arbTest{
+		[]xgen.OrderBook{
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(8.0, 1.0), o(7.0, 2.0)}, SellTree: []xgen.Order{o(9.0, 10.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(1.0, 10.0)}, SellTree: []xgen.Order{o(4.0, 2.0)}},
+			{Pair: xgen.Pair{xgen.BTC, xgen.EUR}, BuyTree: []xgen.Order{o(20.0, 10.0)}, SellTree: []xgen.Order{o(1.0, 10.0)}},
+		},
+		[]xgen.Balance{
+			b(1.5, 10.0), // BTC, USD
+			b(10.0, 10.0),
+			b(10.0, 10.0),
+		},
+		d(0.2, 0.2, 0.2),           // commissions
+		[]xgen.Balance{{}, {}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.0, 1.875), o(0, 0)}, Sell: []xgen.Order{o(7.0, 1.5), o(0, 0), o(0, 0)}},
+	},
+	// Test #5: The buy is limited by $20 of funds at a price of $3, so the amount (20/3 BTC) is rounded down to 6.66666666 BTC,
+	// costing $19.99999998 (rounded to the nearest satoshi, 6.66666667 BTC would cost more than the funds).
+	arbTest{
+		[]xgen.OrderBook{
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(8.0, 100.0)}, SellTree: []xgen.Order{o(9.0, 100.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(1.0, 100.0)}, SellTree: []xgen.Order{o(3.0, 100.0)}},
+		},
+		[]xgen.Balance{
+			b(100.0, 0.0), // BTC, USD
+			b(0.0, 20.0),
+		},
+		d(0.0, 0.0),            // commissions
+		[]xgen.Balance{{}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(3.0, 6.66666666)}, Sell: []xgen.Order{o(8.0, 6.66666666), o(0, 0)}},
+	},
+	// Test #6: All the order books are left out (one-sided, empty or BTC/EUR), so there is nothing to trade.
+	arbTest{
+		[]xgen.OrderBook{
+			{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(8.0, 1.0)}}, // Price, Amount
+			{Pair: xgen.BTCUSD},
+			{Pair: xgen.Pair{xgen.BTC, xgen.EUR}, BuyTree: []xgen.Order{o(20.0, 10.0)}, SellTree: []xgen.Order{o(1.0, 10.0)}},
 		},
 		[]xgen.Balance{
-			[xgen.NumCurrencies]float64{2.0, 0.0}, // BTC, USD
-			[xgen.NumCurrencies]float64{0.0, 20.0},
-			[xgen.NumCurrencies]float64{0.5, 2.5},
+			b(10.0, 10.0), // BTC, USD
+			b(10.0, 10.0),
+			b(10.0, 10.0),
 		},
-		[]float64{0.0, 0.0, 0.0},                              // commissions
-		[][xgen.NumCurrencies]float64{{0, 0}, {0, 0}, {0, 0}}, // minimum allowed trade amounts
-		Strategy{Buy: []xgen.Order{{0, 0}, {4.5, 1.0}, {5.0, 0.5}}, Sell: []xgen.Order{{5.5, 1.5}, {0, 0}, {0, 0}}},
+		d(0.0, 0.0, 0.0),           // commissions
+		[]xgen.Balance{{}, {}, {}}, // minimum allowed trade amounts
+		Strategy{Buy: []xgen.Order{o(0, 0), o(0, 0), o(0, 0)}, Sell: []xgen.Order{o(0, 0), o(0, 0), o(0, 0)}},
 	},
 }
 
 var onesidedTests = []onesidedTest{
 	onesidedTest{
 		[]xgen.Balance{
-			[xgen.NumCurrencies]float64{2.0, 0.0}, // BTC, USD
-			[xgen.NumCurrencies]float64{1.0, 20.0},
-			[xgen.NumCurrencies]float64{1.0, 2.0},
+			b(2.0, 0.0), // BTC, USD
+			b(1.0, 20.0),
+			b(1.0, 2.0),
 		},
-		[]float64{0.4, 0.4, 0.4}, // commissions
-		Strategy{Buy: []xgen.Order{{0, 0}, {4.0, 1.0}, {4.0, 0.5}}, Sell: []xgen.Order{{6.0, 0.50}, {0, 0}, {0, 0}}},
-		Strategy{Buy: []xgen.Order{{0, 0}, {4.0, 2.5}, {4.0, 0.5}}, Sell: []xgen.Order{{6.0, 1.25}, {0, 0}, {0, 0}}},
+		d(0.4, 0.4, 0.4), // commissions
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.0, 1.0), o(4.0, 0.5)}, Sell: []xgen.Order{o(6.0, 0.50), o(0, 0), o(0, 0)}},
+		Strategy{Buy: []xgen.Order{o(0, 0), o(4.0, 2.5), o(4.0, 0.5)}, Sell: []xgen.Order{o(6.0, 1.25), o(0, 0), o(0, 0)}},
 	},
 }
 
 func TestCalculate( /*t *testing.T*/ ) os.Error {
 	for i, at := range arbTests {
-		v := Calculate(at.book, at.funds, at.commission, at.minTrade)
+		v := Calculate(xgen.BTCUSD, at.book, at.funds, at.commission, at.minTrade)
 		if fmt.Sprint(v) != fmt.Sprint(at.out) {
 			//t.Errorf("arbitrageStrategy = %d, want %d.", v, at.out)
 			return os.NewError(fmt.Sprint("ArbitrageStrategy (#", (i + 1), ")<br>", at.book, "<br>", at.funds, "<br>=<br>", v, "<br>want<br>", at.out))
@@ -102,7 +166,7 @@ func TestCalculate( /*t *testing.T*/ ) os.Error {
 
 func TestOnesided( /*t *testing.T*/ ) os.Error {
 	for i, ot := range onesidedTests {
-		v := Onesided(ot.in, ot.funds, ot.commission)
+		v := Onesided(xgen.BTCUSD, ot.in, ot.funds, ot.commission)
 		if fmt.Sprint(v) != fmt.Sprint(ot.out) {
 			//t.Errorf("onesidedArbitrage = %d, want %d.", v, ot.out)
 			return os.NewError(fmt.Sprint("OnesidedArbitrage (#", (i + 1), ")<br>", ot.in, "<br>=<br>", v, "<br>want<br>", ot.out))
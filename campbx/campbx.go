@@ -4,19 +4,53 @@
 // Package campbx implements functions for sending and receiving data via CampBX API.
 package campbx
 
+import (
+	"restapi"
+	"strings"
+	"xgen"
+)
+
 // CampBX API: https://campbx.com/api.php
+// The paths of the API functions are relative to the base URL of the API (DefaultURL unless configured otherwise).
 const (
+	DefaultURL = "https://campbx.com/api"
+
 	// Public Market Data
-	JsonTicker = "http://campbx.com/api/xticker.php"
-	JsonDepth  = "http://CampBX.com/api/xdepth.php"
+	JsonTicker = "/xticker.php"
+	JsonDepth  = "/xdepth.php"
 
 	// Authenticated Trading Functions
-	JsonBalance = "https://CampBX.com/api/myfunds.php"
-	JsonOrders  = "https://CampBX.com/api/myorders.php"
-	JsonBuySell = "https://CampBX.com/api/tradeenter.php"
-	JsonCancel  = "https://CampBX.com/api/tradecancel.php"
+	JsonBalance = "/myfunds.php"
+	JsonOrders  = "/myorders.php"
+	JsonBuySell = "/tradeenter.php"
+	JsonCancel  = "/tradecancel.php"
 )
 
+// Exchange implements the xgen.Exchange interface for CampBX. The base URL, transport and middleware of the HTTP requests
+// are set in the embedded restapi.Client (DefaultURL is used if the base URL is empty).
+type Exchange struct {
+	Login xgen.Credentials
+	restapi.Client
+}
+
+// Name returns the name of the exchange.
+func (e *Exchange) Name() string {
+	return "CampBX"
+}
+
+// url returns the URL of the API function at |path|.
+func (e *Exchange) url(path string) string {
+	if e.BaseURL == "" {
+		return DefaultURL + path
+	}
+	return strings.TrimRight(e.BaseURL, "/") + path
+}
+
+// Pairs returns the trading pairs supported by CampBX.
+func (e *Exchange) Pairs() []xgen.Pair {
+	return []xgen.Pair{xgen.BTCUSD}
+}
+
 // Quote is a struct representing the best available buy and sell prices at the time.
 type Quote struct {
 	Buy  string `json:"Best Bid"`
@@ -26,8 +60,8 @@ type Quote struct {
 
 // OrderBook is a struct representing a limit order book.
 type OrderBook struct {
-	Asks [][2]float64 // Sell orders (price and amount)
-	Bids [][2]float64 // Buy orders (price and amount)
+	Asks [][2]xgen.Decimal // Sell orders (price and amount)
+	Bids [][2]xgen.Decimal // Buy orders (price and amount)
 }
 
 const (
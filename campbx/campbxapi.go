@@ -4,55 +4,99 @@
 package campbx
 
 import (
-	"appengine"
 	"os"
 	"restapi"
 	"xgen"
-	"strconv"
 	"sort"
-	"appengine/datastore"
 	"time"
 )
 
-func check(err os.Error) {
-	if err != nil {
-		panic(err)
-	}
+// wrap adds the exchange and the API endpoint |url| to the error in |err|, if any (see xgen.WrapError).
+func (e *Exchange) wrap(url string, err *os.Error) {
+	*err = xgen.WrapError(e.Name(), url, *err)
+}
+
+// errorPatterns classifies the error messages returned by CampBX (see xgen.ParseError).
+var errorPatterns = []xgen.ErrorPattern{
+	{"login", xgen.AuthFailed},
+	{"password", xgen.AuthFailed},
+	{"insufficient", xgen.InsufficientFunds},
+	{"minimum", xgen.BelowMinimum},
+	{"too many", xgen.RateLimited},
+	{"order not found", xgen.UnknownOrder},
+	{"maintenance", xgen.Unavailable},
+}
+
+// apiError returns the error reported by CampBX in the API response |b|, or nil if there is none.
+func (e *Exchange) apiError(b []byte) os.Error {
+	return xgen.ParseError(e.Name(), b, errorPatterns)
+}
+
+// get fetches public market data, waiting for the rate limit of the public API (see restapi.SetLimit).
+// Failed requests are retried (see restapi.Retry).
+func (e *Exchange) get(c xgen.Context, url string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		restapi.Wait(e.Name(), restapi.Public)
+		return restapi.GetJsonChecked(e.Context(c), url, e.apiError, a)
+	})
+}
+
+// query is like post, but failed requests are retried (see restapi.Retry), so it must only be used for reading account data.
+func (e *Exchange) query(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		return e.post(c, url, data, a)
+	})
+}
+
+// post makes an authenticated API call, waiting for the rate limit of the authenticated API.
+// CampBX only supports password authentication, so the username and password are sent in the form.
+func (e *Exchange) post(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	restapi.Wait(e.Name(), restapi.Private)
+	data["user"] = []string{e.Login.Username}
+	data["pass"] = []string{e.Login.Password}
+	return restapi.PostJsonChecked(e.Context(c), url, data, nil, e.apiError, a)
 }
 
 // GetQuote retrieves the "ticker" data.
-func GetQuote(c appengine.Context) (x xgen.Quote, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetQuote(c xgen.Context, pair xgen.Pair) (x xgen.Quote, err os.Error) {
+	defer e.wrap(e.url(JsonTicker), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var q Quote
-	err = restapi.GetJson(c, JsonTicker, &q)
-	check(err)
-	x.Date = datastore.SecondsToTime(time.Seconds())
-	x.HighestBuy, err = strconv.Atof64(q.Buy)
-	check(err)
-	x.LowestSell, err = strconv.Atof64(q.Sell)
-	check(err)
-	x.Last, err = strconv.Atof64(q.Last)
-	check(err)
+	err = e.get(c, e.url(JsonTicker), &q)
+	if err != nil {
+		return
+	}
+	x.Pair = pair
+	x.Date = time.Seconds()
+	if x.HighestBuy, err = xgen.ParseDecimal(q.Buy); err != nil {
+		return
+	}
+	if x.LowestSell, err = xgen.ParseDecimal(q.Sell); err != nil {
+		return
+	}
+	if x.Last, err = xgen.ParseDecimal(q.Last); err != nil {
+		return
+	}
 	if !x.Validate() {
-		panic("Invalid Ticker")
+		err = os.NewError("invalid ticker")
 	}
 	return
 }
 
 // GetOrderBook retrieves the limit order book.
-func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (x xgen.OrderBook, err os.Error) {
+	defer e.wrap(e.url(JsonDepth), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var b OrderBook
-	err = restapi.GetJson(c, JsonDepth, &b)
-	check(err)
+	err = e.get(c, e.url(JsonDepth), &b)
+	if err != nil {
+		return
+	}
+	x.Pair = pair
 	for _, ask := range b.Asks {
 		o := xgen.Order{Price: ask[Price], Amount: ask[Amount]}
 		x.SellTree = append(x.SellTree, o)
@@ -62,7 +106,8 @@ func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
 		x.BuyTree = append(x.BuyTree, o)
 	}
 	if !x.Validate() {
-		panic("Invalid Depth")
+		err = os.NewError("invalid depth")
+		return
 	}
 	sort.Sort(x.BuyTree)
 	sort.Sort(x.SellTree)
@@ -71,80 +116,100 @@ func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
 }
 
 // GetBalance retrieves the account balance.
-func GetBalance(c appengine.Context, login xgen.Credentials) (x xgen.Balance, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetBalance(c xgen.Context) (x xgen.Balance, err os.Error) {
+	defer e.wrap(e.url(JsonBalance), &err)
 	var b Balance
-	err = restapi.PostJson(c, JsonBalance, map[string][]string{"user": {login.Username}, "pass": {login.Password}}, &b)
-	check(err)
-	x[xgen.BTC], err = strconv.Atof64(b.BtcLiquid)
-	check(err)
-	x[xgen.USD], err = strconv.Atof64(b.UsdLiquid)
+	err = e.query(c, e.url(JsonBalance), map[string][]string{}, &b)
+	if err != nil {
+		return
+	}
+	x = make(xgen.Balance)
+	if x[xgen.BTC], err = xgen.ParseDecimal(b.BtcLiquid); err != nil {
+		return
+	}
+	x[xgen.USD], err = xgen.ParseDecimal(b.UsdLiquid)
 	return
 }
 
-func (h OpenOrders) convert() (o xgen.OpenOrders) { // Convert campbx.OpenOrders to xgen.OpenOrders
-	var err os.Error
-	o.Sell = make(map[string]xgen.OpenOrder)
-	o.Buy = make(map[string]xgen.OpenOrder)
-	for _, order := range h.Buy {
+// convertOrders adds the |orders| with an order id to |m|.
+func convertOrders(orders []openOrder, m map[string]xgen.OpenOrder) (err os.Error) {
+	for _, order := range orders {
 		if order.Oid != "" {
 			var t xgen.OpenOrder
 			t.Date = time.Seconds() // Should use time.Parse to convert order.DateEntered to Unix time
-			t.Price, err = strconv.Atof64(order.Price)
-			check(err)
-			t.Amount, err = strconv.Atof64(order.Quantity)
-			check(err)
-			o.Buy[order.Oid] = t
+			if t.Price, err = xgen.ParseDecimal(order.Price); err != nil {
+				return
+			}
+			if t.Amount, err = xgen.ParseDecimal(order.Quantity); err != nil {
+				return
+			}
+			m[order.Oid] = t
 		}
 	}
-	for _, order := range h.Sell {
-		if order.Oid != "" {
-			var t xgen.OpenOrder
-			t.Date = time.Seconds() // Should use time.Parse to convert order.DateEntered to Unix time
-			t.Price, err = strconv.Atof64(order.Price)
-			check(err)
-			t.Amount, err = strconv.Atof64(order.Quantity)
-			check(err)
-			o.Sell[order.Oid] = t
-		}
+	return
+}
+
+func (h OpenOrders) convert(pair xgen.Pair) (o xgen.OpenOrders, err os.Error) { // Convert campbx.OpenOrders to xgen.OpenOrders
+	o.Pair = pair
+	o.Sell = make(map[string]xgen.OpenOrder)
+	o.Buy = make(map[string]xgen.OpenOrder)
+	if err = convertOrders(h.Buy, o.Buy); err != nil {
+		return
 	}
+	err = convertOrders(h.Sell, o.Sell)
 	return
 }
 
 // GetOpenOrders retrieves a list of all open orders.
-func GetOpenOrders(c appengine.Context, login xgen.Credentials) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (x xgen.OpenOrders, err os.Error) {
+	defer e.wrap(e.url(JsonOrders), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonOrders, map[string][]string{"user": {login.Username}, "pass": {login.Password}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
-	return
+	err = e.query(c, e.url(JsonOrders), map[string][]string{}, &openOrders)
+	if err != nil {
+		return
+	}
+	return openOrders.convert(pair)
 }
 
 // CancelOrder cancels an open order.
-func CancelOrder(c appengine.Context, login xgen.Credentials, oid string, orderType string) (f interface{}, err os.Error) {
-	err = restapi.PostJson(c, JsonCancel, map[string][]string{"user": {login.Username}, "pass": {login.Password}, "Type": {orderType}, "OrderID": {oid}}, &f)
+func (e *Exchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) (err os.Error) {
+	defer e.wrap(e.url(JsonCancel), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
+	t := "Buy" // CampBX order types: "Buy" or "Sell"
+	if orderType == xgen.SellOrder {
+		t = "Sell"
+	}
+	var f interface{}
+	err = e.post(c, e.url(JsonCancel), map[string][]string{"Type": {t}, "OrderID": {oid}}, &f)
 	return
 }
 
-// Buy opens a new order to buy BTC.
-func Buy(c appengine.Context, login xgen.Credentials, price float64, amount float64) (f interface{}, err os.Error) {
-	err = restapi.PostJson(c, JsonBuySell, map[string][]string{"user": {login.Username}, "pass": {login.Password}, "TradeMode": {"QuickBuy"},
-		"Price": {strconv.Ftoa64(price, 'f', -1)}, "Quantity": {strconv.Ftoa64(amount, 'f', -1)}}, &f)
+// Buy opens a new order to buy BTC. The price and amount are rounded down to the scales of the currencies, so that
+// the order never costs more than the funds it was calculated for.
+func (e *Exchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonBuySell), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
+	var f interface{}
+	err = e.post(c, e.url(JsonBuySell), map[string][]string{"TradeMode": {"QuickBuy"},
+		"Price": {price.Trunc(pair.Quote.Scale()).String()}, "Quantity": {amount.Trunc(pair.Base.Scale()).String()}}, &f)
 	return
 }
 
-// Sell opens a new order to sell BTC.
-func Sell(c appengine.Context, login xgen.Credentials, price float64, amount float64) (f interface{}, err os.Error) {
-	err = restapi.PostJson(c, JsonBuySell, map[string][]string{"user": {login.Username}, "pass": {login.Password}, "TradeMode": {"QuickSell"},
-		"Price": {strconv.Ftoa64(price, 'f', -1)}, "Quantity": {strconv.Ftoa64(amount, 'f', -1)}}, &f)
+// Sell opens a new order to sell BTC. The amount is rounded down to the scale of BTC, so that it never exceeds the funds.
+func (e *Exchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonBuySell), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
+	var f interface{}
+	err = e.post(c, e.url(JsonBuySell), map[string][]string{"TradeMode": {"QuickSell"},
+		"Price": {price.Round(pair.Quote.Scale()).String()}, "Quantity": {amount.Trunc(pair.Base.Scale()).String()}}, &f)
 	return
 }
@@ -0,0 +1,120 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package campbx
+
+import (
+	"os"
+	"fmt"
+	"restapi"
+	"xgen"
+)
+
+func d(f float64) xgen.Decimal {
+	return xgen.NewDecimal(f)
+}
+
+// TestCampBX checks the API calls against a stand-in for CampBX: the parsing of the replies (including the "no open orders"
+// entries), the requests made, the classification of the errors, and the retries of temporary failures.
+func TestCampBX() os.Error {
+	savedRetries := restapi.Retries
+	restapi.Retries = restapi.RetryPolicy{3, 1e6, 1e6}
+	defer func() { restapi.Retries = savedRetries }()
+	s, err := NewStandIn()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c := restapi.NewTestContext()
+	e := s.Exchange(xgen.Credentials{Username: "user", Password: "pass"})
+
+	if err = s.SetQuote(xgen.Quote{HighestBuy: d(10), LowestSell: d(10.5), Last: d(10.2)}); err != nil {
+		return err
+	}
+	s.ReplyOnce(JsonTicker, 429, "")
+	q, err := e.GetQuote(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if q.HighestBuy != d(10) || q.LowestSell != d(10.5) || q.Last != d(10.2) || len(s.Calls(JsonTicker)) != 2 {
+		return os.NewError(fmt.Sprint("TestCampBX: GetQuote<br>=<br>", q, " after ", len(s.Calls(JsonTicker)), " requests, want 2"))
+	}
+
+	// The order book is sorted (best prices first)
+	err = s.SetBook(xgen.OrderBook{BuyTree: []xgen.Order{{d(9), d(1)}, {d(10), d(2)}}, SellTree: []xgen.Order{{d(11), d(3)}, {d(10.5), d(4)}}})
+	if err != nil {
+		return err
+	}
+	b, err := e.GetOrderBook(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(b.BuyTree) != 2 || b.BuyTree[0] != (xgen.Order{d(10), d(2)}) || len(b.SellTree) != 2 || b.SellTree[0] != (xgen.Order{d(10.5), d(4)}) {
+		return os.NewError(fmt.Sprint("TestCampBX: GetOrderBook<br>=<br>", b))
+	}
+
+	if err = s.SetBalance(xgen.Balance{xgen.BTC: d(1.5), xgen.USD: d(100)}); err != nil {
+		return err
+	}
+	s.ReplyError(JsonBalance, "Invalid login or password")
+	_, err = e.GetBalance(c)
+	if xgen.ClassOf(err) != xgen.AuthFailed || len(s.Calls(JsonBalance)) != 1 {
+		return os.NewError(fmt.Sprint("TestCampBX: GetBalance = ", err, ", want ", xgen.AuthFailed, " without retries"))
+	}
+	funds, err := e.GetBalance(c)
+	if err != nil {
+		return err
+	}
+	if funds[xgen.BTC] != d(1.5) || funds[xgen.USD] != d(100) {
+		return os.NewError(fmt.Sprint("TestCampBX: GetBalance<br>=<br>", funds))
+	}
+	calls := s.Calls(JsonBalance)
+	if calls[1].Get("user") != "user" || calls[1].Get("pass") != "pass" {
+		return os.NewError(fmt.Sprint("TestCampBX: GetBalance sent<br>", calls))
+	}
+
+	// Without orders, CampBX returns an entry without an order id
+	open, err := e.GetOpenOrders(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(open.Buy) != 0 || len(open.Sell) != 0 {
+		return os.NewError(fmt.Sprint("TestCampBX: GetOpenOrders without orders<br>=<br>", open))
+	}
+	err = s.SetOpenOrders(xgen.OpenOrders{xgen.BTCUSD, map[string]xgen.OpenOrder{"7": {0, d(9.5), d(2)}}, nil})
+	if err != nil {
+		return err
+	}
+	if open, err = e.GetOpenOrders(c, xgen.BTCUSD); err != nil {
+		return err
+	}
+	if len(open.Buy) != 1 || len(open.Sell) != 0 || open.Buy["7"].Price != d(9.5) || open.Buy["7"].Amount != d(2) {
+		return os.NewError(fmt.Sprint("TestCampBX: GetOpenOrders<br>=<br>", open))
+	}
+
+	if err = e.Buy(c, xgen.BTCUSD, d(9.123456), d(2)); err != nil {
+		return err
+	}
+	s.ReplyError(JsonBuySell, "Insufficient funds")
+	err = e.Sell(c, xgen.BTCUSD, d(12), d(5))
+	if xgen.ClassOf(err) != xgen.InsufficientFunds {
+		return os.NewError(fmt.Sprint("TestCampBX: Sell = ", err, ", want ", xgen.InsufficientFunds))
+	}
+	calls = s.Calls(JsonBuySell)
+	if len(calls) != 2 || calls[0].Get("TradeMode") != "QuickBuy" || calls[0].Get("Price") != "9.12345" || calls[0].Get("Quantity") != "2" ||
+		calls[1].Get("TradeMode") != "QuickSell" {
+		return os.NewError(fmt.Sprint("TestCampBX: Buy and Sell sent<br>", calls))
+	}
+	if err = e.CancelOrder(c, xgen.BTCUSD, "7", xgen.BuyOrder); err != nil {
+		return err
+	}
+	if calls = s.Calls(JsonCancel); calls[0].Get("OrderID") != "7" || calls[0].Get("Type") != "Buy" {
+		return os.NewError(fmt.Sprint("TestCampBX: CancelOrder sent<br>", calls))
+	}
+
+	// Without a base URL, the client uses the real exchange
+	if url := (&Exchange{}).url(JsonDepth); url != "https://campbx.com/api/xdepth.php" {
+		return os.NewError("TestCampBX: default URL of JsonDepth " + url)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package campbx
+
+import (
+	"os"
+	"http"
+	"restapi"
+	"xgen"
+)
+
+// StandIn is a local server standing in for the CampBX API in the tests (see restapi.StandIn). The replies are set from
+// the types of package xgen, and served in the JSON shapes of the structs of this package.
+type StandIn struct {
+	*restapi.StandIn
+}
+
+// NewStandIn starts a stand-in for CampBX with no open orders, accepting all new orders and cancellations.
+// The market data and the balance must be set before they are requested.
+func NewStandIn() (*StandIn, os.Error) {
+	rs, err := restapi.NewStandIn()
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{rs}
+	s.Reply(JsonBuySell, 200, `{"Success": "1"}`)
+	s.Reply(JsonCancel, 200, `{"Success": "1"}`)
+	if err = s.SetOpenOrders(xgen.OpenOrders{Pair: xgen.BTCUSD}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetQuote sets the ticker to |q|.
+func (s *StandIn) SetQuote(q xgen.Quote) os.Error {
+	return s.ReplyJson(JsonTicker, Quote{Buy: q.HighestBuy.String(), Sell: q.LowestSell.String(), Last: q.Last.String()})
+}
+
+// SetBook sets the order book to |b|.
+func (s *StandIn) SetBook(b xgen.OrderBook) os.Error {
+	var d OrderBook
+	for _, o := range b.SellTree {
+		d.Asks = append(d.Asks, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	for _, o := range b.BuyTree {
+		d.Bids = append(d.Bids, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	return s.ReplyJson(JsonDepth, d)
+}
+
+// SetBalance sets the liquid funds of the account to those of |b| (with nothing in the margin account).
+func (s *StandIn) SetBalance(b xgen.Balance) os.Error {
+	usd, btc := b[xgen.USD].String(), b[xgen.BTC].String()
+	return s.ReplyJson(JsonBalance, Balance{UsdTotal: usd, UsdLiquid: usd, UsdMargin: "0", BtcTotal: btc, BtcLiquid: btc, BtcMargin: "0"})
+}
+
+// formatOrders converts |orders| of |orderType| ("Buy" or "Sell") to the open orders of CampBX. Like CampBX, it returns
+// an entry without an order id telling that there are no orders if |orders| is empty.
+func formatOrders(orders map[string]xgen.OpenOrder, orderType string) (list []openOrder) {
+	for oid, order := range orders {
+		list = append(list, openOrder{OrderType: "Quick " + orderType, Oid: oid, Price: order.Price.String(),
+			Quantity: order.Amount.String(), MarginPct: "0", StopLoss: "No", FillType: "Incremental", DarkPool: "No"})
+	}
+	if len(list) == 0 {
+		list = []openOrder{{Info: "No open " + orderType + " Orders"}}
+	}
+	return
+}
+
+// SetOpenOrders sets the open orders of the account to |o|.
+func (s *StandIn) SetOpenOrders(o xgen.OpenOrders) os.Error {
+	return s.ReplyJson(JsonOrders, OpenOrders{Buy: formatOrders(o.Buy, "Buy"), Sell: formatOrders(o.Sell, "Sell")})
+}
+
+// Exchange returns a client of the stand-in logging in with |login|.
+func (s *StandIn) Exchange(login xgen.Credentials) *Exchange {
+	return &Exchange{Login: login, Client: restapi.Client{BaseURL: s.URL, Transport: http.DefaultTransport}}
+}
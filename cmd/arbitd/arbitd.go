@@ -0,0 +1,133 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+// Arbitd runs ArBit as a standalone daemon, without the Google App Engine SDK.
+// It serves the same /cron/, /dashboard/ and /testing/ handlers as the App Engine version,
+// and checks for arbitrage on its own once per interval (so there is no need for a crontab),
+// or whenever the order books change with the -engine flag. At SIGTERM (or SIGINT) it lets the run in progress finish
+// before exiting.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"http"
+	"log"
+	"os"
+	"os/signal"
+	"appdb"
+	"arbit"
+	"restapi"
+	"secrets"
+	"xgen"
+)
+
+var (
+	httpAddr = flag.String("http", "localhost:8080", "HTTP service address for the /cron/, /dashboard/ and /testing/ handlers")
+	interval = flag.Int64("interval", 60, "Seconds between arbitrage runs (0 disables the internal scheduling)")
+	jitter   = flag.Int64("jitter", 0, "Maximum seconds a run is moved randomly either way from its interval")
+	grace    = flag.Int64("grace", 30, "Seconds allowed for a run to finish at SIGTERM, before its open orders are canceled")
+	engine   = flag.Bool("engine", false, "Evaluate arbitrage whenever the order books change, instead of once per interval")
+	dataDir  = flag.String("data", "", "Directory for storing the tickers and orders (kept in memory only if empty)")
+	config   = flag.String("config", "arbit.json", "Config file with the exchange accounts and trading settings (see arbit.json.example)")
+	record   = flag.String("record", "", "Cassette file to record the API calls to, with the credentials scrubbed")
+	replay   = flag.String("replay", "", "Cassette file to replay the API calls from, instead of calling the exchanges")
+)
+
+// context implements xgen.Context using the standard library.
+type context struct {
+	store     appdb.Store
+	transport http.RoundTripper
+}
+
+func (c *context) Transport() http.RoundTripper { return c.transport }
+func (c *context) Store() appdb.Store            { return c.store }
+
+func (c *context) Debugf(format string, args ...interface{})    { logf("DEBUG: ", format, args...) }
+func (c *context) Infof(format string, args ...interface{})     { logf("INFO: ", format, args...) }
+func (c *context) Warningf(format string, args ...interface{})  { logf("WARNING: ", format, args...) }
+func (c *context) Errorf(format string, args ...interface{})    { logf("ERROR: ", format, args...) }
+func (c *context) Criticalf(format string, args ...interface{}) { logf("CRITICAL: ", format, args...) }
+
+// logf writes a message to the log, with any secrets (see package secrets) redacted.
+func logf(level string, format string, args ...interface{}) {
+	log.Print(level + secrets.Redact(fmt.Sprintf(format, args...)))
+}
+
+func main() {
+	flag.Parse()
+	if *jitter < 0 || *jitter > *interval {
+		log.Fatalf("arbitd: -jitter must be between 0 and -interval")
+	}
+	if *record != "" && *replay != "" {
+		log.Fatalf("arbitd: -record and -replay cannot be used together")
+	}
+
+	cfg, err := arbit.LoadConfig(*config)
+	if err != nil {
+		log.Fatalf("arbitd: %s", err)
+	}
+	err = arbit.Configure(cfg)
+	if err != nil {
+		log.Fatalf("arbitd: %s", err)
+	}
+
+	var store appdb.Store = appdb.NewMemStore()
+	if *dataDir != "" {
+		fs, err := appdb.OpenFileStore(*dataDir)
+		if err != nil {
+			log.Fatalf("arbitd: %s", err)
+		}
+		store = fs
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if *record != "" {
+		transport = restapi.NewRecorder(*record, transport)
+	} else if *replay != "" {
+		cassette, err := restapi.LoadCassette(*replay)
+		if err != nil {
+			log.Fatalf("arbitd: %s", err)
+		}
+		transport = restapi.NewPlayer(cassette)
+	}
+	c := &context{store, transport}
+	arbit.NewContext = func(r *http.Request) xgen.Context {
+		return c
+	}
+
+	var stop func()
+	if *engine {
+		e := arbit.StartEngine(c, os.Stdout)
+		stop = func() { e.Stop() }
+	} else if *interval > 0 {
+		s := arbit.NewScheduler(c, os.Stdout, *interval*1e9, *jitter*1e9)
+		s.Start()
+		stop = func() { s.Stop() }
+	}
+	go shutdown(c, stop)
+
+	log.Printf("arbitd: serving on http://%s/", *httpAddr)
+	err = http.ListenAndServe(*httpAddr, nil)
+	if err != nil {
+		log.Fatalf("arbitd: %s", err)
+	}
+}
+
+// shutdown waits for SIGTERM or SIGINT, and exits once the run in progress has finished (or its orders have been canceled,
+// see arbit.Shutdown). The scheduler or the engine is stopped with |stop|, unless it is nil.
+func shutdown(c xgen.Context, stop func()) {
+	for sig := range signal.Incoming {
+		if s, ok := sig.(os.UnixSignal); !ok || (s != os.SIGTERM && s != os.SIGINT) {
+			continue
+		}
+		log.Printf("arbitd: %s, shutting down", sig)
+		if stop != nil {
+			stop()
+		}
+		err := arbit.Shutdown(c, os.Stdout, *grace*1e9)
+		if err != nil {
+			log.Fatalf("arbitd: %s", err)
+		}
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This program is distributed under the terms of the MIT/X11 license.
+
+// Arbitkeys manages the encrypted keystore file holding the exchange credentials (see package secrets).
+// The passphrase of the keystore is read from the environment variable ARBIT_PASSPHRASE.
+//
+//	arbitkeys -keystore=arbit.keys list
+//	arbitkeys -keystore=arbit.keys set MtGox.Password < file-containing-the-password
+//	arbitkeys -keystore=arbit.keys delete MtGox.Password
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"secrets"
+)
+
+var keystore = flag.String("keystore", "arbit.keys", "Keystore file (created if it doesn't exist)")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: arbitkeys [-keystore=file] list | set <name> | delete <name>")
+	fmt.Fprintln(os.Stderr, "Secret names are the exchange and the field, e.g. MtGox.Password. The value to set is read from the standard input.")
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	k, err := secrets.OpenKeystore(*keystore, os.Getenv(secrets.PassphraseVar))
+	if err != nil {
+		log.Fatalf("arbitkeys: %s", err)
+	}
+
+	switch {
+	case flag.Arg(0) == "list" && flag.NArg() == 1:
+		for _, name := range k.Names() {
+			fmt.Println(name)
+		}
+		return
+	case flag.Arg(0) == "set" && flag.NArg() == 2:
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != os.EOF {
+			log.Fatalf("arbitkeys: %s", err)
+		}
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			log.Fatalf("arbitkeys: empty value for %s", flag.Arg(1))
+		}
+		k.Set(flag.Arg(1), value)
+	case flag.Arg(0) == "delete" && flag.NArg() == 2:
+		k.Delete(flag.Arg(1))
+	default:
+		usage()
+	}
+
+	err = k.Save()
+	if err != nil {
+		log.Fatalf("arbitkeys: %s", err)
+	}
+}
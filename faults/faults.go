@@ -0,0 +1,393 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package faults injects faults into the calls to the exchanges, for chaos testing the trading loop: the calls chosen by
+// the rules fail, hang, get malformed JSON or return partial or stale data, with the given probabilities.
+// It is meant for paper trading, stand-ins (see restapi.StandIn) and tests. Never enable it when trading real money.
+package faults
+
+import (
+	"os"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"bytes"
+	"rand"
+	"sync"
+	"time"
+	"xgen"
+	"restapi"
+)
+
+// Kind is the kind of a fault.
+type Kind string
+
+// List of fault kinds.
+const (
+	Fail      Kind = "Fail"      // The call returns a temporary error (like a dropped connection)
+	Hang      Kind = "Hang"      // The call blocks for Delay, and then returns a temporary error (like a timeout)
+	Malformed Kind = "Malformed" // The HTTP responses of the call are cut in half, so that they are not valid JSON
+	Partial   Kind = "Partial"   // Only half (rounded down) of the orders of the order book or of the open orders, or of the currencies of the balance, is kept, or the ask of the quote is missing
+	Stale     Kind = "Stale"     // The call returns the result of the last call without a fault (never injected before there is one)
+)
+
+var kinds = []Kind{Fail, Hang, Malformed, Partial, Stale}
+
+// Calls are the names of the calls of xgen.Exchange faults can be injected into. Partial and Stale only apply to
+// the first four, which return data.
+var Calls = []string{"GetQuote", "GetOrderBook", "GetBalance", "GetOpenOrders", "CancelOrder", "Buy", "Sell"}
+
+// Rule injects fault Kind into a call with probability Probability.
+type Rule struct {
+	Exchange    string // Name of the exchange (all exchanges if empty)
+	Call        string // One of Calls (all calls if empty)
+	Kind        Kind
+	Probability float64 // Between 0 and 1
+	Delay       int64   // Milliseconds a hanging call blocks (DefaultDelay if zero)
+	Sent        bool    // Fail and Hang: the call is made before the fault, as if the response was lost (e.g. an order placed anyway)
+}
+
+// DefaultDelay is the number of milliseconds a hanging call blocks, unless the rule tells otherwise.
+var DefaultDelay int64 = 60e3
+
+// dataCall tells whether |call| returns data (and not only an error).
+func dataCall(call string) bool {
+	for _, name := range Calls[:4] {
+		if call == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if the rule is not valid.
+func (r *Rule) Validate() os.Error {
+	known := false
+	for _, k := range kinds {
+		known = known || r.Kind == k
+	}
+	if !known {
+		return os.NewError(fmt.Sprintf("unknown fault %q (the faults are %s, %s, %s, %s and %s)", r.Kind, Fail, Hang, Malformed, Partial, Stale))
+	}
+	if r.Call != "" {
+		known = false
+		for _, name := range Calls {
+			known = known || r.Call == name
+		}
+		if !known {
+			return os.NewError(fmt.Sprintf("unknown call %q", r.Call))
+		}
+		if (r.Kind == Partial || r.Kind == Stale) && !dataCall(r.Call) {
+			return os.NewError(fmt.Sprintf("%s fault in %s, which returns no data", r.Kind, r.Call))
+		}
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return os.NewError(fmt.Sprint("probability ", r.Probability, " is not between 0 and 1"))
+	}
+	if r.Delay < 0 {
+		return os.NewError("negative delay")
+	}
+	return nil
+}
+
+// matches tells whether the rule applies to |call| of exchange |exchange|.
+func (r *Rule) matches(exchange string, call string) bool {
+	if r.Exchange != "" && r.Exchange != exchange || r.Call != "" && r.Call != call {
+		return false
+	}
+	return dataCall(call) || r.Kind != Partial && r.Kind != Stale
+}
+
+func (r *Rule) delay() int64 {
+	if r.Delay == 0 {
+		return DefaultDelay * 1e6
+	}
+	return r.Delay * 1e6
+}
+
+// Injection is a fault injected into a call.
+type Injection struct {
+	Date     int64 // Unix timestamp
+	Exchange string
+	Call     string
+	Kind     Kind
+}
+
+// Injector decides which calls get faults, for all the exchanges it wraps, and records the faults injected.
+type Injector struct {
+	Rules []Rule // Checked in order, the first rule whose dice roll hits choosing the fault
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	injected []Injection
+	last     map[string]interface{} // Results of the last calls without a fault by exchange, call and pair (for Stale)
+}
+
+// New returns an injector applying |rules|, with the dice rolled by a random source seeded with |seed|
+// (so that a chaos test can be repeated).
+func New(seed int64, rules []Rule) *Injector {
+	return &Injector{Rules: rules, rnd: rand.New(rand.NewSource(seed)), last: make(map[string]interface{})}
+}
+
+// choose returns the rule of the fault to inject into |call| of exchange |exchange|, or nil if the call is made normally.
+// The results of the call are kept under |key| (see Exchange.call).
+func (in *Injector) choose(exchange string, call string, key string) *Rule {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := range in.Rules {
+		r := &in.Rules[i]
+		if _, ok := in.last[key]; r.Kind == Stale && !ok {
+			continue
+		}
+		if r.matches(exchange, call) && in.rnd.Float64() < r.Probability {
+			in.injected = append(in.injected, Injection{time.Seconds(), exchange, call, r.Kind})
+			return r
+		}
+	}
+	return nil
+}
+
+// intn returns a random number between 0 and |n|-1.
+func (in *Injector) intn(n int) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rnd.Intn(n)
+}
+
+// Injected returns the faults injected so far, oldest first.
+func (in *Injector) Injected() []Injection {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]Injection(nil), in.injected...)
+}
+
+// Count returns the number of faults of kind |kind| injected into |call| of exchange |exchange| so far.
+// Empty strings match all exchanges, calls or kinds.
+func (in *Injector) Count(exchange string, call string, kind Kind) (n int) {
+	for _, i := range in.Injected() {
+		if (exchange == "" || i.Exchange == exchange) && (call == "" || i.Call == call) && (kind == "" || i.Kind == kind) {
+			n++
+		}
+	}
+	return
+}
+
+// Exchange is an exchange with faults injected into its calls. The faults are chosen by the injector, which also keeps
+// the results for Stale, so that an exchange can be wrapped again (e.g. for each test run) without losing them.
+type Exchange struct {
+	xgen.Exchange // Exchange the calls are made to
+
+	in *Injector
+}
+
+// Wrap returns exchange |x| with the faults of the injector injected into its calls.
+func (in *Injector) Wrap(x xgen.Exchange) *Exchange {
+	return &Exchange{x, in}
+}
+
+// injectedError returns the temporary error of a fault of kind |kind| in |call|.
+func (e *Exchange) injectedError(call string, kind Kind) os.Error {
+	message := "connection reset by peer (injected fault)"
+	if kind == Hang {
+		message = "request timed out (injected fault)"
+	}
+	return xgen.WrapError(e.Name(), call, &restapi.TemporaryError{os.NewError(message)})
+}
+
+// call makes |call| (with the pair |pair|, if any) to the exchange by calling |f|, injecting the fault chosen for it.
+func (e *Exchange) call(c xgen.Context, call string, pair string, f func(c xgen.Context) (interface{}, os.Error)) (interface{}, os.Error) {
+	key := e.Name() + "." + call + "." + pair
+	r := e.in.choose(e.Name(), call, key)
+	if r == nil {
+		v, err := f(c)
+		if err == nil {
+			e.in.mu.Lock()
+			e.in.last[key] = copyOf(v)
+			e.in.mu.Unlock()
+		}
+		return v, err
+	}
+	switch r.Kind {
+	case Fail:
+		if r.Sent {
+			f(c)
+		}
+		return nil, e.injectedError(call, r.Kind)
+	case Hang:
+		if r.Sent {
+			f(c)
+		}
+		time.Sleep(r.delay())
+		return nil, e.injectedError(call, r.Kind)
+	case Malformed:
+		return f(malformed{c})
+	case Partial:
+		v, err := f(c)
+		if err != nil {
+			return v, err
+		}
+		return e.partial(v), nil
+	case Stale:
+		e.in.mu.Lock()
+		defer e.in.mu.Unlock()
+		return copyOf(e.in.last[key]), nil
+	}
+	panic("faults: unknown fault " + string(r.Kind))
+}
+
+// partial returns the partial data of the result |v| of a call (see Partial).
+func (e *Exchange) partial(v interface{}) interface{} {
+	switch x := v.(type) {
+	case xgen.Quote:
+		x.LowestSell = 0
+		return x
+	case xgen.OrderBook:
+		x.BuyTree = x.BuyTree[:len(x.BuyTree)/2]
+		x.SellTree = x.SellTree[:len(x.SellTree)/2]
+		return x
+	case xgen.Balance:
+		b := x.Copy()
+		var currencies []xgen.Currency
+		for cur, _ := range b {
+			currencies = append(currencies, cur)
+		}
+		for n := (len(currencies) + 1) / 2; n > 0; n-- {
+			i := e.in.intn(len(currencies))
+			b[currencies[i]] = 0, false
+			currencies = append(currencies[:i], currencies[i+1:]...)
+		}
+		return b
+	case xgen.OpenOrders:
+		return xgen.OpenOrders{x.Pair, half(x.Buy), half(x.Sell)}
+	}
+	return v
+}
+
+// half returns a copy of |orders| with only half of the orders (rounded down).
+func half(orders map[string]xgen.OpenOrder) map[string]xgen.OpenOrder {
+	h := make(map[string]xgen.OpenOrder)
+	n := len(orders) / 2
+	for oid, o := range orders {
+		if n == 0 {
+			break
+		}
+		h[oid] = o
+		n--
+	}
+	return h
+}
+
+// copyOf returns a copy of the result |v| of a call, so that the caller can change it.
+func copyOf(v interface{}) interface{} {
+	switch x := v.(type) {
+	case xgen.Balance:
+		return x.Copy()
+	case xgen.OrderBook:
+		x.BuyTree = append([]xgen.Order(nil), x.BuyTree...)
+		x.SellTree = append([]xgen.Order(nil), x.SellTree...)
+		return x
+	case xgen.OpenOrders:
+		o := xgen.OpenOrders{x.Pair, make(map[string]xgen.OpenOrder), make(map[string]xgen.OpenOrder)}
+		for oid, order := range x.Buy {
+			o.Buy[oid] = order
+		}
+		for oid, order := range x.Sell {
+			o.Sell[oid] = order
+		}
+		return o
+	}
+	return v
+}
+
+// malformed is a context whose transport cuts the HTTP responses in half (see Malformed). The exchanges that don't use
+// the transport of the context (e.g. the simulated exchanges without a market) are not affected.
+type malformed struct {
+	xgen.Context
+}
+
+func (c malformed) Transport() http.RoundTripper {
+	next := c.Context.Transport()
+	return restapi.TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+		res, err := next.RoundTrip(req)
+		if err != nil {
+			return res, err
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b = b[:len(b)/2]
+		res.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+		res.ContentLength = int64(len(b))
+		return res, nil
+	})
+}
+
+// GetQuote calls GetQuote of the exchange with the fault chosen for it.
+func (e *Exchange) GetQuote(c xgen.Context, pair xgen.Pair) (xgen.Quote, os.Error) {
+	v, err := e.call(c, "GetQuote", pair.String(), func(c xgen.Context) (interface{}, os.Error) {
+		return e.Exchange.GetQuote(c, pair)
+	})
+	if err != nil {
+		return xgen.Quote{}, err
+	}
+	return v.(xgen.Quote), nil
+}
+
+// GetOrderBook calls GetOrderBook of the exchange with the fault chosen for it.
+func (e *Exchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (xgen.OrderBook, os.Error) {
+	v, err := e.call(c, "GetOrderBook", pair.String(), func(c xgen.Context) (interface{}, os.Error) {
+		return e.Exchange.GetOrderBook(c, pair)
+	})
+	if err != nil {
+		return xgen.OrderBook{}, err
+	}
+	return v.(xgen.OrderBook), nil
+}
+
+// GetBalance calls GetBalance of the exchange with the fault chosen for it.
+func (e *Exchange) GetBalance(c xgen.Context) (xgen.Balance, os.Error) {
+	v, err := e.call(c, "GetBalance", "", func(c xgen.Context) (interface{}, os.Error) {
+		return e.Exchange.GetBalance(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(xgen.Balance), nil
+}
+
+// GetOpenOrders calls GetOpenOrders of the exchange with the fault chosen for it.
+func (e *Exchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (xgen.OpenOrders, os.Error) {
+	v, err := e.call(c, "GetOpenOrders", pair.String(), func(c xgen.Context) (interface{}, os.Error) {
+		return e.Exchange.GetOpenOrders(c, pair)
+	})
+	if err != nil {
+		return xgen.OpenOrders{}, err
+	}
+	return v.(xgen.OpenOrders), nil
+}
+
+// CancelOrder calls CancelOrder of the exchange with the fault chosen for it.
+func (e *Exchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) os.Error {
+	_, err := e.call(c, "CancelOrder", "", func(c xgen.Context) (interface{}, os.Error) {
+		return nil, e.Exchange.CancelOrder(c, pair, oid, orderType)
+	})
+	return err
+}
+
+// Buy calls Buy of the exchange with the fault chosen for it.
+func (e *Exchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	_, err := e.call(c, "Buy", "", func(c xgen.Context) (interface{}, os.Error) {
+		return nil, e.Exchange.Buy(c, pair, price, amount)
+	})
+	return err
+}
+
+// Sell calls Sell of the exchange with the fault chosen for it.
+func (e *Exchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	_, err := e.call(c, "Sell", "", func(c xgen.Context) (interface{}, os.Error) {
+		return nil, e.Exchange.Sell(c, pair, price, amount)
+	})
+	return err
+}
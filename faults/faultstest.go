@@ -0,0 +1,122 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package faults
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"xgen"
+	"restapi"
+	"simex"
+)
+
+func d(f float64) xgen.Decimal {
+	return xgen.NewDecimal(f)
+}
+
+// TestFaults checks each kind of fault against a simulated exchange, the rules matching the calls, the probabilities,
+// and the validation of the rules.
+func TestFaults() os.Error {
+	sim := simex.New("Sim", []xgen.Pair{xgen.BTCUSD}, xgen.Balance{xgen.BTC: d(1), xgen.USD: d(100)})
+	sim.SetBook(xgen.OrderBook{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{{d(9), d(3)}, {d(8), d(3)}}, SellTree: []xgen.Order{{d(10), d(2)}, {d(11), d(5)}}})
+	in := New(1, nil)
+	x := in.Wrap(sim)
+
+	// A failed order doesn't reach the exchange, unless the response is lost after it was sent
+	in.Rules = []Rule{{Call: "Buy", Kind: Fail, Probability: 1}}
+	err := x.Buy(nil, xgen.BTCUSD, d(10), d(0.5))
+	if !restapi.Temporary(err) || len(sim.Fills()) != 0 {
+		return os.NewError(fmt.Sprint("TestFaults: Buy = ", err, " with ", len(sim.Fills()), " fills, want a temporary error and no fills"))
+	}
+	in.Rules[0].Sent = true
+	err = x.Buy(nil, xgen.BTCUSD, d(10), d(0.5))
+	if !restapi.Temporary(err) || len(sim.Fills()) != 1 {
+		return os.NewError(fmt.Sprint("TestFaults: Buy sent = ", err, " with ", len(sim.Fills()), " fills, want a temporary error and 1 fill"))
+	}
+
+	// Rules for other exchanges or calls don't apply, and Stale returns the result of the last call without a fault
+	in.Rules = []Rule{{Exchange: "Other", Kind: Fail, Probability: 1}, {Call: "Sell", Kind: Fail, Probability: 1}}
+	before, err := x.GetBalance(nil)
+	if err != nil {
+		return err
+	}
+	if err = x.Buy(nil, xgen.BTCUSD, d(10), d(0.5)); err != nil {
+		return err
+	}
+	in.Rules = []Rule{{Call: "GetBalance", Kind: Stale, Probability: 1}}
+	funds, err := x.GetBalance(nil)
+	if err != nil {
+		return err
+	}
+	if funds[xgen.BTC] != before[xgen.BTC] || funds[xgen.USD] != before[xgen.USD] || funds[xgen.BTC] != d(1.5) {
+		return os.NewError(fmt.Sprint("TestFaults: stale GetBalance<br>=<br>", funds, "<br>want<br>", before))
+	}
+	in.Rules = nil
+	book, err := x.GetOrderBook(nil, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	want := fmt.Sprint(book)
+	book.BuyTree[0].Amount = 0 // Changing a result must not change the stale data
+	in.Rules = []Rule{{Call: "GetOrderBook", Kind: Stale, Probability: 1}}
+	if book, err = x.GetOrderBook(nil, xgen.BTCUSD); err != nil {
+		return err
+	}
+	if fmt.Sprint(book) != want {
+		return os.NewError(fmt.Sprint("TestFaults: stale GetOrderBook<br>=<br>", book, "<br>want<br>", want))
+	}
+
+	// Partial data
+	in.Rules = []Rule{{Kind: Partial, Probability: 1}}
+	b, err := x.GetOrderBook(nil, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(b.BuyTree) != 1 || len(b.SellTree) != 1 {
+		return os.NewError(fmt.Sprint("TestFaults: partial GetOrderBook<br>=<br>", b))
+	}
+	if funds, err = x.GetBalance(nil); err != nil {
+		return err
+	}
+	if len(funds) != 1 {
+		return os.NewError(fmt.Sprint("TestFaults: partial GetBalance<br>=<br>", funds))
+	}
+	q, err := x.GetQuote(nil, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if q.Validate() {
+		return os.NewError(fmt.Sprint("TestFaults: partial GetQuote<br>=<br>", q, "<br>want an invalid quote"))
+	}
+
+	// A hanging call returns a timeout after the delay
+	in.Rules = []Rule{{Call: "CancelOrder", Kind: Hang, Probability: 1, Delay: 20}}
+	start := time.Nanoseconds()
+	err = x.CancelOrder(nil, xgen.BTCUSD, "1", xgen.BuyOrder)
+	if elapsed := time.Nanoseconds() - start; !restapi.Temporary(err) || elapsed < 20e6 {
+		return os.NewError(fmt.Sprint("TestFaults: hanging CancelOrder = ", err, " after ", elapsed, "ns, want a temporary error after 20ms"))
+	}
+
+	// The faults happen about as often as asked, and they are all recorded
+	in = New(1, []Rule{{Call: "GetQuote", Kind: Fail, Probability: 0.3}})
+	x = in.Wrap(sim)
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err = x.GetQuote(nil, xgen.BTCUSD); err != nil {
+			failed++
+		}
+	}
+	if n := in.Count("Sim", "GetQuote", Fail); failed < 250 || failed > 350 || n != failed {
+		return os.NewError(fmt.Sprint("TestFaults: ", failed, " of 1000 calls failed with probability 0.3 (", n, " faults recorded)"))
+	}
+
+	for _, r := range []Rule{{Kind: "Explode", Probability: 1}, {Call: "Withdraw", Kind: Fail}, {Call: "Buy", Kind: Stale},
+		{Kind: Fail, Probability: 1.5}, {Kind: Hang, Delay: -1}} {
+		if r.Validate() == nil {
+			return os.NewError(fmt.Sprint("TestFaults: invalid rule ", r, " accepted"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package gae
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"os"
+	"strconv"
+	"appdb"
+)
+
+// Datastore implements appdb.Store using Google App Engine's datastore.
+type Datastore struct {
+	c appengine.Context
+}
+
+// Put creates or updates a datastore entity of given kind.
+func (d *Datastore) Put(kind string, sKey string, iKey int64, data interface{}) (err os.Error) {
+	key := datastore.NewKey(d.c, kind, sKey, iKey, nil)
+	_, err = datastore.Put(d.c, key, data)
+	return
+}
+
+// Get retrieves a datastore entity of given kind, and stores the entity to |data|.
+func (d *Datastore) Get(kind string, sKey string, iKey int64, data interface{}) (err os.Error) {
+	key := datastore.NewKey(d.c, kind, sKey, iKey, nil)
+	err = datastore.Get(d.c, key, data)
+	if err == datastore.ErrNoSuchEntity {
+		err = appdb.ErrNoSuchEntity
+	}
+	return
+}
+
+// Search retrieves datastore entities matching search |s|.
+// The cursor returned is the offset of the next page, since the datastore iterators don't provide cursors.
+func (d *Datastore) Search(s *appdb.Search) (data []appdb.Entity, cursor string, err os.Error) {
+	offset := s.Offset
+	if s.Cursor != "" {
+		var n int
+		n, err = strconv.Atoi(s.Cursor)
+		if err != nil {
+			err = os.NewError("gae: invalid cursor: " + s.Cursor)
+			return
+		}
+		offset += n
+	}
+	q := datastore.NewQuery(s.Kind)
+	for _, f := range s.Filters {
+		q = q.Filter(f.Property+" "+f.Operator, f.Value)
+	}
+	if s.Order != "" {
+		q = q.Order(s.Order)
+	}
+	q = q.Offset(offset)
+	if s.Limit > 0 {
+		q = q.Limit(s.Limit)
+	}
+	m := make([]datastore.Map, 0)
+	_, err = q.GetAll(d.c, &m)
+	data = make([]appdb.Entity, len(m))
+	for i, e := range m {
+		data[i] = appdb.Entity(e)
+	}
+	if s.Limit > 0 && len(m) == s.Limit {
+		cursor = strconv.Itoa(offset + len(m))
+	}
+	return
+}
+
+// Delete deletes a datastore entity of given kind.
+func (d *Datastore) Delete(kind string, sKey string, iKey int64) (err os.Error) {
+	key := datastore.NewKey(d.c, kind, sKey, iKey, nil)
+	err = datastore.Delete(d.c, key)
+	return
+}
+
+// RunInTransaction runs |f| in a datastore transaction (the datastore retries the transaction a few times on collisions).
+func (d *Datastore) RunInTransaction(f func(tx appdb.Store) os.Error) (err os.Error) {
+	err = datastore.RunInTransaction(d.c, func(tc appengine.Context) os.Error {
+		return f(&Datastore{tc})
+	}, nil)
+	if err == datastore.ErrConcurrentTransaction {
+		err = appdb.ErrConcurrentTransaction
+	}
+	return
+}
@@ -0,0 +1,66 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package gae runs ArBit on Google App Engine, using urlfetch for the API calls and the datastore for storage.
+package gae
+
+import (
+	"appengine"
+	"appengine/urlfetch"
+	"fmt"
+	"http"
+	"appdb"
+	"arbit"
+	"secrets"
+	"xgen"
+)
+
+// context implements xgen.Context for App Engine requests.
+type context struct {
+	appengine.Context
+	store appdb.Store
+}
+
+func (c *context) Transport() http.RoundTripper {
+	return &urlfetch.Transport{c.Context, 10, true} // Set timeout to 10 seconds (instead of the default 5)
+}
+
+func (c *context) Store() appdb.Store {
+	return c.store
+}
+
+// The logging functions redact the secrets (see package secrets) before writing to the App Engine log.
+func (c *context) Debugf(format string, args ...interface{}) {
+	c.Context.Debugf("%s", secrets.Redact(fmt.Sprintf(format, args...)))
+}
+func (c *context) Infof(format string, args ...interface{}) {
+	c.Context.Infof("%s", secrets.Redact(fmt.Sprintf(format, args...)))
+}
+func (c *context) Warningf(format string, args ...interface{}) {
+	c.Context.Warningf("%s", secrets.Redact(fmt.Sprintf(format, args...)))
+}
+func (c *context) Errorf(format string, args ...interface{}) {
+	c.Context.Errorf("%s", secrets.Redact(fmt.Sprintf(format, args...)))
+}
+func (c *context) Criticalf(format string, args ...interface{}) {
+	c.Context.Criticalf("%s", secrets.Redact(fmt.Sprintf(format, args...)))
+}
+
+// ConfigFile is the config file of ArBit, read from the application directory (see arbit.json.example).
+const ConfigFile = "arbit.json"
+
+func init() {
+	cfg, err := arbit.LoadConfig(ConfigFile)
+	if err != nil {
+		panic(err)
+	}
+	err = arbit.Configure(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	arbit.NewContext = func(r *http.Request) xgen.Context {
+		c := appengine.NewContext(r)
+		return &context{c, &Datastore{c}}
+	}
+}
@@ -4,31 +4,66 @@
 // Package mtgox implements functions for sending and receiving data via Mt Gox API.
 package mtgox
 
+import (
+	"restapi"
+	"strings"
+	"xgen"
+)
+
 // Mt. Gox Trade API: https://mtgox.com/support/tradeAPI
 // API documentation: https://en.bitcoin.it/wiki/MtGox/API
+// The paths of the API functions are relative to the base URL of the API (DefaultURL unless configured otherwise).
 const (
+	DefaultURL = "https://mtgox.com/api/0"
+
 	// Public Market Data
-	JsonTicker = "https://mtgox.com/api/0/data/ticker.php"
-	JsonDepth  = "https://mtgox.com/api/0/data/getDepth.php"
-	JsonRecent = "https://mtgox.com/api/0/data/getTrades.php"
+	JsonTicker = "/data/ticker.php"
+	JsonDepth  = "/data/getDepth.php"
+	JsonRecent = "/data/getTrades.php"
 
 	// Authenticated Trading Functions
-	JsonBalance = "https://mtgox.com/api/0/getFunds.php"
-	JsonOrders  = "https://mtgox.com/api/0/getOrders.php"
-	JsonBuy     = "https://mtgox.com/api/0/buyBTC.php"
-	JsonSell    = "https://mtgox.com/api/0/sellBTC.php"
-	JsonCancel  = "https://mtgox.com/api/0/cancelOrder.php"
+	JsonBalance = "/getFunds.php"
+	JsonOrders  = "/getOrders.php"
+	JsonBuy     = "/buyBTC.php"
+	JsonSell    = "/sellBTC.php"
+	JsonCancel  = "/cancelOrder.php"
 )
 
+// Exchange implements the xgen.Exchange interface for Mt Gox. The base URL, transport and middleware of the HTTP requests
+// are set in the embedded restapi.Client (DefaultURL is used if the base URL is empty).
+type Exchange struct {
+	Login xgen.Credentials
+	restapi.Client
+}
+
+// Name returns the name of the exchange.
+func (e *Exchange) Name() string {
+	return "MtGox"
+}
+
+// url returns the URL of the API function at |path|.
+func (e *Exchange) url(path string) string {
+	if e.BaseURL == "" {
+		return DefaultURL + path
+	}
+	return strings.TrimRight(e.BaseURL, "/") + path
+}
+
+// Pairs returns the trading pairs supported by Mt Gox. Mt Gox also trades BTC against EUR and JPY, but the balance
+// (see GetBalance) only tells the BTC and USD funds, so the other pairs are left out until their funds can be read.
+func (e *Exchange) Pairs() []xgen.Pair {
+	return []xgen.Pair{xgen.BTCUSD}
+}
+
 type quote struct {
-	Buy  float64 // Highest Bid
-	Sell float64 // Lowest Ask
-	Vol  int64   // Traded volume since last close
-	High float64 // Maximum rate (?) since last close
-	Low  float64 // Minimum rate (?) since last close
-	Last float64
-	Avg  float64
-	Vwap float64
+	Buy  xgen.Decimal // Highest Bid
+	Sell xgen.Decimal // Lowest Ask
+	Vol  int64        // Traded volume since last close
+	High xgen.Decimal // Maximum rate (?) since last close
+	Low  xgen.Decimal // Minimum rate (?) since last close
+	Last xgen.Decimal
+	Avg  xgen.Decimal
+	Vwap xgen.Decimal
 }
 
 // Quote is a struct representing the best available buy and sell prices at the time.
@@ -38,8 +73,8 @@ type Quote struct {
 
 // OrderBook is a struct representing a limit order book.
 type OrderBook struct {
-	Asks [][2]float64 // Sell orders (price and amount)
-	Bids [][2]float64 // Buy orders (price and amount)
+	Asks [][2]xgen.Decimal // Sell orders (price and amount)
+	Bids [][2]xgen.Decimal // Buy orders (price and amount)
 }
 
 const (
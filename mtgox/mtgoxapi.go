@@ -1,57 +1,118 @@
 // Copyright 2011 Teppo Salonen. All rights reserved.
 // This file is part of ArBit and distributed under the terms of the MIT/X11 license.
 
-// TODO: Add HTTP headers, though it works fine without the headers too (at least for now)
+// The HTTP headers of the requests (e.g. the User-Agent) are set by the middleware of the client (see restapi.Client).
 
 package mtgox
 
 import (
-	"appengine"
 	"os"
 	"restapi"
 	"xgen"
+	"nonce"
 	"strconv"
 	"sort"
-	"appengine/datastore"
 	"time"
 )
 
-func check(err os.Error) {
+// wrap adds the exchange and the API endpoint |url| to the error in |err|, if any (see xgen.WrapError).
+func (e *Exchange) wrap(url string, err *os.Error) {
+	*err = xgen.WrapError(e.Name(), url, *err)
+}
+
+// errorPatterns classifies the error messages returned by Mt Gox (see xgen.ParseError).
+var errorPatterns = []xgen.ErrorPattern{
+	{"logged in", xgen.AuthFailed}, // "Must be logged in"
+	{"invalid key", xgen.AuthFailed},
+	{"signature", xgen.AuthFailed},
+	{"nonce", xgen.AuthFailed},
+	{"insufficient funds", xgen.InsufficientFunds},
+	{"minimum", xgen.BelowMinimum},
+	{"too many requests", xgen.RateLimited},
+	{"order not found", xgen.UnknownOrder},
+	{"maintenance", xgen.Unavailable},
+}
+
+// apiError returns the error reported by Mt Gox in the API response |b|, or nil if there is none.
+func (e *Exchange) apiError(b []byte) os.Error {
+	return xgen.ParseError(e.Name(), b, errorPatterns)
+}
+
+// get fetches public market data, waiting for the rate limit of the public API (see restapi.SetLimit).
+// Failed requests are retried (see restapi.Retry).
+func (e *Exchange) get(c xgen.Context, url string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		restapi.Wait(e.Name(), restapi.Public)
+		return restapi.GetJsonChecked(e.Context(c), url, e.apiError, a)
+	})
+}
+
+// query is like post, but failed requests are retried (see restapi.Retry), so it must only be used for reading account data.
+func (e *Exchange) query(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		return e.post(c, url, data, a)
+	})
+}
+
+// post makes an authenticated API call, waiting for the rate limit of the authenticated API. The request is signed with the API key
+// if the credentials have one, and otherwise the username and password are sent in the form. Each call has a unique nonce (see package nonce).
+func (e *Exchange) post(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	restapi.Wait(e.Name(), restapi.Private)
+	login := e.Login.Username
+	if e.Login.HasKey() {
+		login = e.Login.Key
+	}
+	n, err := nonce.Next(c.Store(), e.Name(), login)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	data["nonce"] = []string{strconv.Itoa64(n)}
+	if e.Login.HasKey() {
+		s, err := restapi.NewHmacSigner(e.Login.Key, e.Login.Secret)
+		if err != nil {
+			return err
+		}
+		return restapi.PostJsonChecked(e.Context(c), url, data, s, e.apiError, a)
+	}
+	data["name"] = []string{e.Login.Username}
+	data["pass"] = []string{e.Login.Password}
+	return restapi.PostJsonChecked(e.Context(c), url, data, nil, e.apiError, a)
 }
 
 // GetQuote retrieves the "ticker" data.
-func GetQuote(c appengine.Context) (x xgen.Quote, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetQuote(c xgen.Context, pair xgen.Pair) (x xgen.Quote, err os.Error) {
+	defer e.wrap(e.url(JsonTicker), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var q Quote
-	err = restapi.GetJson(c, JsonTicker, &q)
-	check(err)
-	x.Date = datastore.SecondsToTime(time.Seconds())
+	err = e.get(c, e.url(JsonTicker)+"?Currency="+string(pair.Quote), &q)
+	if err != nil {
+		return
+	}
+	x.Pair = pair
+	x.Date = time.Seconds()
 	x.HighestBuy = q.Ticker.Buy
 	x.LowestSell = q.Ticker.Sell
 	x.Last = q.Ticker.Last
 	if !x.Validate() {
-		panic("Invalid Ticker")
+		err = os.NewError("invalid ticker")
 	}
 	return
 }
 
 // GetOrderBook retrieves the limit order book.
-func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (x xgen.OrderBook, err os.Error) {
+	defer e.wrap(e.url(JsonDepth), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var b OrderBook
-	err = restapi.GetJson(c, JsonDepth, &b)
-	check(err)
+	err = e.get(c, e.url(JsonDepth)+"?Currency="+string(pair.Quote), &b)
+	if err != nil {
+		return
+	}
+	x.Pair = pair
 	for _, ask := range b.Asks {
 		o := xgen.Order{Price: ask[Price], Amount: ask[Amount]}
 		x.SellTree = append(x.SellTree, o)
@@ -61,7 +122,8 @@ func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
 		x.BuyTree = append(x.BuyTree, o)
 	}
 	if !x.Validate() {
-		panic("Invalid Depth")
+		err = os.NewError("invalid depth")
+		return
 	}
 	sort.Sort(x.BuyTree)
 	sort.Sort(x.SellTree)
@@ -70,91 +132,107 @@ func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
 }
 
 // GetBalance retrieves the account balance.
-func GetBalance(c appengine.Context, login xgen.Credentials) (x xgen.Balance, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetBalance(c xgen.Context) (x xgen.Balance, err os.Error) {
+	defer e.wrap(e.url(JsonBalance), &err)
 	var b Balance
-	err = restapi.PostJson(c, JsonBalance, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "nonce": {strconv.Itoa64(time.Nanoseconds())}}, &b)
-	check(err)
-	x[xgen.BTC], err = strconv.Atof64(b.Btcs)
-	check(err)
-	x[xgen.USD], err = strconv.Atof64(b.Usds)
-	check(err)
+	err = e.query(c, e.url(JsonBalance), map[string][]string{}, &b)
+	if err != nil {
+		return
+	}
+	x = make(xgen.Balance)
+	if x[xgen.BTC], err = xgen.ParseDecimal(b.Btcs); err != nil {
+		return
+	}
+	x[xgen.USD], err = xgen.ParseDecimal(b.Usds)
 	return
 }
 
-func (h OpenOrders) convert() (o xgen.OpenOrders) { // Convert mtgox.OpenOrders to xgen.OpenOrders
-	var err os.Error
+func (h OpenOrders) convert(pair xgen.Pair) (o xgen.OpenOrders, err os.Error) { // Convert mtgox.OpenOrders (of the given trading pair) to xgen.OpenOrders
+	o.Pair = pair
 	o.Sell = make(map[string]xgen.OpenOrder)
 	o.Buy = make(map[string]xgen.OpenOrder)
 	for _, order := range h.Orders {
+		if order.Currency != string(pair.Quote) || order.Item != string(pair.Base) {
+			continue
+		}
 		var t xgen.OpenOrder
 		t.Date = order.Date
-		t.Price, err = strconv.Atof64(order.Price)
-		check(err)
-		t.Amount, err = strconv.Atof64(order.Amount)
-		check(err)
+		if t.Price, err = xgen.ParseDecimal(order.Price); err != nil {
+			return
+		}
+		if t.Amount, err = xgen.ParseDecimal(order.Amount); err != nil {
+			return
+		}
 		if order.OrderType == 1 { // Sell order
 			o.Sell[order.Oid] = t
 		} else if order.OrderType == 2 { // Buy order
 			o.Buy[order.Oid] = t
 		} else {
-			panic("Invalid order type")
+			err = os.NewError("invalid order type " + strconv.Itoa(int(order.OrderType)))
+			return
 		}
 	}
 	return
 }
 
 // GetOpenOrders retrieves a list of all open orders.
-func GetOpenOrders(c appengine.Context, login xgen.Credentials) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (x xgen.OpenOrders, err os.Error) {
+	defer e.wrap(e.url(JsonOrders), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonOrders, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "nonce": {strconv.Itoa64(time.Nanoseconds())}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
-	return
+	err = e.query(c, e.url(JsonOrders), map[string][]string{}, &openOrders)
+	if err != nil {
+		return
+	}
+	return openOrders.convert(pair)
 }
 
 // CancelOrder cancels an open order.
-func CancelOrder(c appengine.Context, login xgen.Credentials, oid string, orderType int8) (f interface{}, err os.Error) {
-	err = restapi.PostJson(c, JsonCancel, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "nonce": {strconv.Itoa64(time.Nanoseconds())},
-		"oid": {oid}, "type": {strconv.Itoa(int(orderType))}}, &f)
+func (e *Exchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) (err os.Error) {
+	defer e.wrap(e.url(JsonCancel), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
+	t := 2 // Mt Gox order types: 1 = Sell order, 2 = Buy order
+	if orderType == xgen.SellOrder {
+		t = 1
+	}
+	var f interface{}
+	err = e.post(c, e.url(JsonCancel), map[string][]string{"oid": {oid}, "type": {strconv.Itoa(t)}}, &f)
 	return
 }
 
-// Buy opens a new order to buy BTC.
-func Buy(c appengine.Context, login xgen.Credentials, price float64, amount float64) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+// Buy opens a new order to buy BTC. The price and amount are rounded down to the scales of the currencies, so that
+// the order never costs more than the funds it was calculated for.
+func (e *Exchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonBuy), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonBuy, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "nonce": {strconv.Itoa64(time.Nanoseconds())},
-		"price": {strconv.Ftoa64(price, 'f', -1)}, "amount": {strconv.Ftoa64(amount, 'f', -1)}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
+	err = e.post(c, e.url(JsonBuy), map[string][]string{"Currency": {string(pair.Quote)},
+		"price": {price.Trunc(pair.Quote.Scale()).String()}, "amount": {amount.Trunc(pair.Base.Scale()).String()}}, &openOrders)
+	if err != nil {
+		return
+	}
+	_, err = openOrders.convert(pair) // Checks that the returned orders are valid
 	return
 }
 
-// Sell opens a new order to sell BTC.
-func Sell(c appengine.Context, login xgen.Credentials, price float64, amount float64) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+// Sell opens a new order to sell BTC. The amount is rounded down to the scale of BTC, so that it never exceeds the funds.
+func (e *Exchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonSell), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonSell, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "nonce": {strconv.Itoa64(time.Nanoseconds())},
-		"price": {strconv.Ftoa64(price, 'f', -1)}, "amount": {strconv.Ftoa64(amount, 'f', -1)}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
+	err = e.post(c, e.url(JsonSell), map[string][]string{"Currency": {string(pair.Quote)},
+		"price": {price.Round(pair.Quote.Scale()).String()}, "amount": {amount.Trunc(pair.Base.Scale()).String()}}, &openOrders)
+	if err != nil {
+		return
+	}
+	_, err = openOrders.convert(pair) // Checks that the returned orders are valid
 	return
 }
@@ -0,0 +1,122 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package mtgox
+
+import (
+	"os"
+	"fmt"
+	"restapi"
+	"xgen"
+)
+
+func d(f float64) xgen.Decimal {
+	return xgen.NewDecimal(f)
+}
+
+// TestMtGox checks the API calls against a stand-in for Mt Gox: the parsing of the replies, the requests made,
+// the classification of the errors, and the retries of temporary failures.
+func TestMtGox() os.Error {
+	savedRetries := restapi.Retries
+	restapi.Retries = restapi.RetryPolicy{3, 1e6, 1e6}
+	defer func() { restapi.Retries = savedRetries }()
+	s, err := NewStandIn()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c := restapi.NewTestContext()
+	e := s.Exchange(xgen.Credentials{Key: "key", Secret: "c2VjcmV0"})
+
+	if err = s.SetQuote(xgen.Quote{HighestBuy: d(10), LowestSell: d(10.5), Last: d(10.2)}); err != nil {
+		return err
+	}
+	q, err := e.GetQuote(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if q.HighestBuy != d(10) || q.LowestSell != d(10.5) || q.Last != d(10.2) {
+		return os.NewError(fmt.Sprint("TestMtGox: GetQuote<br>=<br>", q))
+	}
+
+	// The order book is sorted (best prices first)
+	err = s.SetBook(xgen.OrderBook{BuyTree: []xgen.Order{{d(9), d(1)}, {d(10), d(2)}}, SellTree: []xgen.Order{{d(11), d(3)}, {d(10.5), d(4)}}})
+	if err != nil {
+		return err
+	}
+	b, err := e.GetOrderBook(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(b.BuyTree) != 2 || b.BuyTree[0] != (xgen.Order{d(10), d(2)}) || len(b.SellTree) != 2 || b.SellTree[0] != (xgen.Order{d(10.5), d(4)}) {
+		return os.NewError(fmt.Sprint("TestMtGox: GetOrderBook<br>=<br>", b))
+	}
+
+	// A failing server is retried
+	if err = s.SetBalance(xgen.Balance{xgen.BTC: d(1.5), xgen.USD: d(100)}); err != nil {
+		return err
+	}
+	s.ReplyOnce(JsonBalance, 503, "")
+	funds, err := e.GetBalance(c)
+	if err != nil {
+		return err
+	}
+	if funds[xgen.BTC] != d(1.5) || funds[xgen.USD] != d(100) || len(s.Calls(JsonBalance)) != 2 {
+		return os.NewError(fmt.Sprint("TestMtGox: GetBalance<br>=<br>", funds, " after ", len(s.Calls(JsonBalance)), " requests, want 2"))
+	}
+
+	// The balance has no EUR funds, so the BTC/EUR pair is not traded (instead of always seeing zero funds)
+	btceur := xgen.Pair{xgen.BTC, xgen.EUR}
+	if xgen.Supports(e, btceur) || funds[xgen.EUR] != 0 {
+		return os.NewError(fmt.Sprint("TestMtGox: ", btceur, " supported with EUR funds ", funds[xgen.EUR], ", want unsupported"))
+	}
+	if _, err = e.GetOrderBook(c, btceur); err == nil {
+		return os.NewError("TestMtGox: GetOrderBook accepted " + btceur.String())
+	}
+
+	err = s.SetOpenOrders(xgen.OpenOrders{xgen.BTCUSD, map[string]xgen.OpenOrder{"a1": {1318000000, d(9.5), d(2)}}, nil})
+	if err != nil {
+		return err
+	}
+	open, err := e.GetOpenOrders(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(open.Buy) != 1 || len(open.Sell) != 0 || open.Buy["a1"] != (xgen.OpenOrder{1318000000, d(9.5), d(2)}) {
+		return os.NewError(fmt.Sprint("TestMtGox: GetOpenOrders<br>=<br>", open))
+	}
+
+	// The orders are sent with the price and amount rounded down and a new nonce
+	if err = e.Buy(c, xgen.BTCUSD, d(9.123456), d(2)); err != nil {
+		return err
+	}
+	calls := s.Calls(JsonBuy)
+	if len(calls) != 1 || calls[0].Get("price") != "9.12345" || calls[0].Get("amount") != "2" || calls[0].Get("Currency") != "USD" || calls[0].Get("nonce") == "" {
+		return os.NewError(fmt.Sprint("TestMtGox: Buy sent<br>", calls))
+	}
+
+	// Errors are classified, and are not retried for orders
+	s.ReplyError(JsonSell, "Insufficient funds")
+	err = e.Sell(c, xgen.BTCUSD, d(12), d(5))
+	if xgen.ClassOf(err) != xgen.InsufficientFunds || len(s.Calls(JsonSell)) != 1 {
+		return os.NewError(fmt.Sprint("TestMtGox: Sell = ", err, " after ", len(s.Calls(JsonSell)), " requests, want ", xgen.InsufficientFunds, " after 1"))
+	}
+	if ce, ok := err.(*xgen.CallError); !ok || ce.Exchange != "MtGox" || ce.Endpoint != s.URL+JsonSell {
+		return os.NewError(fmt.Sprint("TestMtGox: Sell = ", err, ", want the exchange and ", s.URL+JsonSell, " in the error"))
+	}
+	s.ReplyError(JsonCancel, "Order not found")
+	err = e.CancelOrder(c, xgen.BTCUSD, "a2", xgen.SellOrder)
+	if xgen.ClassOf(err) != xgen.UnknownOrder {
+		return os.NewError(fmt.Sprint("TestMtGox: CancelOrder = ", err, ", want ", xgen.UnknownOrder))
+	}
+	calls = s.Calls(JsonCancel)
+	if calls[0].Get("oid") != "a2" || calls[0].Get("type") != "1" {
+		return os.NewError(fmt.Sprint("TestMtGox: CancelOrder sent<br>", calls))
+	}
+
+	// Without a base URL, the client uses the real exchange
+	if url := (&Exchange{}).url(JsonDepth); url != "https://mtgox.com/api/0/data/getDepth.php" {
+		return os.NewError("TestMtGox: default URL of JsonDepth " + url)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package mtgox
+
+import (
+	"os"
+	"http"
+	"restapi"
+	"xgen"
+)
+
+// StandIn is a local server standing in for the Mt Gox API in the tests (see restapi.StandIn). The replies are set from
+// the types of package xgen, and served in the JSON shapes of the structs of this package.
+type StandIn struct {
+	*restapi.StandIn
+}
+
+// NewStandIn starts a stand-in for Mt Gox with no open orders. The market data and the balance must be set before they are requested.
+func NewStandIn() (*StandIn, os.Error) {
+	rs, err := restapi.NewStandIn()
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{rs}
+	if err = s.SetOpenOrders(xgen.OpenOrders{Pair: xgen.BTCUSD}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetQuote sets the ticker to |q|.
+func (s *StandIn) SetQuote(q xgen.Quote) os.Error {
+	return s.ReplyJson(JsonTicker, Quote{quote{Buy: q.HighestBuy, Sell: q.LowestSell, Last: q.Last}})
+}
+
+// SetBook sets the order book to |b|.
+func (s *StandIn) SetBook(b xgen.OrderBook) os.Error {
+	var d OrderBook
+	for _, o := range b.SellTree {
+		d.Asks = append(d.Asks, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	for _, o := range b.BuyTree {
+		d.Bids = append(d.Bids, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	return s.ReplyJson(JsonDepth, d)
+}
+
+// SetBalance sets the BTC and USD funds of the account to those of |b|.
+func (s *StandIn) SetBalance(b xgen.Balance) os.Error {
+	return s.ReplyJson(JsonBalance, Balance{Usds: b[xgen.USD].String(), Btcs: b[xgen.BTC].String()})
+}
+
+// SetOpenOrders sets the open orders of the account to |o|. Mt Gox returns the open orders after placing
+// and canceling an order too, so they are the reply of those functions as well.
+func (s *StandIn) SetOpenOrders(o xgen.OpenOrders) os.Error {
+	var h OpenOrders
+	add := func(orders map[string]xgen.OpenOrder, t int8) {
+		for oid, order := range orders {
+			h.Orders = append(h.Orders, openOrder{OrderType: t, Status: 1, Real_status: "open", Oid: oid,
+				Currency: string(o.Pair.Quote), Item: string(o.Pair.Base), Price: order.Price.String(),
+				Amount: order.Amount.String(), Date: order.Date})
+		}
+	}
+	add(o.Sell, 1)
+	add(o.Buy, 2)
+	for _, url := range []string{JsonOrders, JsonBuy, JsonSell, JsonCancel} {
+		if err := s.ReplyJson(url, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exchange returns a client of the stand-in logging in with |login|.
+func (s *StandIn) Exchange(login xgen.Credentials) *Exchange {
+	return &Exchange{Login: login, Client: restapi.Client{BaseURL: s.URL, Transport: http.DefaultTransport}}
+}
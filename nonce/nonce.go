@@ -0,0 +1,100 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package nonce generates the nonces for authenticated API calls. The nonces of each exchange account are strictly increasing,
+// even if the clock goes backwards or the calls are made concurrently, and they are never reused after a restart:
+// the nonces are reserved in blocks, and the end of the reserved block (the high-water mark) is stored with appdb
+// before any nonce of the block is handed out.
+package nonce
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"appdb"
+)
+
+// Kind is the datastore kind of the stored high-water marks.
+const Kind = "Nonce"
+
+// Block is the number of nonces reserved at a time. Nonces follow the clock in nanoseconds (as the exchanges expect
+// increasing timestamps), so a block lasts about a minute before the next one has to be stored.
+var Block int64 = 60 * 1e9
+
+// Manager generates the nonces of a single exchange account. The managers only coordinate the calls within one process,
+// so the same account must not be used by several processes at the same time.
+type Manager struct {
+	mu     sync.Mutex
+	id     string // Key of the stored high-water mark
+	loaded bool
+	last   int64 // Last nonce handed out
+	limit  int64 // End of the reserved block (exclusive)
+}
+
+// mark is the stored high-water mark: all nonces below Limit may have been used already.
+type mark struct {
+	Limit int64
+}
+
+var (
+	mu       sync.Mutex
+	managers = make(map[string]*Manager)
+)
+
+// For returns the nonce manager of the account |login| (e.g. the username or API key) at |exchange|.
+// The login is only stored as a hash, so that no credentials end up in the datastore.
+func For(exchange string, login string) *Manager {
+	id := exchange + "_" + fmt.Sprintf("%x", sha256Sum(login))[:16]
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := managers[id]
+	if !ok {
+		m = &Manager{id: id}
+		managers[id] = m
+	}
+	return m
+}
+
+// Next returns a nonce for the account |login| at |exchange| (see For and Manager.Next).
+func Next(s appdb.Store, exchange string, login string) (int64, os.Error) {
+	return For(exchange, login).Next(s)
+}
+
+// Next returns the next nonce, which is greater than any nonce returned before (also before a restart, as long as the
+// same storage |s| is used). If a new block has to be reserved and storing it fails, no nonce is returned.
+func (m *Manager) Next(s appdb.Store) (int64, os.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.loaded {
+		var h mark
+		err := s.Get(Kind, m.id, 0, &h)
+		if err != nil && err != appdb.ErrNoSuchEntity {
+			return 0, err
+		}
+		m.last = h.Limit - 1
+		m.limit = h.Limit
+		m.loaded = true
+	}
+	n := m.last + 1
+	if now := time.Nanoseconds(); now > n {
+		n = now
+	}
+	if n >= m.limit {
+		limit := n + Block
+		err := s.Put(Kind, m.id, 0, &mark{limit})
+		if err != nil {
+			return 0, err
+		}
+		m.limit = limit
+	}
+	m.last = n
+	return n, nil
+}
+
+func sha256Sum(s string) []byte {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return h.Sum()
+}
@@ -0,0 +1,72 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package nonce
+
+import (
+	"os"
+	"fmt"
+	"appdb"
+)
+
+// TestNonce checks that the nonces are unique and increasing when requested concurrently,
+// after the clock has gone backwards, and after a restart (simulated with a new Manager using the same store |s|).
+func TestNonce(s appdb.Store) os.Error {
+	saved := Block
+	Block = 10 // Reserve small blocks to store the high-water mark often
+	defer func() { Block = saved }()
+
+	m := &Manager{id: "Test"}
+	c := make(chan int64)
+	errc := make(chan os.Error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				n, err := m.Next(s)
+				if err != nil {
+					errc <- err
+					return
+				}
+				c <- n
+			}
+		}()
+	}
+	seen := make(map[int64]bool)
+	var max int64
+	for len(seen) < 100 {
+		select {
+		case n := <-c:
+			if seen[n] {
+				return os.NewError(fmt.Sprint("Manager.Next: nonce ", n, " returned twice"))
+			}
+			seen[n] = true
+			if n > max {
+				max = n
+			}
+		case err := <-errc:
+			return err
+		}
+	}
+
+	// Clock going backwards: the last nonce is far in the future
+	m.last += 1e15
+	max = m.last
+	n, err := m.Next(s)
+	if err != nil {
+		return err
+	}
+	if n != max+1 {
+		return os.NewError(fmt.Sprint("Manager.Next after clock adjustment = ", n, ", want ", max+1))
+	}
+
+	// Restart
+	m = &Manager{id: "Test"}
+	n2, err := m.Next(s)
+	if err != nil {
+		return err
+	}
+	if n2 <= n {
+		return os.NewError(fmt.Sprint("Manager.Next after restart = ", n2, ", want > ", n))
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"os"
+	"bytes"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"json"
+	"sort"
+	"strings"
+	"sync"
+	"secrets"
+)
+
+// Interaction is an HTTP request made to an API and the response to it, as stored in a cassette.
+type Interaction struct {
+	Method string
+	URL    string   // With the query string
+	Form   []string // Fields of the form posted as "key=value", sorted (see Scrub)
+	Status int
+	Body   string // Response body
+	Error  string // Error of the transport for a request that got no response (e.g. a network error)
+}
+
+// Cassette is a list of interactions, recorded from the real APIs by a Recorder and replayed by a Player, so that
+// the code calling the APIs can be run deterministically in tests and backtests without the exchanges.
+type Cassette struct {
+	Interactions []Interaction
+}
+
+// ScrubbedFields are the form fields whose values are replaced with "*" in the cassettes: the credentials, which must
+// never be stored, and the nonces, which change on every run. The values of the registered secrets (see package secrets)
+// are redacted from all the fields, URLs and responses too.
+var ScrubbedFields = []string{"name", "user", "pass", "password", "nonce"}
+
+// LoadCassette reads a cassette from file |filename|.
+func LoadCassette(filename string) (*Cassette, os.Error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Cassette)
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, os.NewError("restapi: cassette " + filename + ": " + err.String())
+	}
+	return c, nil
+}
+
+// Save writes the cassette to file |filename|, replacing the file atomically.
+func (c *Cassette) Save(filename string) os.Error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filename+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// Scrub returns the fields of the form-encoded |body| as "key=value" strings (sorted by key), with the values of
+// ScrubbedFields replaced with "*" and the registered secrets redacted.
+func Scrub(body string) ([]string, os.Error) {
+	values, err := http.ParseQuery(body)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for k, vs := range values {
+		for _, v := range vs {
+			for _, f := range ScrubbedFields {
+				if k == f {
+					v = "*"
+				}
+			}
+			fields = append(fields, k+"="+secrets.Redact(v))
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// request returns the scrubbed Interaction for |req| (without the response). The body of |req| is read, so it is
+// replaced with a copy.
+func request(req *http.Request) (Interaction, os.Error) {
+	in := Interaction{Method: req.Method, URL: secrets.Redact(req.URL.String())}
+	if req.Body == nil {
+		return in, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return in, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	in.Form, err = Scrub(string(b))
+	return in, err
+}
+
+// Recorder is a transport recording the interactions with the APIs. The requests are sent with Transport, and the
+// cassette is saved to the file after each interaction, so that nothing is lost if the process is killed. A request
+// failing in Transport is recorded with the error (redacted) instead of a response, and the Player returns the error.
+type Recorder struct {
+	Transport http.RoundTripper
+	filename  string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a recorder sending the requests with transport |t| and saving the cassette to file |filename|.
+func NewRecorder(filename string, t http.RoundTripper) *Recorder {
+	return &Recorder{Transport: t, filename: filename}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	in, err := request(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.Transport.RoundTrip(req)
+	if err == nil {
+		var b []byte
+		b, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+		in.Status, in.Body = res.StatusCode, secrets.Redact(string(b))
+	}
+	if err != nil {
+		res, in.Error = nil, secrets.Redact(err.String())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, in)
+	if serr := r.cassette.Save(r.filename); serr != nil {
+		return nil, serr
+	}
+	return res, err
+}
+
+// MismatchError is returned by a Player for a request that is not the next request to its host in the cassette. The difference is
+// shown as a diff of the method, URL and form fields of the requests: the lines of the cassette missing from the request
+// start with "-", and the lines of the request missing from the cassette with "+".
+type MismatchError struct {
+	Index int // Index of the interaction in the cassette
+	Diff  string
+}
+
+func (e *MismatchError) String() string {
+	return fmt.Sprint("restapi: request ", e.Index+1, " does not match the cassette:\n", e.Diff)
+}
+
+// lines returns the request of |in| as lines of text: the method and URL, followed by the form fields.
+func (in *Interaction) lines() []string {
+	return append([]string{in.Method + " " + in.URL}, in.Form...)
+}
+
+// diff returns the differences of the sorted lines |want| and |got| (or "" if there are none). The first line
+// (the method and the URL) is compared separately, since it is not sorted with the rest.
+func diff(want []string, got []string) string {
+	s, same := "", true
+	line := func(prefix string, l string) {
+		s += prefix + l + "\n"
+		if prefix != "  " {
+			same = false
+		}
+	}
+	if want[0] == got[0] {
+		line("  ", want[0])
+	} else {
+		line("- ", want[0])
+		line("+ ", got[0])
+	}
+	i, j := 1, 1
+	for i < len(want) || j < len(got) {
+		switch {
+		case j == len(got) || i < len(want) && want[i] < got[j]:
+			line("- ", want[i])
+			i++
+		case i == len(want) || got[j] < want[i]:
+			line("+ ", got[j])
+			j++
+		default:
+			line("  ", want[i])
+			i++
+			j++
+		}
+	}
+	if same {
+		return ""
+	}
+	return s
+}
+
+// Player is a transport replaying a cassette: each request must match the next interaction with the same host
+// in the cassette (after scrubbing, see Scrub), and gets the recorded response. No request is sent to the APIs.
+// The order is only kept within each host, since the calls to different exchanges are made concurrently (and their
+// order changes from run to run).
+type Player struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	played   []bool
+}
+
+// NewPlayer returns a player replaying cassette |c| from the beginning.
+func NewPlayer(c *Cassette) *Player {
+	return &Player{cassette: c, played: make([]bool, len(c.Interactions))}
+}
+
+// host returns the host (and port) of |url|, or "" if it cannot be parsed.
+func host(url string) string {
+	u, err := http.ParseURL(url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	got, err := request(req)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := -1
+	for i, in := range p.cassette.Interactions {
+		if !p.played[i] && host(in.URL) == req.URL.Host {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return nil, &MismatchError{len(p.cassette.Interactions), "+ " + strings.Join(got.lines(), "\n+ ") + "\n(the cassette has ended for " + req.URL.Host + ")\n"}
+	}
+	want := p.cassette.Interactions[next]
+	if d := diff(want.lines(), got.lines()); d != "" {
+		return nil, &MismatchError{next, d}
+	}
+	p.played[next] = true
+	if want.Error != "" {
+		return nil, os.NewError(want.Error)
+	}
+	return &http.Response{Status: fmt.Sprint(want.Status, " ", http.StatusText(want.Status)), StatusCode: want.Status,
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header), Request: req,
+		Body: ioutil.NopCloser(strings.NewReader(want.Body)), ContentLength: int64(len(want.Body))}, nil
+}
+
+// Done returns an error if some of the interactions in the cassette have not been replayed.
+func (p *Player) Done() os.Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, first := 0, -1
+	for i, played := range p.played {
+		if !played {
+			if first < 0 {
+				first = i
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		return os.NewError(fmt.Sprint("restapi: ", n, " interactions of the cassette not replayed, starting from ",
+			p.cassette.Interactions[first].Method, " ", p.cassette.Interactions[first].URL))
+	}
+	return nil
+}
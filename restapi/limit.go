@@ -0,0 +1,112 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"sync"
+	"time"
+)
+
+// Class is the class of an API endpoint, which may have its own rate limit.
+type Class int
+
+// List of endpoint classes.
+const (
+	Public  Class = iota // Market data
+	Private              // Authenticated trading functions
+)
+
+func (c Class) String() string {
+	if c == Private {
+		return "private"
+	}
+	return "public"
+}
+
+// Limiter is a token bucket limiting the rate of API calls: a token is added to the bucket every |interval|
+// nanoseconds, up to |burst| tokens, and each call takes one token (waiting for it if the bucket is empty).
+type Limiter struct {
+	mu       sync.Mutex
+	interval int64
+	burst    int64
+	full     int64 // Time when the bucket is full again (the bucket is full at any time after this)
+	waited   int64 // Total time the callers have waited, in nanoseconds
+}
+
+// NewLimiter returns a limiter allowing one call every |interval| nanoseconds on average, and |burst| calls at once.
+func NewLimiter(interval int64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{interval: interval, burst: int64(burst)}
+}
+
+// Wait waits until a call is allowed, and returns the time waited in nanoseconds.
+func (l *Limiter) Wait() int64 {
+	l.mu.Lock()
+	now := time.Nanoseconds()
+	if l.full < now {
+		l.full = now
+	}
+	// The bucket holds burst tokens when full, so a token is available once full-now <= (burst-1)*interval
+	wait := l.full - (l.burst-1)*l.interval - now
+	if wait < 0 {
+		wait = 0
+	}
+	l.full += l.interval // Take the token
+	l.waited += wait
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return wait
+}
+
+// Waited returns the total time the callers have waited, in nanoseconds.
+func (l *Limiter) Waited() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waited
+}
+
+var (
+	limitMu  sync.RWMutex
+	limiters = make(map[string]*Limiter) // By limitKey
+)
+
+func limitKey(exchange string, class Class) string {
+	return exchange + "/" + class.String()
+}
+
+// SetLimit sets the rate limit for the |class| endpoints of |exchange| (see NewLimiter).
+func SetLimit(exchange string, class Class, interval int64, burst int) {
+	limitMu.Lock()
+	defer limitMu.Unlock()
+	limiters[limitKey(exchange, class)] = NewLimiter(interval, burst)
+}
+
+// Wait waits until a call to an endpoint of |class| at |exchange| is allowed, and returns the time waited in nanoseconds.
+// Calls to exchanges without a rate limit (see SetLimit) are not limited.
+func Wait(exchange string, class Class) int64 {
+	limitMu.RLock()
+	l := limiters[limitKey(exchange, class)]
+	limitMu.RUnlock()
+	if l == nil {
+		return 0
+	}
+	return l.Wait()
+}
+
+// Waited returns the total time the calls to |exchange| have waited for the rate limits, in nanoseconds.
+func Waited(exchange string) (ns int64) {
+	limitMu.RLock()
+	defer limitMu.RUnlock()
+	for _, class := range []Class{Public, Private} {
+		if l := limiters[limitKey(exchange, class)]; l != nil {
+			ns += l.Waited()
+		}
+	}
+	return
+}
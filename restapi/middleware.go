@@ -0,0 +1,196 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"os"
+	"compress/gzip"
+	"http"
+	"io"
+	"sync"
+	"time"
+)
+
+// Middleware wraps the transport |next|, e.g. to add headers to the requests, or to check or measure the responses.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// TransportFunc is a transport calling the function for each request.
+type TransportFunc func(req *http.Request) (*http.Response, os.Error)
+
+func (f TransportFunc) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	return f(req)
+}
+
+// Chain returns transport |t| wrapped in the middleware |ms|, so that the first middleware sees the requests first
+// (and the responses last).
+func Chain(t http.RoundTripper, ms ...Middleware) http.RoundTripper {
+	for i := len(ms) - 1; i >= 0; i-- {
+		t = ms[i](t)
+	}
+	return t
+}
+
+// Client holds the HTTP settings of an API client: the base URL of the API, the transport, and the middleware the requests
+// go through. It is embedded in the clients of the exchanges, so that the same code can be used with the real exchange,
+// a sandbox, a mirror or a local stand-in (see StandIn).
+type Client struct {
+	BaseURL    string            // Base URL of the API (the URL of the real exchange if empty)
+	Transport  http.RoundTripper // Transport of the HTTP requests (the transport of the context if nil)
+	Middleware []Middleware      // Middleware of the requests, the first one seeing the requests first (see Chain)
+}
+
+// Context returns |c| with the transport of the client: Transport (or the transport of |c|) wrapped in the middleware.
+func (cl *Client) Context(c Context) Context {
+	if cl.Transport == nil && len(cl.Middleware) == 0 {
+		return c
+	}
+	t := cl.Transport
+	if t == nil {
+		t = c.Transport()
+	}
+	return WithTransport(c, Chain(t, cl.Middleware...))
+}
+
+// withHeader returns a copy of |req| with header |key| set to |value| (the transports must not change the requests).
+func withHeader(req *http.Request, key string, value string) *http.Request {
+	r := *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set(key, value)
+	return &r
+}
+
+// Header returns a middleware setting header |key| of the requests to |value|.
+func Header(key string, value string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+			return next.RoundTrip(withHeader(req, key, value))
+		})
+	}
+}
+
+// UserAgent returns a middleware setting the User-Agent header of the requests to |agent|.
+func UserAgent(agent string) Middleware {
+	return Header("User-Agent", agent)
+}
+
+// gzipBody is the body of a compressed response, closing the compressed body with the decompressor.
+type gzipBody struct {
+	io.ReadCloser // Decompressor
+	body          io.ReadCloser
+}
+
+func (b *gzipBody) Close() os.Error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
+
+// Gzip returns a middleware asking for compressed responses, and decompressing them.
+func Gzip() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+			res, err := next.RoundTrip(withHeader(req, "Accept-Encoding", "gzip"))
+			if err != nil || res.Header.Get("Content-Encoding") != "gzip" {
+				return res, err
+			}
+			z, err := gzip.NewReader(res.Body)
+			if err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+			res.Header.Del("Content-Encoding")
+			res.ContentLength = -1
+			res.Body = &gzipBody{z, res.Body}
+			return res, nil
+		})
+	}
+}
+
+// ErrTooLarge is returned for the responses larger than allowed by MaxBytes. It is not temporary (see Retry).
+var ErrTooLarge = os.NewError("restapi: response too large")
+
+// limitedBody is a response body returning ErrTooLarge after |left| bytes.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, os.Error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return 0, ErrTooLarge
+	}
+	return n, err
+}
+
+// MaxBytes returns a middleware failing the responses larger than |n| bytes with ErrTooLarge, so that a broken
+// or hostile server cannot make the caller read an endless response. It must come before Gzip (see Chain) to limit the decompressed
+// responses, since a small compressed response can expand to any size.
+func MaxBytes(n int64) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+			res, err := next.RoundTrip(req)
+			if err != nil {
+				return res, err
+			}
+			if res.ContentLength > n {
+				res.Body.Close()
+				return nil, ErrTooLarge
+			}
+			res.Body = &limitedBody{res.Body, n}
+			return res, nil
+		})
+	}
+}
+
+// Hook returns a middleware calling |f| before each request. If |f| returns an error, the request fails with it
+// without being sent. It is meant for the tests, e.g. to add latency (by sleeping in |f|) or to inject failures.
+func Hook(f func(req *http.Request) os.Error) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+			if err := f(req); err != nil {
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// Stats counts the requests made through the middleware returned by Measure.
+type Stats struct {
+	mu       sync.Mutex
+	requests int
+	failures int   // Transport errors, and responses telling that the server is overloaded or failing
+	elapsed  int64 // Total time until the response headers, in nanoseconds
+}
+
+// Get returns the number of requests and failures, and the total time taken by the requests in nanoseconds.
+func (s *Stats) Get() (requests int, failures int, elapsed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.failures, s.elapsed
+}
+
+// Measure returns a middleware counting the requests and their failures in |s|, and the time they take.
+func Measure(s *Stats) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+			start := time.Nanoseconds()
+			res, err := next.RoundTrip(req)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.requests++
+			if err != nil || res.StatusCode == 429 || res.StatusCode >= 500 {
+				s.failures++
+			}
+			s.elapsed += time.Nanoseconds() - start
+			return res, err
+		})
+	}
+}
@@ -5,65 +5,145 @@
 package restapi
 
 import (
-	"appengine"
-	"appengine/urlfetch"
 	"os"
 	"io/ioutil"
 	"json"
 	"http"
+	"strings"
+	"secrets"
 )
 
+// Context is the environment an API call is made in. It provides the HTTP transport and the logging functions,
+// which are implemented by appengine.Context when running on App Engine, and by the standard library otherwise.
+type Context interface {
+	Transport() http.RoundTripper
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
+}
+
+// transportContext is a Context with its own transport.
+type transportContext struct {
+	Context
+	t http.RoundTripper
+}
+
+func (c transportContext) Transport() http.RoundTripper {
+	return c.t
+}
+
+// WithTransport returns |c| with its transport replaced by |t|, or |c| itself if |t| is nil.
+func WithTransport(c Context, t http.RoundTripper) Context {
+	if t == nil {
+		return c
+	}
+	return transportContext{c, t}
+}
+
+// ErrorFunc returns the error reported by an API in the response body |b|, or nil if the response is not an error.
+type ErrorFunc func(b []byte) os.Error
+
 // GetJson fetches a URL using a GET request, parses the returned JSON response, and stores the response in struct |a|.
-func GetJson(c appengine.Context, url string, a interface{}) (err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
-	b := getUrl(c, url)
-	err = json.Unmarshal(b, &a)
-	return
+// Network errors and overloaded or failing servers are returned as a TemporaryError (see Retry).
+// Any secrets (see package secrets) are redacted from the returned error.
+func GetJson(c Context, url string, a interface{}) os.Error {
+	return GetJsonChecked(c, url, nil, a)
+}
+
+// GetJsonChecked is like GetJson, but the response is first passed to |ef| (unless it is nil), and the error it reports is returned.
+func GetJsonChecked(c Context, url string, ef ErrorFunc, a interface{}) os.Error {
+	b, err := getUrl(c, url)
+	if err != nil {
+		return redact(err)
+	}
+	return decode(b, ef, a)
 }
 
 // PostJson submits data to a URL using a POST request, parses the returned JSON response, and stores the response in struct |a|.
-func PostJson(c appengine.Context, url string, data map[string][]string, a interface{}) (err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
-	b := postForm(c, url, data)
-	err = json.Unmarshal(b, &a)
-	return
+// The errors are returned as by GetJson, but a TemporaryError does not tell whether the request reached the server or not.
+func PostJson(c Context, url string, data map[string][]string, a interface{}) os.Error {
+	return PostJsonChecked(c, url, data, nil, nil, a)
+}
+
+// PostJsonSigned is like PostJson, but the request is signed by |s| (unless it is nil) before sending it.
+func PostJsonSigned(c Context, url string, data map[string][]string, s Signer, a interface{}) os.Error {
+	return PostJsonChecked(c, url, data, s, nil, a)
 }
 
-func check(err os.Error) {
+// PostJsonChecked is like PostJsonSigned, but the response is first passed to |ef| (unless it is nil), and the error it reports is returned.
+func PostJsonChecked(c Context, url string, data map[string][]string, s Signer, ef ErrorFunc, a interface{}) os.Error {
+	b, err := postForm(c, url, data, s)
 	if err != nil {
-		panic(err)
+		return redact(err)
 	}
+	return decode(b, ef, a)
 }
 
-func getUrl(c appengine.Context, url string) []byte {
-	/*client := urlfetch.Client(c)
-	res, err := client.Get(url)
-	check(err)*/
-	req, err := http.NewRequest("GET", url, nil)
-	check(err)
-	t := &urlfetch.Transport{c, 10, true} // Set timeout to 10 seconds (instead of the default 5)
-    res, err := t.RoundTrip(req)
-    check(err)
-	defer res.Body.Close()
-	b, err := ioutil.ReadAll(res.Body)
-	check(err)
-	return b
+// decode checks response |b| for errors with |ef| (unless it is nil), and parses it into |a|.
+func decode(b []byte, ef ErrorFunc, a interface{}) os.Error {
+	if ef != nil {
+		if err := ef(b); err != nil {
+			return redact(err)
+		}
+	}
+	return redact(json.Unmarshal(b, &a))
 }
 
-func postForm(c appengine.Context, url string, data map[string][]string) []byte {
-	client := urlfetch.Client(c)
-	res, err := client.PostForm(url, data)
-	check(err)
+// redact removes the secrets from |err|, keeping a TemporaryError temporary.
+func redact(err os.Error) os.Error {
+	if t, ok := err.(*TemporaryError); ok {
+		return &TemporaryError{secrets.RedactError(t.Err)}
+	}
+	return secrets.RedactError(err)
+}
+
+// readBody reads the body of response |res|. Responses telling that the server is overloaded or failing are errors.
+func readBody(res *http.Response) ([]byte, os.Error) {
 	defer res.Body.Close()
+	if res.StatusCode == 429 || res.StatusCode >= 500 {
+		return nil, &TemporaryError{&StatusError{res.StatusCode, res.Status}}
+	}
 	b, err := ioutil.ReadAll(res.Body)
-	check(err)
-	return b
+	if err == ErrTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &TemporaryError{err}
+	}
+	return b, nil
+}
+
+func getUrl(c Context, url string) ([]byte, os.Error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Transport().RoundTrip(req)
+	if err != nil {
+		return nil, &TemporaryError{err}
+	}
+	return readBody(res)
+}
+
+func postForm(c Context, url string, data map[string][]string, s Signer) ([]byte, os.Error) {
+	body := http.Values(data).Encode()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s != nil {
+		err = s.Sign(req, []byte(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := c.Transport().RoundTrip(req)
+	if err != nil {
+		return nil, &TemporaryError{err}
+	}
+	return readBody(res)
 }
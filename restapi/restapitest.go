@@ -0,0 +1,334 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"os"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"secrets"
+	"appdb"
+)
+
+// TestSign checks the headers set by HmacSigner against a signature computed independently.
+func TestSign() os.Error {
+	s, err := NewHmacSigner("key", "c2VjcmV0") // Secret "secret"
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "https://example.com/", nil)
+	if err != nil {
+		return err
+	}
+	err = s.Sign(req, []byte("nonce=1318000000000000&amount=1"))
+	if err != nil {
+		return err
+	}
+	want := "mZOlbWlJ1rcWrSRXF4YZyN8IIEqfdbWspht3d69K7wuAI7TFPiEKF9CZO+XCwXAkFLFJ3xkreY3cN2dNNR1xLA=="
+	if req.Header.Get("Rest-Key") != "key" || req.Header.Get("Rest-Sign") != want {
+		return os.NewError("HmacSigner.Sign: Rest-Key = " + req.Header.Get("Rest-Key") + ", Rest-Sign = " + req.Header.Get("Rest-Sign") + ", want key, " + want)
+	}
+	if _, err = NewHmacSigner("key", "not base64!"); err == nil {
+		return os.NewError("NewHmacSigner: invalid secret accepted")
+	}
+	return nil
+}
+
+// TestLimiter checks that a limiter lets a burst of calls through at once and then spaces out the calls.
+func TestLimiter() os.Error {
+	l := NewLimiter(20e6, 2) // 20ms, burst of 2
+	for i := 0; i < 2; i++ {
+		if wait := l.Wait(); wait != 0 {
+			return os.NewError("Limiter.Wait: waited " + strconv.Itoa64(wait) + "ns within the burst")
+		}
+	}
+	if wait := l.Wait(); wait < 10e6 || wait > 20e6 {
+		return os.NewError("Limiter.Wait: waited " + strconv.Itoa64(wait) + "ns after the burst, want about 20ms")
+	}
+	if l.Waited() == 0 {
+		return os.NewError("Limiter.Waited = 0")
+	}
+	if wait := Wait("no such exchange", Public); wait != 0 {
+		return os.NewError("Wait: waited " + strconv.Itoa64(wait) + "ns without a limit")
+	}
+	return nil
+}
+
+// TestContext is a Context for the tests of the packages calling the APIs: it discards the log messages, and stores
+// the data in memory (so it is also an xgen.Context). The zero value has no store.
+type TestContext struct {
+	store appdb.Store
+}
+
+// NewTestContext returns a TestContext with an empty memory store.
+func NewTestContext() TestContext {
+	return TestContext{appdb.NewMemStore()}
+}
+
+func (c TestContext) Transport() http.RoundTripper                 { return nil }
+func (c TestContext) Store() appdb.Store                           { return c.store }
+func (c TestContext) Debugf(format string, args ...interface{})    {}
+func (c TestContext) Infof(format string, args ...interface{})     {}
+func (c TestContext) Warningf(format string, args ...interface{})  {}
+func (c TestContext) Errorf(format string, args ...interface{})    {}
+func (c TestContext) Criticalf(format string, args ...interface{}) {}
+
+// TestRetry checks that only temporary errors are retried, and that the backoff grows within its limits.
+func TestRetry() os.Error {
+	var slept []int64
+	sleep = func(ns int64) { slept = append(slept, ns) }
+	defer func() { sleep = time.Sleep }()
+	p := RetryPolicy{4, 100, 300}
+
+	calls := 0
+	err := Retry(TestContext{}, p, func() os.Error {
+		calls++
+		return &TemporaryError{os.NewError("connection reset")}
+	})
+	if !Temporary(err) || calls != 4 || len(slept) != 3 {
+		return os.NewError(fmt.Sprint("Retry: ", calls, " calls and ", len(slept), " waits for a temporary error, want 4 and 3"))
+	}
+	for i, max := range []int64{100, 200, 300} {
+		if slept[i] <= max/2 || slept[i] > max {
+			return os.NewError(fmt.Sprint("Retry: waited ", slept[i], "ns after attempt ", i+1, ", want between ", max/2, " and ", max))
+		}
+	}
+
+	calls = 0
+	err = Retry(TestContext{}, p, func() os.Error {
+		calls++
+		if calls == 2 {
+			return os.NewError("invalid JSON")
+		}
+		return &TemporaryError{&StatusError{503, "503 Service Unavailable"}}
+	})
+	if err == nil || Temporary(err) || calls != 2 {
+		return os.NewError(fmt.Sprint("Retry: ", calls, " calls, error ", err, ", want 2 calls and the permanent error"))
+	}
+	return nil
+}
+
+// TestCassette records calls to a stand-in, and checks that the credentials are scrubbed from the cassette, that the
+// calls (and a network error) are replayed (with a different nonce), and that a request not matching the cassette is
+// reported with a diff.
+func TestCassette() os.Error {
+	s, err := NewStandIn()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Reply("/ticker", 200, `{"last": "10.5"}`)
+	s.Reply("/buy", 200, `{"oid": "1"}`)
+	f, err := ioutil.TempFile("", "cassette")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	dead, err := NewStandIn()
+	if err != nil {
+		return err
+	}
+	dead.Close()
+	defer secrets.Save()()
+	secrets.Register("s3cr3t-key")
+
+	var a map[string]string
+	c := WithTransport(TestContext{}, NewRecorder(f.Name(), http.DefaultTransport))
+	if err = GetJson(c, s.URL+"/ticker", &a); err != nil {
+		return err
+	}
+	form := map[string][]string{"name": {"user"}, "pass": {"p4ss"}, "key": {"s3cr3t-key"}, "nonce": {"1"}, "amount": {"1"}}
+	if err = PostJson(c, s.URL+"/buy", form, &a); err != nil {
+		return err
+	}
+	if err = GetJson(c, dead.URL+"/ticker", &a); !Temporary(err) {
+		return os.NewError(fmt.Sprint("TestCassette: closed server = ", err, ", want a temporary error"))
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	for _, secret := range []string{"user", "p4ss", "s3cr3t-key"} {
+		if strings.Index(string(b), secret) >= 0 {
+			return os.NewError("TestCassette: " + secret + " in the cassette<br>" + string(b))
+		}
+	}
+
+	cassette, err := LoadCassette(f.Name())
+	if err != nil {
+		return err
+	}
+	p := NewPlayer(cassette)
+	c = WithTransport(TestContext{}, p)
+	if err = GetJson(c, s.URL+"/ticker", &a); err != nil {
+		return err
+	}
+	form["nonce"] = []string{"2"}
+	if err = PostJson(c, s.URL+"/buy", form, &a); err != nil {
+		return err
+	}
+	if a["oid"] != "1" || len(s.Calls("/buy")) != 1 {
+		return os.NewError(fmt.Sprint("TestCassette: replayed ", a, " after ", len(s.Calls("/buy")), " requests, want the oid 1 after 1"))
+	}
+	if err = GetJson(c, dead.URL+"/ticker", &a); !Temporary(err) || cassette.Interactions[2].Error == "" {
+		return os.NewError(fmt.Sprint("TestCassette: replayed closed server = ", err, ", want the recorded error ", cassette.Interactions[2].Error))
+	}
+	if err = p.Done(); err != nil {
+		return err
+	}
+
+	p = NewPlayer(cassette)
+	p.RoundTrip(mustRequest("GET", s.URL+"/ticker", ""))
+	_, err = p.RoundTrip(mustRequest("POST", s.URL+"/buy", "amount=2&key=s3cr3t-key"))
+	want := "  POST " + s.URL + "/buy\n- amount=1\n+ amount=2\n  key=[REDACTED]\n- name=*\n- nonce=*\n- pass=*\n"
+	if e, ok := err.(*MismatchError); !ok || e.Index != 1 || e.Diff != want {
+		return os.NewError(fmt.Sprint("TestCassette: mismatch<br>=<br>", err, "<br>want<br>", want))
+	}
+	return nil
+}
+
+// TestConcurrentReplay records the calls to two hosts, and checks that they are replayed when the calls to the hosts
+// are made concurrently (in a different order than recorded), as long as the order of the calls to each host is kept.
+func TestConcurrentReplay() os.Error {
+	var urls []string
+	for i := 0; i < 2; i++ {
+		s, err := NewStandIn()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		s.Reply("/ticker", 200, fmt.Sprintf(`{"last": "%d"}`, i))
+		s.Reply("/depth", 200, `{"asks": "none"}`)
+		urls = append(urls, s.URL)
+	}
+	f, err := ioutil.TempFile("", "cassette")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	var a map[string]interface{}
+	c := WithTransport(TestContext{}, NewRecorder(f.Name(), http.DefaultTransport))
+	for _, path := range []string{"/ticker", "/depth"} {
+		for _, url := range urls {
+			if err = GetJson(c, url+path, &a); err != nil {
+				return err
+			}
+		}
+	}
+	cassette, err := LoadCassette(f.Name())
+	if err != nil {
+		return err
+	}
+
+	p := NewPlayer(cassette)
+	c = WithTransport(TestContext{}, p)
+	done := make(chan os.Error)
+	for i, url := range urls {
+		go func(i int, url string) {
+			time.Sleep(int64(1-i) * 20e6) // The second host first
+			var a map[string]string
+			err := GetJson(c, url+"/ticker", &a)
+			if err == nil && a["last"] != fmt.Sprint(i) {
+				err = os.NewError(fmt.Sprint("TestConcurrentReplay: ticker of host ", i, " = ", a))
+			}
+			if err == nil {
+				err = GetJson(c, url+"/depth", &a)
+			}
+			done <- err
+		}(i, url)
+	}
+	for i := 0; i < len(urls); i++ {
+		if err = <-done; err != nil {
+			return err
+		}
+	}
+	return p.Done()
+}
+
+// mustRequest returns a new request with the form-encoded |body|, or panics.
+func mustRequest(method string, url string, body string) *http.Request {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+// TestMiddleware checks the order of the middleware, the headers set, the decompression of responses, the size limit,
+// and the failures and latency injected with a hook.
+func TestMiddleware() os.Error {
+	var got *http.Request
+	var buf bytes.Buffer
+	z, err := gzip.NewWriter(&buf)
+	if err != nil {
+		return err
+	}
+	z.Write([]byte(`{"last": "10.5"}`))
+	z.Close()
+	server := TransportFunc(func(req *http.Request) (*http.Response, os.Error) {
+		got = req
+		res := &http.Response{StatusCode: 200, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBuffer(buf.Bytes())), ContentLength: -1}
+		if req.Header.Get("Accept-Encoding") == "gzip" {
+			res.Header.Set("Content-Encoding", "gzip")
+		}
+		return res, nil
+	})
+
+	var order string
+	mark := func(s string) Middleware {
+		return Hook(func(req *http.Request) os.Error {
+			order += s
+			return nil
+		})
+	}
+	var stats Stats
+	cl := Client{Transport: server, Middleware: []Middleware{mark("1"), UserAgent("ArBit"), Header("X-Test", "yes"), Gzip(), MaxBytes(100), Measure(&stats), mark("2")}}
+	var a map[string]string
+	if err = GetJson(cl.Context(TestContext{}), "http://example.com/ticker", &a); err != nil {
+		return err
+	}
+	if a["last"] != "10.5" || order != "12" || got.Header.Get("User-Agent") != "ArBit" || got.Header.Get("X-Test") != "yes" {
+		return os.NewError(fmt.Sprint("TestMiddleware: ", a, " with the middleware called in order ", order, " and headers ", got.Header))
+	}
+	if requests, failures, _ := stats.Get(); requests != 1 || failures != 0 {
+		return os.NewError(fmt.Sprint("TestMiddleware: ", requests, " requests and ", failures, " failures measured, want 1 and 0"))
+	}
+
+	// Before Gzip, MaxBytes limits the size of the decompressed response
+	cl.Middleware = []Middleware{MaxBytes(10), Gzip()}
+	if err = GetJson(cl.Context(TestContext{}), "http://example.com/ticker", &a); err != ErrTooLarge {
+		return os.NewError(fmt.Sprint("TestMiddleware: response over MaxBytes = ", err, ", want ", ErrTooLarge))
+	}
+
+	// The hook fails every other request after a delay
+	calls := 0
+	cl.Middleware = []Middleware{Measure(&stats), Hook(func(req *http.Request) os.Error {
+		calls++
+		time.Sleep(20e6)
+		if calls%2 == 1 {
+			return os.NewError("connection refused")
+		}
+		return nil
+	})}
+	err = GetJson(cl.Context(TestContext{}), "http://example.com/ticker", &a)
+	if !Temporary(err) {
+		return os.NewError(fmt.Sprint("TestMiddleware: injected failure = ", err, ", want a temporary error"))
+	}
+	if err = GetJson(cl.Context(TestContext{}), "http://example.com/ticker", &a); err != nil {
+		return err
+	}
+	if requests, failures, elapsed := stats.Get(); requests != 3 || failures != 1 || elapsed < 40e6 {
+		return os.NewError(fmt.Sprint("TestMiddleware: ", requests, " requests, ", failures, " failures and ", elapsed, "ns measured, want 3, 1 and at least 40ms"))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"os"
+	"rand"
+	"time"
+)
+
+// TemporaryError is an error that may go away if the request is repeated, such as a network error or an overloaded server.
+// Whether a temporary error means that the request did not reach the exchange is unknown, so only the requests without
+// side effects can be repeated blindly.
+type TemporaryError struct {
+	Err os.Error
+}
+
+func (e *TemporaryError) String() string {
+	return e.Err.String()
+}
+
+// Temporary tells if |err| is a TemporaryError, or another error telling that it is temporary (such as xgen.ExchangeError).
+func Temporary(err os.Error) bool {
+	switch e := err.(type) {
+	case *TemporaryError:
+		return true
+	case interface {
+		Temporary() bool
+	}:
+		return e.Temporary()
+	}
+	return false
+}
+
+// StatusError is returned for HTTP responses telling that the server is overloaded or failing (status 429 or 5xx).
+// It is always wrapped in a TemporaryError.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) String() string {
+	return "HTTP status " + e.Status
+}
+
+// RetryPolicy tells how many times a request is attempted, and how long to wait between the attempts: the backoff
+// starts at Backoff nanoseconds and doubles after each attempt up to MaxBackoff, and a random jitter of up to half
+// the backoff is subtracted, so that concurrent callers don't retry at the same time.
+type RetryPolicy struct {
+	Attempts   int   // Total number of attempts (1 means no retries)
+	Backoff    int64 // Nanoseconds
+	MaxBackoff int64 // Nanoseconds
+}
+
+// Retries is the policy used by Retry. It is set from the config (see arbit.Configure).
+var Retries = RetryPolicy{3, 500e6, 5e9}
+
+// sleep is replaced by the tests.
+var sleep = time.Sleep
+
+// Delay returns the time to wait in nanoseconds after the failed |attempt| (starting from 1), including the jitter.
+func (p RetryPolicy) Delay(attempt int) int64 {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d - rand.Int63n(d/2)
+}
+
+// Retry calls |f| until it succeeds, returns an error that is not temporary (see Temporary), or the attempts of policy |p|
+// run out, and returns the last error. |f| must be safe to repeat, i.e. it must not have side effects at the exchange,
+// such as placing an order. The retries are logged as warnings.
+func Retry(c Context, p RetryPolicy, f func() os.Error) (err os.Error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || !Temporary(err) || attempt >= p.Attempts {
+			return
+		}
+		d := p.Delay(attempt)
+		c.Warningf("Attempt %d failed, retrying in %d ms: %s", attempt, d/1e6, err)
+		sleep(d)
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,57 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"http"
+	"os"
+)
+
+// Signer adds the authentication of an API key to a request, whose (URL encoded form) body is |body|.
+type Signer interface {
+	Sign(req *http.Request, body []byte) os.Error
+}
+
+// HmacSigner signs requests with HMAC-SHA512 as required by the Mt Gox API (and other APIs modelled after it):
+// the key is sent in the KeyHeader, and the base64 encoded HMAC-SHA512 of the body in the SignHeader.
+// The body must contain a nonce, which makes each signature unique.
+type HmacSigner struct {
+	Key        string // API key
+	Secret     []byte // API secret (decoded, e.g. with base64.StdEncoding if the exchange gives it in base64)
+	KeyHeader  string // "Rest-Key" if empty
+	SignHeader string // "Rest-Sign" if empty
+}
+
+// NewHmacSigner returns a Mt Gox style signer for the API key |key| and its base64 encoded secret.
+func NewHmacSigner(key string, secret string) (*HmacSigner, os.Error) {
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, os.NewError("restapi: invalid API secret (base64 expected)")
+	}
+	return &HmacSigner{Key: key, Secret: b}, nil
+}
+
+// Sign sets the key and signature headers of |req|.
+func (s *HmacSigner) Sign(req *http.Request, body []byte) os.Error {
+	keyHeader, signHeader := s.KeyHeader, s.SignHeader
+	if keyHeader == "" {
+		keyHeader = "Rest-Key"
+	}
+	if signHeader == "" {
+		signHeader = "Rest-Sign"
+	}
+	req.Header.Set(keyHeader, s.Key)
+	req.Header.Set(signHeader, s.Signature(body))
+	return nil
+}
+
+// Signature returns the base64 encoded HMAC-SHA512 of |body|.
+func (s *HmacSigner) Signature(body []byte) string {
+	h := hmac.New(sha512.New, s.Secret)
+	h.Write(body)
+	return base64.StdEncoding.EncodeToString(h.Sum())
+}
@@ -0,0 +1,118 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package restapi
+
+import (
+	"os"
+	"http"
+	"json"
+	"net"
+	"sync"
+)
+
+// StandIn is a local HTTP server standing in for the API of an exchange in the tests. The replies are scripted per API
+// function with Reply and ReplyOnce, and the requests are recorded, so that an API package can be tested end to end
+// without the exchange. The API functions are told apart by the path of their URL only,
+// so the clients of the exchanges are given the URL of the stand-in as their base URL.
+type StandIn struct {
+	URL string // URL of the server, e.g. "http://127.0.0.1:41234"
+
+	mu       sync.Mutex
+	replies  map[string]*reply        // Reply to the requests to each path
+	once     map[string][]*reply      // Replies used once (in order) before the reply of the path
+	calls    map[string][]http.Values // Query and form values of the requests to each path
+	listener net.Listener
+}
+
+// reply is a scripted HTTP response.
+type reply struct {
+	status int
+	body   []byte
+}
+
+// NewStandIn starts a stand-in server without any replies, listening on a free local port. The requests to the paths
+// without a reply get status 404 and an error message in the error envelope of the exchanges (see ReplyError).
+func NewStandIn() (*StandIn, os.Error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{URL: "http://" + l.Addr().String(), replies: make(map[string]*reply), once: make(map[string][]*reply),
+		calls: make(map[string][]http.Values), listener: l}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { s.serve(w, r) }))
+	return s, nil
+}
+
+// path returns the path of |url|, which is usually the path of the API function relative to the base URL of the exchange.
+func path(url string) string {
+	u, err := http.ParseURL(url)
+	if err != nil {
+		return url
+	}
+	return u.Path
+}
+
+func (s *StandIn) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	p := r.URL.Path
+	s.mu.Lock()
+	s.calls[p] = append(s.calls[p], r.Form)
+	rep := s.replies[p]
+	if q := s.once[p]; len(q) > 0 {
+		rep, s.once[p] = q[0], q[1:]
+	}
+	s.mu.Unlock()
+	if rep == nil {
+		b, _ := json.Marshal(map[string]string{"error": "no reply for " + p})
+		rep = &reply{404, b}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rep.status)
+	w.Write(rep.body)
+}
+
+// Reply sets the response to all the requests to the API function at |url| to |body| with HTTP status |status|.
+func (s *StandIn) Reply(url string, status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[path(url)] = &reply{status, []byte(body)}
+}
+
+// ReplyOnce is like Reply, but the response is used for the next request only. The responses queued for the same function
+// are used in order, and then the response set with Reply.
+func (s *StandIn) ReplyOnce(url string, status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := path(url)
+	s.once[p] = append(s.once[p], &reply{status, []byte(body)})
+}
+
+// ReplyJson is like Reply, but the response is |a| encoded as JSON with status 200.
+func (s *StandIn) ReplyJson(url string, a interface{}) os.Error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	s.Reply(url, 200, string(b))
+	return nil
+}
+
+// ReplyError makes the API function at |url| fail once with |message| in the error envelope of the exchanges
+// ({"error": message} with status 200, see xgen.ParseError).
+func (s *StandIn) ReplyError(url string, message string) {
+	b, _ := json.Marshal(map[string]string{"error": message})
+	s.ReplyOnce(url, 200, string(b))
+}
+
+// Calls returns the query and form values of the requests made to the API function at |url| so far.
+func (s *StandIn) Calls(url string) []http.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]http.Values(nil), s.calls[path(url)]...)
+}
+
+// Close stops the server.
+func (s *StandIn) Close() {
+	s.listener.Close()
+}
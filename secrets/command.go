@@ -0,0 +1,32 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package secrets
+
+import (
+	"exec"
+	"os"
+	"strings"
+)
+
+// Command is a Provider running an external program (e.g. a password manager) to get the secrets.
+// The name of the secret is given as the last argument, and the program prints the secret to the standard output.
+// Empty output means that the secret was not found.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// Secret runs the command for secret |name|.
+func (c *Command) Secret(name string) (string, os.Error) {
+	args := append(append([]string(nil), c.Args...), name)
+	out, err := exec.Command(c.Path, args...).Output()
+	if err != nil {
+		return "", os.NewError("secrets: " + c.Path + ": " + err.String())
+	}
+	s := strings.TrimRight(string(out), "\r\n")
+	if s == "" {
+		return "", ErrNotFound
+	}
+	return s, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package secrets
+
+import (
+	"os"
+	"strings"
+)
+
+// Env is a Provider reading the secrets from environment variables. The variable of secret "MtGox.Password"
+// is named PREFIX_MTGOX_PASSWORD, i.e. the name is upper cased and all other characters than letters and digits become underscores.
+type Env struct {
+	Prefix string // E.g. "ARBIT"
+}
+
+// Secret returns the value of the environment variable for secret |name|.
+func (e *Env) Secret(name string) (string, os.Error) {
+	s := os.Getenv(e.Variable(name))
+	if s == "" {
+		return "", ErrNotFound
+	}
+	return s, nil
+}
+
+// Variable returns the name of the environment variable for secret |name|.
+func (e *Env) Variable(name string) string {
+	v := strings.Map(func(c int) int {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		}
+		return '_'
+	}, name)
+	if e.Prefix != "" {
+		v = e.Prefix + "_" + v
+	}
+	return v
+}
@@ -0,0 +1,198 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"sort"
+)
+
+// PassphraseVar is the environment variable containing the passphrase of the keystore (used by package arbit and cmd/arbitkeys).
+const PassphraseVar = "ARBIT_PASSPHRASE"
+
+// Keystore is a Provider keeping the secrets in a local file encrypted with a passphrase.
+// The file is encrypted with AES-256 in CTR mode and authenticated with HMAC-SHA256,
+// using keys derived from the passphrase with PBKDF2 (see seal).
+type Keystore struct {
+	path       string
+	passphrase string
+	secrets    map[string]string
+}
+
+// OpenKeystore decrypts the keystore file |path|. If the file doesn't exist, an empty keystore is returned (and created by Save).
+func OpenKeystore(path string, passphrase string) (*Keystore, os.Error) {
+	if passphrase == "" {
+		return nil, os.NewError("secrets: empty keystore passphrase")
+	}
+	k := &Keystore{path, passphrase, make(map[string]string)}
+	b, err := ioutil.ReadFile(path)
+	if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(passphrase, b)
+	if err != nil {
+		return nil, os.NewError(path + ": " + err.String())
+	}
+	err = json.Unmarshal(plain, &k.secrets)
+	if err != nil {
+		return nil, os.NewError(path + ": " + err.String())
+	}
+	return k, nil
+}
+
+// Secret returns secret |name| from the keystore.
+func (k *Keystore) Secret(name string) (string, os.Error) {
+	s, ok := k.secrets[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return s, nil
+}
+
+// Set adds or replaces secret |name| (call Save to write the change to the file).
+func (k *Keystore) Set(name string, value string) {
+	k.secrets[name] = value
+}
+
+// Delete removes secret |name| (call Save to write the change to the file).
+func (k *Keystore) Delete(name string) {
+	k.secrets[name] = "", false
+}
+
+// Names returns the names of all the secrets in the keystore, in alphabetical order.
+func (k *Keystore) Names() (names []string) {
+	for name := range k.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Save encrypts the keystore and writes it to the file (readable by the owner only).
+func (k *Keystore) Save() os.Error {
+	plain, err := json.Marshal(k.secrets)
+	if err != nil {
+		return err
+	}
+	b, err := seal(k.passphrase, plain)
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// Iterations is the number of PBKDF2 iterations used when encrypting a keystore.
+const Iterations = 10000
+
+// The numbers of PBKDF2 iterations accepted from a keystore file: fewer would make the passphrase easy to guess, and more
+// would let a tampered file keep ArBit deriving the key for hours.
+const (
+	minIterations = 10000
+	maxIterations = 10000000
+)
+
+// sealed is the format of the keystore file.
+type sealed struct {
+	Iterations int
+	Salt       []byte
+	IV         []byte
+	Data       []byte // Encrypted JSON object of the secrets by name
+	MAC        []byte // HMAC-SHA256 of IV and Data
+}
+
+// seal encrypts |plain| with a key derived from |passphrase| and a random salt.
+func seal(passphrase string, plain []byte) ([]byte, os.Error) {
+	s := sealed{Iterations: Iterations, Salt: make([]byte, 16), IV: make([]byte, aes.BlockSize)}
+	_, err := io.ReadFull(rand.Reader, s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(rand.Reader, s.IV)
+	if err != nil {
+		return nil, err
+	}
+	key := pbkdf2([]byte(passphrase), s.Salt, s.Iterations, 64)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	s.Data = make([]byte, len(plain))
+	cipher.NewCTR(block, s.IV).XORKeyStream(s.Data, plain)
+	s.MAC = mac(key[32:], s.IV, s.Data)
+	return json.Marshal(s)
+}
+
+// unseal decrypts data encrypted by seal.
+func unseal(passphrase string, b []byte) ([]byte, os.Error) {
+	var s sealed
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.IV) != aes.BlockSize {
+		return nil, os.NewError("secrets: invalid keystore file")
+	}
+	if s.Iterations < minIterations || s.Iterations > maxIterations {
+		return nil, os.NewError(fmt.Sprint("secrets: invalid keystore file (", s.Iterations, " PBKDF2 iterations, want ",
+			minIterations, " to ", maxIterations, ")"))
+	}
+	key := pbkdf2([]byte(passphrase), s.Salt, s.Iterations, 64)
+	if subtle.ConstantTimeCompare(mac(key[32:], s.IV, s.Data), s.MAC) != 1 {
+		return nil, os.NewError("secrets: wrong passphrase or corrupted keystore")
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(s.Data))
+	cipher.NewCTR(block, s.IV).XORKeyStream(plain, s.Data)
+	return plain, nil
+}
+
+func mac(key []byte, iv []byte, data []byte) []byte {
+	h := hmac.NewSHA256(key)
+	h.Write(iv)
+	h.Write(data)
+	return h.Sum()
+}
+
+// pbkdf2 derives a key of |keyLen| bytes from |password| using PBKDF2 with HMAC-SHA256 (RFC 2898).
+func pbkdf2(password []byte, salt []byte, iter int, keyLen int) []byte {
+	prf := hmac.NewSHA256(password)
+	var dk []byte
+	for block := 1; len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum()
+		t := append([]byte(nil), u...)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum()
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
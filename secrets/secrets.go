@@ -0,0 +1,113 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package secrets implements providers for secret values such as the exchange credentials (environment variables,
+// an encrypted keystore file and external commands), and redacts the secrets handed out from logs and error messages.
+package secrets
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by a Provider that doesn't have the requested secret.
+var ErrNotFound = os.NewError("secrets: secret not found")
+
+// Provider is the interface implemented by all the sources of secrets.
+// Secrets are named by the exchange and the field, e.g. "MtGox.Password".
+type Provider interface {
+	Secret(name string) (string, os.Error)
+}
+
+// Chain is a Provider asking each provider in turn until one of them has the secret.
+type Chain []Provider
+
+// Secret returns the secret from the first provider that has it.
+func (c Chain) Secret(name string) (string, os.Error) {
+	for _, p := range c {
+		s, err := p.Secret(name)
+		if err != ErrNotFound {
+			return s, err
+		}
+	}
+	return "", ErrNotFound
+}
+
+// Get retrieves secret |name| from provider |p|, and registers the value to be redacted (see Redact).
+func Get(p Provider, name string) (string, os.Error) {
+	s, err := p.Secret(name)
+	if err != nil {
+		return "", os.NewError(name + ": " + err.String())
+	}
+	Register(s)
+	return s, nil
+}
+
+// MinLength is the length of the shortest secret redacted (shorter values would match too much of the ordinary text).
+const MinLength = 4
+
+const redacted = "[REDACTED]"
+
+var (
+	mu     sync.RWMutex
+	values []string // Longest first, so that a secret containing another one is redacted as a whole
+)
+
+// Register adds |value| to the secrets replaced by Redact.
+func Register(value string) {
+	if len(value) < MinLength {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		if v == value {
+			return
+		}
+	}
+	values = append(values, value)
+	sort.Sort(byLength(values))
+}
+
+// Save returns a function restoring the registered secrets to those registered now, for the tests registering
+// secrets of their own.
+func Save() (restore func()) {
+	mu.RLock()
+	saved := append([]string(nil), values...)
+	mu.RUnlock()
+	return func() {
+		mu.Lock()
+		values = saved
+		mu.Unlock()
+	}
+}
+
+// Redact replaces all the registered secrets in |s| with "[REDACTED]".
+func Redact(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, v := range values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
+
+// RedactError returns |err| with all the registered secrets removed from the error message.
+func RedactError(err os.Error) os.Error {
+	if err == nil {
+		return nil
+	}
+	s := err.String()
+	if r := Redact(s); r != s {
+		return os.NewError(r)
+	}
+	return err
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
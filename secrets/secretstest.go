@@ -0,0 +1,79 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package secrets
+
+import (
+	"os"
+	"fmt"
+	"json"
+)
+
+type pbkdf2Test struct {
+	password string
+	salt     string
+	iter     int
+	keyLen   int
+	out      string
+}
+
+var pbkdf2Tests = []pbkdf2Test{
+	{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+	{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+	{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+}
+
+// TestSecrets checks the key derivation, the keystore encryption, the environment variable names and the redaction.
+func TestSecrets() os.Error {
+	for _, pt := range pbkdf2Tests {
+		if v := fmt.Sprintf("%x", pbkdf2([]byte(pt.password), []byte(pt.salt), pt.iter, pt.keyLen)); v != pt.out {
+			return os.NewError(fmt.Sprint("pbkdf2(", pt.password, ", ", pt.salt, ", ", pt.iter, ")<br>=<br>", v, "<br>want<br>", pt.out))
+		}
+	}
+
+	b, err := seal("passphrase", []byte(`{"MtGox.Password":"secret"}`))
+	if err != nil {
+		return err
+	}
+	plain, err := unseal("passphrase", b)
+	if err != nil {
+		return err
+	}
+	if string(plain) != `{"MtGox.Password":"secret"}` {
+		return os.NewError("unseal(seal(x)) = " + string(plain))
+	}
+	if _, err = unseal("wrong passphrase", b); err == nil {
+		return os.NewError("unseal: wrong passphrase accepted")
+	}
+	for _, iter := range []int{1, 100000000} {
+		var s sealed
+		if err = json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		s.Iterations = iter
+		tampered, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err = unseal("passphrase", tampered); err == nil {
+			return os.NewError(fmt.Sprint("unseal: ", iter, " iterations accepted"))
+		}
+	}
+
+	if v := (&Env{"ARBIT"}).Variable("MtGox.Password"); v != "ARBIT_MTGOX_PASSWORD" {
+		return os.NewError("Env.Variable(MtGox.Password) = " + v + ", want ARBIT_MTGOX_PASSWORD")
+	}
+
+	// Test with an empty list of secrets, and restore the real secrets afterwards
+	defer Save()()
+	mu.Lock()
+	values = nil
+	mu.Unlock()
+	Register("hunter2")
+	Register("hunter2hunter2")
+	Register("abc") // Too short to be redacted
+	if s := Redact("pass=hunter2hunter2&name=abc&old=hunter2"); s != "pass=[REDACTED]&name=abc&old=[REDACTED]" {
+		return os.NewError("Redact = " + s)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package simex implements a simulated exchange for paper trading and testing, with its own matching engine,
+// balances, commissions and open orders.
+package simex
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"xgen"
+)
+
+// Exchange is a simulated exchange implementing the xgen.Exchange interface. The orders are matched against the order book
+// of the market the exchange simulates: an order crossing the book is filled at the prices of the book (partially, if there
+// is not enough volume), and the rest of it stays open until a later order book crosses its price, or it is canceled.
+// The fills change the balances, with the commission deducted from the currency received, and the funds of the open orders
+// are reserved (GetBalance returns the funds available for new orders, like the exchanges do).
+//
+// The order books are read from |Market| (e.g. the real exchange), or set with SetBook (e.g. replayed from stored data).
+// Since the real market never sees the simulated orders, the volume they have taken is removed from the later books
+// for as long as the price level stays in the book. The simulated orders are not shown in the order books.
+type Exchange struct {
+	Market     xgen.Exchange // Exchange the order books are read from (nil if they are only set with SetBook)
+	Commission xgen.Decimal  // Commission per trade, e.g. 0.006 for 0.6%
+	MinTrade   xgen.Balance  // Minimum order size by currency (no minimum if nil)
+
+	name     string
+	pairs    []xgen.Pair
+	mu       sync.Mutex
+	funds    xgen.Balance // Including the funds reserved for the open orders
+	reserved xgen.Balance
+	books    map[xgen.Pair]*book
+	open     map[string]*order // By order ID
+	fills    []Fill
+	seq      int
+}
+
+// book is the order book of a pair, with the volume taken by the simulated orders removed.
+type book struct {
+	xgen.OrderBook
+	takenAsks map[xgen.Decimal]xgen.Decimal // Amount taken by price
+	takenBids map[xgen.Decimal]xgen.Decimal
+	last      xgen.Decimal // Price of the last fill
+}
+
+type order struct {
+	oid      string
+	seq      int
+	pair     xgen.Pair
+	t        xgen.OrderType
+	date     int64
+	price    xgen.Decimal
+	amount   xgen.Decimal // Amount left to fill
+	reserved xgen.Decimal // Funds reserved for the amount left (in the quote currency for buy orders, in the base currency for sell orders)
+}
+
+// Fill is a full or partial execution of a simulated order.
+type Fill struct {
+	Date   int64 // Unix timestamp
+	Oid    string
+	Type   xgen.OrderType
+	Price  xgen.Decimal
+	Amount xgen.Decimal
+	Fee    xgen.Decimal // Commission in the currency received
+}
+
+// New returns a simulated exchange named |name| trading in |pairs|, with the starting balance |funds|.
+// The order books must be set with SetBook, unless |Market| is set.
+func New(name string, pairs []xgen.Pair, funds xgen.Balance) *Exchange {
+	return &Exchange{name: name, pairs: pairs, funds: funds.Copy(), reserved: make(xgen.Balance),
+		books: make(map[xgen.Pair]*book), open: make(map[string]*order)}
+}
+
+// Simulate returns a simulated exchange in place of |market|, with the same name and pairs and the order books of |market|,
+// starting with balance |funds| and charging |commission| per trade.
+func Simulate(market xgen.Exchange, funds xgen.Balance, commission xgen.Decimal) *Exchange {
+	e := New(market.Name(), market.Pairs(), funds)
+	e.Market = market
+	e.Commission = commission
+	return e
+}
+
+// Name returns the name of the exchange.
+func (e *Exchange) Name() string {
+	return e.name
+}
+
+// Pairs returns the trading pairs supported by the exchange.
+func (e *Exchange) Pairs() []xgen.Pair {
+	return e.pairs
+}
+
+// SetBook replaces the order book of |b.Pair|, and fills the open orders crossing it.
+func (e *Exchange) SetBook(b xgen.OrderBook) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.update(b)
+}
+
+// Fills returns the fills of the orders so far, oldest first.
+func (e *Exchange) Fills() []Fill {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Fill(nil), e.fills...)
+}
+
+// GetQuote returns the best bid and ask of the order book, and the price of the last fill (or the midpoint of the best bid and ask,
+// if nothing has been filled yet).
+func (e *Exchange) GetQuote(c xgen.Context, pair xgen.Pair) (q xgen.Quote, err os.Error) {
+	b, err := e.GetOrderBook(c, pair)
+	if err != nil {
+		return
+	}
+	q.Pair, q.Date = pair, time.Seconds()
+	if len(b.BuyTree) > 0 {
+		q.HighestBuy = b.BuyTree[0].Price
+	}
+	if len(b.SellTree) > 0 {
+		q.LowestSell = b.SellTree[0].Price
+	}
+	e.mu.Lock()
+	q.Last = e.books[pair].last
+	e.mu.Unlock()
+	if q.Last == 0 {
+		q.Last = (q.HighestBuy + q.LowestSell) / 2
+	}
+	return
+}
+
+// GetOrderBook reads the order book from the market (if any), fills the open orders crossing it, and returns the book.
+func (e *Exchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (xgen.OrderBook, os.Error) {
+	if e.Market != nil {
+		b, err := e.Market.GetOrderBook(c, pair)
+		if err != nil {
+			return xgen.OrderBook{}, err
+		}
+		e.SetBook(b)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, err := e.book(pair)
+	if err != nil {
+		return xgen.OrderBook{}, err
+	}
+	x := b.OrderBook
+	x.BuyTree = append([]xgen.Order(nil), b.BuyTree...)
+	x.SellTree = append([]xgen.Order(nil), b.SellTree...)
+	return x, nil
+}
+
+// GetBalance returns the funds available for new orders.
+func (e *Exchange) GetBalance(c xgen.Context) (xgen.Balance, os.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b := e.funds.Copy()
+	for cur, v := range e.reserved {
+		b[cur] -= v
+	}
+	return b, nil
+}
+
+// GetOpenOrders returns the orders of |pair| not filled yet.
+func (e *Exchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (xgen.OpenOrders, os.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	open := xgen.OpenOrders{pair, make(map[string]xgen.OpenOrder), make(map[string]xgen.OpenOrder)}
+	for oid, o := range e.open {
+		if o.pair != pair {
+			continue
+		}
+		if o.t == xgen.BuyOrder {
+			open.Buy[oid] = xgen.OpenOrder{o.date, o.price, o.amount}
+		} else {
+			open.Sell[oid] = xgen.OpenOrder{o.date, o.price, o.amount}
+		}
+	}
+	return open, nil
+}
+
+// CancelOrder cancels the open order |oid|, releasing its reserved funds.
+func (e *Exchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) os.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	o, ok := e.open[oid]
+	if !ok || o.pair != pair || o.t != orderType {
+		return &xgen.ExchangeError{e.name, xgen.UnknownOrder, "no such order: " + oid}
+	}
+	e.release(o)
+	e.open[oid] = nil, false
+	return nil
+}
+
+// Buy opens a buy order for |amount| at |price|.
+func (e *Exchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	return e.place(c, pair, xgen.BuyOrder, price, amount)
+}
+
+// Sell opens a sell order for |amount| at |price|.
+func (e *Exchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	return e.place(c, pair, xgen.SellOrder, price, amount)
+}
+
+// place opens an order of type |t|, filling it at once as far as it crosses the latest order book (read from the market, if any).
+func (e *Exchange) place(c xgen.Context, pair xgen.Pair, t xgen.OrderType, price xgen.Decimal, amount xgen.Decimal) os.Error {
+	if !xgen.Supports(e, pair) {
+		return &xgen.ExchangeError{e.name, xgen.UnknownError, "unsupported pair " + pair.String()}
+	}
+	if price <= 0 || amount <= 0 {
+		return &xgen.ExchangeError{e.name, xgen.UnknownError, "invalid price or amount"}
+	}
+	if amount < e.MinTrade[pair.Base] || price.Mul(amount) < e.MinTrade[pair.Quote] {
+		return &xgen.ExchangeError{e.name, xgen.BelowMinimum, "order is below the minimum size"}
+	}
+	if e.Market != nil {
+		if _, err := e.GetOrderBook(c, pair); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, err := e.book(pair)
+	if err != nil {
+		return err
+	}
+	cur, need := pair.Quote, price.Mul(amount)
+	if t == xgen.SellOrder {
+		cur, need = pair.Base, amount
+	}
+	if e.funds[cur]-e.reserved[cur] < need {
+		return &xgen.ExchangeError{e.name, xgen.InsufficientFunds, "insufficient funds"}
+	}
+	e.seq++
+	o := &order{strconv.Itoa(e.seq), e.seq, pair, t, time.Seconds(), price, amount, need}
+	e.reserved[cur] += need
+	e.match(b, o, false)
+	if o.amount > 0 {
+		e.open[o.oid] = o
+	}
+	return nil
+}
+
+// book returns the order book of |pair|. The caller must hold the lock.
+func (e *Exchange) book(pair xgen.Pair) (*book, os.Error) {
+	b, ok := e.books[pair]
+	if !ok {
+		return nil, &xgen.ExchangeError{e.name, xgen.Unavailable, "no order book for " + pair.String()}
+	}
+	return b, nil
+}
+
+// update replaces the order book of |x.Pair| with |x| (less the volume taken by the simulated orders), and matches the open orders
+// against it. The caller must hold the lock.
+func (e *Exchange) update(x xgen.OrderBook) {
+	b, ok := e.books[x.Pair]
+	if !ok {
+		b = &book{takenAsks: make(map[xgen.Decimal]xgen.Decimal), takenBids: make(map[xgen.Decimal]xgen.Decimal)}
+		e.books[x.Pair] = b
+	}
+	b.Pair = x.Pair
+	b.BuyTree = untaken(x.BuyTree, b.takenBids)
+	b.SellTree = untaken(x.SellTree, b.takenAsks)
+	sort.Sort(b.BuyTree)
+	sort.Sort(b.SellTree)
+	b.BuyTree.Reverse()
+
+	var open orders
+	for _, o := range e.open {
+		if o.pair == x.Pair {
+			open = append(open, o)
+		}
+	}
+	sort.Sort(open)
+	for _, o := range open {
+		e.match(b, o, true)
+		if o.amount == 0 {
+			e.open[o.oid] = nil, false
+		}
+	}
+}
+
+// untaken returns a copy of the price levels |levels| with the amounts in |taken| removed. The price levels no longer
+// in the book are removed from |taken|.
+func untaken(levels []xgen.Order, taken map[xgen.Decimal]xgen.Decimal) []xgen.Order {
+	list := make([]xgen.Order, 0, len(levels))
+	seen := make(map[xgen.Decimal]bool)
+	for _, l := range levels {
+		seen[l.Price] = true
+		l.Amount -= taken[l.Price]
+		if l.Amount > 0 {
+			list = append(list, l)
+		}
+	}
+	for price, _ := range taken {
+		if !seen[price] {
+			taken[price] = 0, false
+		}
+	}
+	return list
+}
+
+// match fills order |o| against the order book |b| as far as the prices cross. A new order (taker) is filled at the prices
+// of the book, while an open order (|maker|) is filled at its own price. The caller must hold the lock.
+func (e *Exchange) match(b *book, o *order, maker bool) {
+	levels, taken := b.SellTree, b.takenAsks
+	if o.t == xgen.SellOrder {
+		levels, taken = b.BuyTree, b.takenBids
+	}
+	for len(levels) > 0 && o.amount > 0 {
+		l := &levels[0]
+		if o.t == xgen.BuyOrder && l.Price > o.price || o.t == xgen.SellOrder && l.Price < o.price {
+			break
+		}
+		amount := o.amount
+		if l.Amount < amount {
+			amount = l.Amount
+		}
+		price := l.Price
+		if maker {
+			price = o.price
+		}
+		e.fill(b, o, price, amount)
+		taken[l.Price] += amount
+		l.Amount -= amount
+		if l.Amount == 0 {
+			levels = levels[1:]
+		}
+	}
+	if o.t == xgen.BuyOrder {
+		b.SellTree = levels
+	} else {
+		b.BuyTree = levels
+	}
+}
+
+// fill executes |amount| of order |o| at |price|, changing the balances. The caller must hold the lock.
+func (e *Exchange) fill(b *book, o *order, price xgen.Decimal, amount xgen.Decimal) {
+	base, quote := o.pair.Base, o.pair.Quote
+	value := price.Mul(amount)
+	f := Fill{time.Seconds(), o.oid, o.t, price, amount, 0}
+	var used xgen.Decimal // Reserved funds used by the fill
+	if o.t == xgen.BuyOrder {
+		f.Fee = amount.Mul(e.Commission)
+		e.funds[quote] -= value
+		e.funds[base] += amount - f.Fee
+		used = o.price.Mul(amount)
+	} else {
+		f.Fee = value.Mul(e.Commission)
+		e.funds[base] -= amount
+		e.funds[quote] += value - f.Fee
+		used = amount
+	}
+	o.amount -= amount
+	if used > o.reserved || o.amount == 0 {
+		used = o.reserved
+	}
+	o.reserved -= used
+	e.reserved[o.reservedCurrency()] -= used
+	b.last = price
+	e.fills = append(e.fills, f)
+}
+
+// release releases the funds reserved for order |o|. The caller must hold the lock.
+func (e *Exchange) release(o *order) {
+	e.reserved[o.reservedCurrency()] -= o.reserved
+	o.reserved = 0
+}
+
+func (o *order) reservedCurrency() xgen.Currency {
+	if o.t == xgen.BuyOrder {
+		return o.pair.Quote
+	}
+	return o.pair.Base
+}
+
+// orders sorts the open orders in the order they were placed.
+type orders []*order
+
+func (s orders) Len() int           { return len(s) }
+func (s orders) Less(i, j int) bool { return s[i].seq < s[j].seq }
+func (s orders) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,92 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package simex
+
+import (
+	"os"
+	"fmt"
+	"xgen"
+)
+
+func o(price, amount float64) xgen.Order {
+	return xgen.Order{xgen.NewDecimal(price), xgen.NewDecimal(amount)}
+}
+
+func b(btc, usd float64) xgen.Balance {
+	return xgen.Balance{xgen.BTC: xgen.NewDecimal(btc), xgen.USD: xgen.NewDecimal(usd)}
+}
+
+func checkBalance(e *Exchange, want xgen.Balance, step string) os.Error {
+	funds, _ := e.GetBalance(nil)
+	if funds[xgen.BTC] != want[xgen.BTC] || funds[xgen.USD] != want[xgen.USD] {
+		return os.NewError(fmt.Sprint("TestSimex: balance after ", step, "<br>=<br>", funds, "<br>want<br>", want))
+	}
+	return nil
+}
+
+// TestSimex checks the fills, partial fills, open orders and balances of a simulated exchange with 1% commission.
+func TestSimex() os.Error {
+	e := New("Sim", []xgen.Pair{xgen.BTCUSD}, b(0, 100))
+	e.Commission = xgen.NewDecimal(0.01)
+	e.SetBook(xgen.OrderBook{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(9, 3)}, SellTree: []xgen.Order{o(11, 5), o(10, 2)}})
+
+	// Buying 3 BTC for up to $10.50 takes the 2 BTC at $10, and the rest stays open (reserving $10.50)
+	err := e.Buy(nil, xgen.BTCUSD, xgen.NewDecimal(10.5), xgen.NewDecimal(3))
+	if err != nil {
+		return err
+	}
+	if err = checkBalance(e, b(1.98, 69.5), "a partial fill"); err != nil {
+		return err
+	}
+	book, _ := e.GetOrderBook(nil, xgen.BTCUSD)
+	if len(book.SellTree) != 1 || book.SellTree[0] != o(11, 5) {
+		return os.NewError(fmt.Sprint("TestSimex: asks after a fill<br>=<br>", book.SellTree, "<br>want<br>", o(11, 5)))
+	}
+
+	// The same book again doesn't fill anything, since the 2 BTC at $10 were taken already
+	e.SetBook(xgen.OrderBook{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(9, 3)}, SellTree: []xgen.Order{o(10, 2), o(11, 5)}})
+	if n := len(e.Fills()); n != 1 {
+		return os.NewError(fmt.Sprint("TestSimex: ", n, " fills after the same book again, want 1"))
+	}
+
+	// A new ask at $10.40 fills 0.5 BTC of the open order at its own price
+	e.SetBook(xgen.OrderBook{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{o(9, 3)}, SellTree: []xgen.Order{o(10.4, 0.5), o(11, 5)}})
+	open, _ := e.GetOpenOrders(nil, xgen.BTCUSD)
+	if len(open.Buy) != 1 || len(open.Sell) != 0 || open.Buy["1"].Amount != xgen.NewDecimal(0.5) {
+		return os.NewError(fmt.Sprint("TestSimex: open orders<br>=<br>", open, "<br>want a buy order for 0.5 BTC"))
+	}
+	if err = checkBalance(e, b(2.475, 69.5), "a fill of an open order"); err != nil {
+		return err
+	}
+
+	err = e.Sell(nil, xgen.BTCUSD, xgen.NewDecimal(8), xgen.NewDecimal(5))
+	if xgen.ClassOf(err) != xgen.InsufficientFunds {
+		return os.NewError(fmt.Sprint("TestSimex: selling more than the balance = ", err, ", want ", xgen.InsufficientFunds))
+	}
+
+	// Canceling releases the $5.25 reserved for the rest of the order
+	if err = e.CancelOrder(nil, xgen.BTCUSD, "1", xgen.BuyOrder); err != nil {
+		return err
+	}
+	if err = checkBalance(e, b(2.475, 74.75), "canceling"); err != nil {
+		return err
+	}
+	err = e.CancelOrder(nil, xgen.BTCUSD, "1", xgen.BuyOrder)
+	if xgen.ClassOf(err) != xgen.UnknownOrder {
+		return os.NewError(fmt.Sprint("TestSimex: canceling twice = ", err, ", want ", xgen.UnknownOrder))
+	}
+
+	// Selling 1 BTC for at least $8 is filled at the best bid of $9, less the commission
+	if err = e.Sell(nil, xgen.BTCUSD, xgen.NewDecimal(8), xgen.NewDecimal(1)); err != nil {
+		return err
+	}
+	if err = checkBalance(e, b(1.475, 83.66), "selling"); err != nil {
+		return err
+	}
+	q, _ := e.GetQuote(nil, xgen.BTCUSD)
+	if q.HighestBuy != xgen.NewDecimal(9) || q.LowestSell != xgen.NewDecimal(11) || q.Last != xgen.NewDecimal(9) {
+		return os.NewError(fmt.Sprint("TestSimex: quote<br>=<br>", q))
+	}
+	return nil
+}
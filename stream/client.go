@@ -0,0 +1,210 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package stream
+
+import (
+	"os"
+	"json"
+	"sync"
+	"time"
+	"websocket"
+	"xgen"
+	"restapi"
+)
+
+// Update is sent to the subscribers of a client whenever its order book changes, and for the other messages of the stream
+// (e.g. heartbeats), which tell that the book is still live. When the book goes out of sync (the connection is lost or
+// a message is missed), an update with Synced false and an empty book is sent, so that the book is no longer used.
+type Update struct {
+	Exchange string
+	Book     xgen.OrderBook
+	Seq      int64 // Sequence number of the last message applied to the book
+	Received int64 // Time the message was received in nanoseconds (see time.Nanoseconds)
+	Synced   bool
+}
+
+// Subscription receives the updates of a client. Only the latest update is kept for a slow subscriber,
+// since each update contains the whole order book.
+type Subscription struct {
+	C      <-chan Update
+	c      chan Update
+	client *Client
+}
+
+// Close stops the updates of the subscription.
+func (s *Subscription) Close() {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+	s.client.subs[s] = false, false
+}
+
+// Client keeps the order book of an exchange up to date from its market data stream, reconnecting after
+// connection failures and sequence gaps (with the backoff of |Retry|).
+type Client struct {
+	Exchange string
+	URL      string // E.g. "ws://localhost:8081/"
+	Origin   string // Origin of the websocket handshake
+	Retry    restapi.RetryPolicy
+
+	mu         sync.Mutex
+	book       Book
+	subs       map[*Subscription]bool
+	conn       *websocket.Conn
+	stop       chan bool
+	reconnects int
+	gaps       int
+}
+
+// NewClient returns a client for the stream of |exchange| at |url|. The client doesn't connect until Start is called.
+func NewClient(exchange string, url string) *Client {
+	return &Client{Exchange: exchange, URL: url, Origin: "http://localhost/", Retry: restapi.Retries,
+		subs: make(map[*Subscription]bool), stop: make(chan bool)}
+}
+
+// Start connects to the stream in the background, logging the connection failures to |c|.
+func (cl *Client) Start(c restapi.Context) {
+	go cl.run(c)
+}
+
+// Stop disconnects from the stream. The client cannot be started again.
+func (cl *Client) Stop() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	close(cl.stop)
+	if cl.conn != nil {
+		cl.conn.Close()
+	}
+}
+
+// Book returns the current order book, and whether it is in sync with the exchange.
+func (cl *Client) Book() (xgen.OrderBook, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.book.OrderBook(), cl.book.Synced
+}
+
+// Stats returns the number of times the client has reconnected to the stream, and the number of sequence gaps detected.
+func (cl *Client) Stats() (reconnects int, gaps int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.reconnects, cl.gaps
+}
+
+// Subscribe returns a subscription to the updates of the order book. If the book is in sync,
+// the current book is sent at once.
+func (cl *Client) Subscribe() *Subscription {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	c := make(chan Update, 1)
+	s := &Subscription{c, c, cl}
+	cl.subs[s] = true
+	if cl.book.Synced {
+		c <- cl.update(time.Nanoseconds())
+	}
+	return s
+}
+
+func (cl *Client) update(received int64) Update {
+	if !cl.book.Synced {
+		return Update{cl.Exchange, xgen.OrderBook{Pair: cl.book.Pair}, cl.book.Seq, received, false}
+	}
+	return Update{cl.Exchange, cl.book.OrderBook(), cl.book.Seq, received, true}
+}
+
+// publish sends the current book to the subscribers, replacing any update they haven't received yet.
+func (cl *Client) publish(received int64) {
+	u := cl.update(received)
+	for s, _ := range cl.subs {
+		select {
+		case <-s.c:
+		default:
+		}
+		s.c <- u // Only publish writes to the channel, so there is room after emptying it
+	}
+}
+
+func (cl *Client) stopped() bool {
+	select {
+	case <-cl.stop:
+		return true
+	default:
+	}
+	return false
+}
+
+// run reads the stream until the client is stopped, reconnecting after failures.
+func (cl *Client) run(c restapi.Context) {
+	for attempt := 1; ; attempt++ {
+		synced, err := cl.session()
+		if cl.stopped() {
+			return
+		}
+		if synced {
+			attempt = 1 // The connection worked, so start the backoff from the beginning
+		}
+		d := cl.Retry.Delay(attempt)
+		c.Warningf("%s: stream: %s (reconnecting in %d ms)", cl.Exchange, err, d/1e6)
+		select {
+		case <-cl.stop:
+			return
+		case <-time.After(d):
+		}
+		cl.mu.Lock()
+		cl.reconnects++
+		cl.mu.Unlock()
+	}
+}
+
+// session connects to the stream and applies its messages to the book until the connection fails or a message is missed.
+// It tells whether the book was synced during the session.
+func (cl *Client) session() (synced bool, err os.Error) {
+	ws, err := websocket.Dial(cl.URL, "", cl.Origin)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	cl.mu.Lock()
+	if cl.stopped() {
+		cl.mu.Unlock()
+		return false, os.NewError("stopped")
+	}
+	cl.conn = ws
+	cl.book = Book{} // Wait for the snapshot of the new connection
+	cl.mu.Unlock()
+
+	dec := json.NewDecoder(ws)
+	for {
+		var m Message
+		if err = dec.Decode(&m); err != nil {
+			cl.desync(synced)
+			return
+		}
+		received := time.Nanoseconds()
+		cl.mu.Lock()
+		err = cl.book.Apply(&m)
+		if _, ok := err.(*GapError); ok {
+			cl.gaps++
+		}
+		if err == nil && cl.book.Synced {
+			synced = true
+			cl.publish(received)
+		}
+		cl.mu.Unlock()
+		if err != nil {
+			cl.desync(synced)
+			return
+		}
+	}
+	panic("unreachable")
+}
+
+// desync marks the book out of sync after a session has ended, telling the subscribers if the book was synced during the session.
+func (cl *Client) desync(synced bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.book.Synced = false
+	if synced {
+		cl.publish(time.Nanoseconds())
+	}
+}
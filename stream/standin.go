@@ -0,0 +1,103 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package stream
+
+import (
+	"os"
+	"http"
+	"json"
+	"net"
+	"sync"
+	"websocket"
+	"xgen"
+)
+
+// StandIn is a local market data stream server standing in for an exchange in the tests. Each client gets
+// a snapshot of the order book when it connects, followed by the changes made with Depth and Trade.
+type StandIn struct {
+	URL string // URL of the stream, e.g. "ws://127.0.0.1:41234/"
+
+	mu       sync.Mutex
+	book     Book
+	conns    map[*websocket.Conn]*json.Encoder
+	listener net.Listener
+}
+
+// NewStandIn starts a stand-in server for |pair| with an empty order book, listening on a free local port.
+func NewStandIn(pair xgen.Pair) (*StandIn, os.Error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{URL: "ws://" + l.Addr().String() + "/", conns: make(map[*websocket.Conn]*json.Encoder), listener: l}
+	s.book.Apply(&Message{Type: "snapshot", Pair: pair.String()})
+	go http.Serve(l, websocket.Handler(s.serve))
+	return s, nil
+}
+
+func (s *StandIn) serve(ws *websocket.Conn) {
+	s.mu.Lock()
+	enc := json.NewEncoder(ws)
+	if enc.Encode(s.book.Snapshot()) != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.conns[ws] = enc
+	s.mu.Unlock()
+
+	// Wait until the client disconnects (the clients don't send anything)
+	b := make([]byte, 512)
+	for {
+		if _, err := ws.Read(b); err != nil {
+			break
+		}
+	}
+	s.mu.Lock()
+	s.conns[ws] = nil, false
+	s.mu.Unlock()
+}
+
+// send applies |m| to the book and sends it to the connected clients, numbering it with the next sequence number
+// (unless |skip| is set, in which case the message is lost on the way to simulate a gap in the stream).
+func (s *StandIn) send(m *Message, skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Seq = s.book.Seq + 1
+	s.book.Apply(m)
+	if skip {
+		return
+	}
+	for ws, enc := range s.conns {
+		if enc.Encode(m) != nil {
+			ws.Close()
+			s.conns[ws] = nil, false
+		}
+	}
+}
+
+// Depth sets the total amount of the orders at |price| on |side| (Ask or Bid) of the book. Zero removes the price level.
+func (s *StandIn) Depth(side string, price xgen.Decimal, amount xgen.Decimal) {
+	s.send(&Message{Type: "depth", Side: side, Price: price, Amount: amount}, false)
+}
+
+// Trade removes |amount| from the orders at |price| on |side| of the book.
+func (s *StandIn) Trade(side string, price xgen.Decimal, amount xgen.Decimal) {
+	s.send(&Message{Type: "trade", Side: side, Price: price, Amount: amount}, false)
+}
+
+// Lose is like Depth, but the message is never sent to the clients, so they will see a gap in the sequence numbers.
+func (s *StandIn) Lose(side string, price xgen.Decimal, amount xgen.Decimal) {
+	s.send(&Message{Type: "depth", Side: side, Price: price, Amount: amount}, true)
+}
+
+// Close stops the server and disconnects the clients.
+func (s *StandIn) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ws, _ := range s.conns {
+		ws.Close()
+		s.conns[ws] = nil, false
+	}
+}
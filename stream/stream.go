@@ -0,0 +1,139 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+// Package stream keeps live order books of the exchanges from their websocket market data streams, instead of
+// polling the order books once per run. A stream starts with a snapshot of the order book, followed by incremental
+// depth and trade messages numbered with consecutive sequence numbers. A missing message (a sequence gap) makes the book
+// invalid, so the client reconnects and starts again from a new snapshot.
+package stream
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"xgen"
+)
+
+// Message is a message of a market data stream, encoded as JSON.
+type Message struct {
+	Type   string            // "snapshot", "depth" or "trade" (other types, such as heartbeats, are ignored)
+	Seq    int64             // Sequence number, increasing by one for each message of the stream
+	Pair   string            // Trading pair of the snapshot, e.g. "BTC/USD"
+	Asks   [][2]xgen.Decimal // Snapshot: sell orders (price and amount)
+	Bids   [][2]xgen.Decimal // Snapshot: buy orders (price and amount)
+	Side   string            // Depth and trade: "ask" or "bid"
+	Price  xgen.Decimal      // Depth and trade: price level
+	Amount xgen.Decimal      // Depth: new total amount at the price (zero removes the level). Trade: amount traded at the price.
+}
+
+// Sides of the order book in messages.
+const (
+	Ask = "ask"
+	Bid = "bid"
+)
+
+// GapError is returned by Book.Apply when a message of the stream is missing.
+type GapError struct {
+	Want int64 // Sequence number expected
+	Got  int64
+}
+
+func (e *GapError) String() string {
+	return fmt.Sprint("stream: sequence gap (expected ", e.Want, ", got ", e.Got, ")")
+}
+
+// ErrNotSynced is returned by Book.Apply for incremental messages received before the first snapshot.
+var ErrNotSynced = os.NewError("stream: update before snapshot")
+
+// Book is an order book built from the messages of a stream. The zero value is an empty book waiting for a snapshot.
+type Book struct {
+	Pair   xgen.Pair
+	Seq    int64 // Sequence number of the last message applied
+	Synced bool  // A snapshot has been applied, and no message has been missed since
+	asks   map[xgen.Decimal]xgen.Decimal
+	bids   map[xgen.Decimal]xgen.Decimal
+}
+
+// Apply updates the book with message |m|. If a message has been missed, the book is no longer synced and a GapError is returned.
+func (b *Book) Apply(m *Message) os.Error {
+	switch m.Type {
+	case "snapshot":
+		pair, err := xgen.ParsePair(m.Pair)
+		if err != nil {
+			return err
+		}
+		b.Pair, b.Seq, b.Synced = pair, m.Seq, true
+		b.asks = levels(m.Asks)
+		b.bids = levels(m.Bids)
+		return nil
+	case "depth", "trade":
+	default:
+		return nil
+	}
+	if !b.Synced {
+		return ErrNotSynced
+	}
+	if m.Seq != b.Seq+1 {
+		b.Synced = false
+		return &GapError{b.Seq + 1, m.Seq}
+	}
+	side := b.bids
+	if m.Side == Ask {
+		side = b.asks
+	} else if m.Side != Bid {
+		return os.NewError("stream: invalid side " + m.Side)
+	}
+	amount := m.Amount
+	if m.Type == "trade" {
+		amount = side[m.Price] - m.Amount
+	}
+	if amount > 0 {
+		side[m.Price] = amount
+	} else {
+		side[m.Price] = 0, false
+	}
+	b.Seq = m.Seq
+	return nil
+}
+
+// OrderBook returns a copy of the book, with the bids from the highest price down and the asks from the lowest price up.
+func (b *Book) OrderBook() (x xgen.OrderBook) {
+	x.Pair = b.Pair
+	x.SellTree = orders(b.asks)
+	x.BuyTree = orders(b.bids)
+	sort.Sort(x.BuyTree)
+	sort.Sort(x.SellTree)
+	x.BuyTree.Reverse()
+	return
+}
+
+// Snapshot returns a snapshot message of the book (used by the stand-in server, see StandIn).
+func (b *Book) Snapshot() *Message {
+	x := b.OrderBook()
+	m := &Message{Type: "snapshot", Seq: b.Seq, Pair: b.Pair.String()}
+	for _, o := range x.SellTree {
+		m.Asks = append(m.Asks, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	for _, o := range x.BuyTree {
+		m.Bids = append(m.Bids, [2]xgen.Decimal{o.Price, o.Amount})
+	}
+	return m
+}
+
+func levels(list [][2]xgen.Decimal) map[xgen.Decimal]xgen.Decimal {
+	m := make(map[xgen.Decimal]xgen.Decimal)
+	for _, l := range list {
+		if l[1] > 0 {
+			m[l[0]] = l[1]
+		}
+	}
+	return m
+}
+
+func orders(m map[xgen.Decimal]xgen.Decimal) []xgen.Order {
+	list := make([]xgen.Order, 0, len(m))
+	for price, amount := range m {
+		list = append(list, xgen.Order{Price: price, Amount: amount})
+	}
+	return list
+}
@@ -0,0 +1,99 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package stream
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"xgen"
+	"restapi"
+)
+
+// next waits for an update of at least sequence number |seq|.
+func next(sub *Subscription, seq int64) (Update, os.Error) {
+	timeout := time.After(5e9)
+	for {
+		select {
+		case u := <-sub.C:
+			if u.Seq >= seq {
+				return u, nil
+			}
+		case <-timeout:
+			return Update{}, os.NewError(fmt.Sprint("stream: no update with sequence number ", seq, " in 5 seconds"))
+		}
+	}
+	panic("unreachable")
+}
+
+func d(s string) xgen.Decimal {
+	return xgen.MustDecimal(s)
+}
+
+// TestStream checks the order book updates and the gap detection, and a client following a stand-in server
+// through a lost message.
+func TestStream() os.Error {
+	var b Book
+	if err := b.Apply(&Message{Type: "depth", Seq: 1, Side: Ask, Price: d("10"), Amount: d("1")}); err != ErrNotSynced {
+		return os.NewError(fmt.Sprint("Book.Apply (before snapshot) = ", err))
+	}
+	msgs := []Message{
+		{Type: "snapshot", Seq: 5, Pair: "BTC/USD", Asks: [][2]xgen.Decimal{{d("10"), d("1")}, {d("11"), d("2")}}, Bids: [][2]xgen.Decimal{{d("9"), d("3")}}},
+		{Type: "depth", Seq: 6, Side: Bid, Price: d("9.5"), Amount: d("1")},
+		{Type: "trade", Seq: 7, Side: Ask, Price: d("10"), Amount: d("0.4")},
+		{Type: "depth", Seq: 8, Side: Ask, Price: d("11"), Amount: d("0")},
+		{Type: "heartbeat"},
+	}
+	for _, m := range msgs {
+		if err := b.Apply(&m); err != nil {
+			return err
+		}
+	}
+	x := b.OrderBook()
+	if s := fmt.Sprint(x.SellTree, x.BuyTree); s != "[{10 0.6}] [{9.5 1} {9 3}]" {
+		return os.NewError("Book.OrderBook = " + s + ", want [{10 0.6}] [{9.5 1} {9 3}]")
+	}
+	if err, ok := b.Apply(&Message{Type: "depth", Seq: 10, Side: Bid, Price: d("9"), Amount: d("1")}).(*GapError); !ok || err.Want != 9 || b.Synced {
+		return os.NewError(fmt.Sprint("Book.Apply (gap) = ", err))
+	}
+
+	s, err := NewStandIn(xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Depth(Ask, d("10"), d("1"))
+	s.Depth(Bid, d("9"), d("2"))
+	cl := NewClient("StandIn", s.URL)
+	cl.Retry = restapi.RetryPolicy{10, 10e6, 50e6}
+	sub := cl.Subscribe()
+	defer sub.Close()
+	cl.Start(restapi.TestContext{})
+	defer cl.Stop()
+
+	u, err := next(sub, 2) // Snapshot
+	if err != nil {
+		return err
+	}
+	s.Depth(Ask, d("11"), d("3"))
+	if u, err = next(sub, 3); err != nil {
+		return err
+	}
+	if len(u.Book.SellTree) != 2 || u.Book.SellTree[1].Price != d("11") {
+		return os.NewError(fmt.Sprint("Client: book = ", u.Book, " after depth update"))
+	}
+
+	s.Lose(Bid, d("9"), d("0"))
+	s.Depth(Bid, d("8"), d("1")) // Gap, so the client reconnects and gets a new snapshot
+	if u, err = next(sub, 5); err != nil {
+		return err
+	}
+	if !u.Synced || fmt.Sprint(u.Book.BuyTree) != "[{8 1}]" {
+		return os.NewError(fmt.Sprint("Client: bids = ", u.Book.BuyTree, " after resync, want [{8 1}]"))
+	}
+	if reconnects, gaps := cl.Stats(); reconnects != 1 || gaps != 1 {
+		return os.NewError(fmt.Sprint("Client.Stats = ", reconnects, " reconnects and ", gaps, " gaps, want 1 and 1"))
+	}
+	return nil
+}
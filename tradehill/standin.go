@@ -0,0 +1,94 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package tradehill
+
+import (
+	"os"
+	"http"
+	"restapi"
+	"xgen"
+	"strconv"
+)
+
+// StandIn is a local server standing in for the TradeHill API in the tests (see restapi.StandIn). The replies are set from
+// the types of package xgen, and served in the JSON shapes of the structs of this package.
+type StandIn struct {
+	*restapi.StandIn
+}
+
+// NewStandIn starts a stand-in for TradeHill with no open orders in the BTC/USD market. The market data and the balance
+// must be set before they are requested.
+func NewStandIn() (*StandIn, os.Error) {
+	rs, err := restapi.NewStandIn()
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{rs}
+	if err = s.SetOpenOrders(xgen.OpenOrders{Pair: xgen.BTCUSD}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetQuote sets the ticker of the market of |q.Pair| to |q|.
+func (s *StandIn) SetQuote(q xgen.Quote) os.Error {
+	return s.ReplyJson(path(JsonTicker, q.Pair), Quote{quote{Buy: q.HighestBuy.String(), Sell: q.LowestSell.String(),
+		Last: q.Last.String(), Last_when: "1 minute ago"}})
+}
+
+// formatOrders converts |orders| to the price and amount pairs of the order book.
+func formatOrders(orders []xgen.Order) (list [][2]string) {
+	for _, o := range orders {
+		list = append(list, [2]string{o.Price.String(), o.Amount.String()})
+	}
+	return
+}
+
+// SetBook sets the order book of the market of |b.Pair| to |b|.
+func (s *StandIn) SetBook(b xgen.OrderBook) os.Error {
+	return s.ReplyJson(path(JsonDepth, b.Pair), OrderBook{Asks: formatOrders(b.SellTree), Bids: formatOrders(b.BuyTree)})
+}
+
+// SetBalance sets the funds of the account to |b| (with nothing reserved for the open orders).
+func (s *StandIn) SetBalance(b xgen.Balance) os.Error {
+	usd, eur, btc := b[xgen.USD].String(), b[xgen.EUR].String(), b[xgen.BTC].String()
+	return s.ReplyJson(path(JsonBalance, xgen.BTCUSD), Balance{USD: usd, USD_Available: usd, USD_Reserved: "0E-10",
+		EUR: eur, EUR_Available: eur, EUR_Reserved: "0E-10", BTC: btc, BTC_Available: btc, BTC_Reserved: "0E-10"})
+}
+
+// SetOpenOrders sets the open orders in the market of |o.Pair| to |o|. The order ids must be integers. TradeHill returns
+// the open orders after placing and canceling an order too, so they are the reply of those functions as well.
+func (s *StandIn) SetOpenOrders(o xgen.OpenOrders) os.Error {
+	var h OpenOrders
+	add := func(orders map[string]xgen.OpenOrder, t int8, currency xgen.Currency) os.Error {
+		for oid, order := range orders {
+			n, err := strconv.Atoi64(oid)
+			if err != nil {
+				return err
+			}
+			h.Orders = append(h.Orders, openOrder{OrderType: t, Status: 1, Oid: n, Symbol: string(o.Pair.Base),
+				Price: order.Price.String(), Amount_orig: order.Amount.String(), Amount: order.Amount.String(),
+				Reserved_currency: string(currency), Date: order.Date})
+		}
+		return nil
+	}
+	if err := add(o.Sell, 1, o.Pair.Base); err != nil {
+		return err
+	}
+	if err := add(o.Buy, 2, o.Pair.Quote); err != nil {
+		return err
+	}
+	for _, format := range []string{JsonOrders, JsonBuy, JsonSell, JsonCancel} {
+		if err := s.ReplyJson(path(format, o.Pair), h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exchange returns a client of the stand-in logging in with |login|.
+func (s *StandIn) Exchange(login xgen.Credentials) *Exchange {
+	return &Exchange{Login: login, Client: restapi.Client{BaseURL: s.URL, Transport: http.DefaultTransport}}
+}
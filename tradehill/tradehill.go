@@ -4,22 +4,63 @@
 // Package tradehill implements functions for sending and receiving data via TradeHill API.
 package tradehill
 
+import (
+	"fmt"
+	"restapi"
+	"strings"
+	"xgen"
+)
+
 // TradeHill Trading API: https://www.tradehill.com/Support/TradingAPI/
 // Description of the data: http://bitcoincharts.com/about/exchanges/
+// The paths of the API functions are relative to the base URL of the API (DefaultURL unless configured otherwise).
+// They are format strings taking the quote currency of the market (e.g. "USD").
 const (
+	DefaultURL = "https://api.tradehill.com/APIv1"
+
 	// Public Market Data
-	JsonTicker = "https://api.tradehill.com/APIv1/USD/Ticker"
-	JsonDepth  = "https://api.tradehill.com/APIv1/USD/Orderbook"
-	JsonRecent = "https://api.tradehill.com/APIv1/USD/Trades"
+	JsonTicker = "/%s/Ticker"
+	JsonDepth  = "/%s/Orderbook"
+	JsonRecent = "/%s/Trades"
 
 	// Authenticated Trading Functions
-	JsonBalance = "https://api.tradehill.com/APIv1/USD/GetBalance"
-	JsonOrders  = "https://api.tradehill.com/APIv1/USD/GetOrders"
-	JsonBuy     = "https://api.tradehill.com/APIv1/USD/BuyBTC"
-	JsonSell    = "https://api.tradehill.com/APIv1/USD/SellBTC"
-	JsonCancel  = "https://api.tradehill.com/APIv1/USD/CancelOrder"
+	JsonBalance = "/%s/GetBalance"
+	JsonOrders  = "/%s/GetOrders"
+	JsonBuy     = "/%s/BuyBTC"
+	JsonSell    = "/%s/SellBTC"
+	JsonCancel  = "/%s/CancelOrder"
 )
 
+// Exchange implements the xgen.Exchange interface for TradeHill. The base URL, transport and middleware of the HTTP requests
+// are set in the embedded restapi.Client (DefaultURL is used if the base URL is empty).
+type Exchange struct {
+	Login xgen.Credentials
+	restapi.Client
+}
+
+// Name returns the name of the exchange.
+func (e *Exchange) Name() string {
+	return "TradeHill"
+}
+
+// Pairs returns the trading pairs supported by TradeHill.
+func (e *Exchange) Pairs() []xgen.Pair {
+	return []xgen.Pair{xgen.BTCUSD, {xgen.BTC, xgen.EUR}}
+}
+
+// path returns the path of the API function |format| for the market of the trading pair.
+func path(format string, pair xgen.Pair) string {
+	return fmt.Sprintf(format, pair.Quote)
+}
+
+// url returns the URL of the API function |format| for the market of the trading pair.
+func (e *Exchange) url(format string, pair xgen.Pair) string {
+	if e.BaseURL == "" {
+		return DefaultURL + path(format, pair)
+	}
+	return strings.TrimRight(e.BaseURL, "/") + path(format, pair)
+}
+
 type quote struct {
 	Buy       string
 	Sell      string
@@ -64,6 +105,9 @@ type Balance struct {
 	USD           string // Can be "0E-10" ?
 	USD_Available string
 	USD_Reserved  string
+	EUR           string
+	EUR_Available string
+	EUR_Reserved  string
 	BTC           string
 	BTC_Available string
 	BTC_Reserved  string
@@ -73,8 +117,8 @@ type openOrder struct {
 	OrderType         int8 `json:"type"` // 1 = Sell order, 2 = Buy order
 	Status            int8   // 1 = Active (which is the value for all returned order, any other value here indicates an error)
 	Oid               int64  // Unique order id
-	Symbol            string // Currency symbol (currently always "BTC")
-	Price             string // Limit price of the order (in USD)
+	Symbol            string // Currency symbol of the base currency (currently always "BTC")
+	Price             string // Limit price of the order (in the currency of the market)
 	Amount_orig       string // The original amount (size) of your order
 	Amount            string // The amount (size) of your order that remains to be filled (amount = amount_orig - amount filled)
 	Reserved_amount   string // The amount of money reserved in order to fill this order (includes estimated commissions)
@@ -4,73 +4,126 @@
 package tradehill
 
 import (
-	"appengine"
 	"os"
 	"restapi"
 	"xgen"
 	"strconv"
 	"sort"
-	"appengine/datastore"
 	"time"
 )
 
-func check(err os.Error) {
-	if err != nil {
-		panic(err)
-	}
+// wrap adds the exchange and the API endpoint |url| to the error in |err|, if any (see xgen.WrapError).
+func (e *Exchange) wrap(url string, err *os.Error) {
+	*err = xgen.WrapError(e.Name(), url, *err)
+}
+
+// errorPatterns classifies the error messages returned by TradeHill (see xgen.ParseError).
+var errorPatterns = []xgen.ErrorPattern{
+	{"smallest allowable transaction size", xgen.BelowMinimum}, // "The smallest allowable transaction size is 1.00 USD."
+	{"insufficient", xgen.InsufficientFunds},
+	{"not enough", xgen.InsufficientFunds},
+	{"password", xgen.AuthFailed},
+	{"login", xgen.AuthFailed},
+	{"too many requests", xgen.RateLimited},
+	{"order not found", xgen.UnknownOrder},
+	{"invalid order", xgen.UnknownOrder},
+	{"maintenance", xgen.Unavailable},
+}
+
+// apiError returns the error reported by TradeHill in the API response |b|, or nil if there is none.
+func (e *Exchange) apiError(b []byte) os.Error {
+	return xgen.ParseError(e.Name(), b, errorPatterns)
+}
+
+// get fetches public market data, waiting for the rate limit of the public API (see restapi.SetLimit).
+// Failed requests are retried (see restapi.Retry).
+func (e *Exchange) get(c xgen.Context, url string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		restapi.Wait(e.Name(), restapi.Public)
+		return restapi.GetJsonChecked(e.Context(c), url, e.apiError, a)
+	})
+}
+
+// query is like post, but failed requests are retried (see restapi.Retry), so it must only be used for reading account data.
+func (e *Exchange) query(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	return restapi.Retry(c, restapi.Retries, func() os.Error {
+		return e.post(c, url, data, a)
+	})
+}
+
+// post makes an authenticated API call, waiting for the rate limit of the authenticated API.
+// TradeHill only supports password authentication, so the username and password are sent in the form.
+func (e *Exchange) post(c xgen.Context, url string, data map[string][]string, a interface{}) os.Error {
+	restapi.Wait(e.Name(), restapi.Private)
+	data["name"] = []string{e.Login.Username}
+	data["pass"] = []string{e.Login.Password}
+	return restapi.PostJsonChecked(e.Context(c), url, data, nil, e.apiError, a)
 }
 
 // GetQuote retrieves the "ticker" data.
-func GetQuote(c appengine.Context) (x xgen.Quote, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetQuote(c xgen.Context, pair xgen.Pair) (x xgen.Quote, err os.Error) {
+	defer e.wrap(e.url(JsonTicker, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var q Quote
-	err = restapi.GetJson(c, JsonTicker, &q)
-	check(err)
-	x.Date = datastore.SecondsToTime(time.Seconds())
-	x.HighestBuy, err = strconv.Atof64(q.Ticker.Buy)
-	check(err)
-	x.LowestSell, err = strconv.Atof64(q.Ticker.Sell)
-	check(err)
-	x.Last, err = strconv.Atof64(q.Ticker.Last)
-	check(err)
+	err = e.get(c, e.url(JsonTicker, pair), &q)
+	if err != nil {
+		return
+	}
+	x.Pair = pair
+	x.Date = time.Seconds()
+	if x.HighestBuy, err = xgen.ParseDecimal(q.Ticker.Buy); err != nil {
+		return
+	}
+	if x.LowestSell, err = xgen.ParseDecimal(q.Ticker.Sell); err != nil {
+		return
+	}
+	if x.Last, err = xgen.ParseDecimal(q.Ticker.Last); err != nil {
+		return
+	}
 	if !x.Validate() {
-		panic("Invalid Ticker")
+		err = os.NewError("invalid ticker")
 	}
 	return
 }
 
-// GetOrderBook retrieves the limit order book.
-func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
+// parseOrders converts the price and amount pairs of the order book to orders.
+func parseOrders(list [][2]string) (orders []xgen.Order, err os.Error) {
+	for _, po := range list {
+		var o xgen.Order
+		if o.Price, err = xgen.ParseDecimal(po[Price]); err != nil {
+			return
+		}
+		if o.Amount, err = xgen.ParseDecimal(po[Amount]); err != nil {
+			return
 		}
-	}()
+		orders = append(orders, o)
+	}
+	return
+}
+
+// GetOrderBook retrieves the limit order book.
+func (e *Exchange) GetOrderBook(c xgen.Context, pair xgen.Pair) (x xgen.OrderBook, err os.Error) {
+	defer e.wrap(e.url(JsonDepth, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var b OrderBook
-	err = restapi.GetJson(c, JsonDepth, &b)
-	check(err)
-	for _, ask := range b.Asks {
-		var o xgen.Order
-		o.Price, err = strconv.Atof64(ask[Price])
-		check(err)
-		o.Amount, err = strconv.Atof64(ask[Amount])
-		check(err)
-		x.SellTree = append(x.SellTree, o)
+	err = e.get(c, e.url(JsonDepth, pair), &b)
+	if err != nil {
+		return
 	}
-	for _, bid := range b.Bids {
-		var o xgen.Order
-		o.Price, err = strconv.Atof64(bid[Price])
-		check(err)
-		o.Amount, err = strconv.Atof64(bid[Amount])
-		check(err)
-		x.BuyTree = append(x.BuyTree, o)
+	x.Pair = pair
+	if x.SellTree, err = parseOrders(b.Asks); err != nil {
+		return
+	}
+	if x.BuyTree, err = parseOrders(b.Bids); err != nil {
+		return
 	}
 	if !x.Validate() {
-		panic("Invalid Depth")
+		err = os.NewError("invalid depth")
+		return
 	}
 	sort.Sort(x.BuyTree)
 	sort.Sort(x.SellTree)
@@ -79,97 +132,107 @@ func GetOrderBook(c appengine.Context) (x xgen.OrderBook, err os.Error) {
 }
 
 // GetBalance retrieves the account balance.
-func GetBalance(c appengine.Context, login xgen.Credentials) (x xgen.Balance, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetBalance(c xgen.Context) (x xgen.Balance, err os.Error) {
+	defer e.wrap(e.url(JsonBalance, xgen.BTCUSD), &err)
 	var b Balance
-	err = restapi.PostJson(c, JsonBalance, map[string][]string{"name": {login.Username}, "pass": {login.Password}}, &b)
-	check(err)
-	x[xgen.BTC], err = strconv.Atof64(b.BTC)
-	check(err)
-	x[xgen.USD], err = strconv.Atof64(b.USD)
+	err = e.query(c, e.url(JsonBalance, xgen.BTCUSD), map[string][]string{}, &b)
+	if err != nil {
+		return
+	}
+	x = make(xgen.Balance)
+	if x[xgen.BTC], err = xgen.ParseDecimal(b.BTC); err != nil {
+		return
+	}
+	if x[xgen.USD], err = xgen.ParseDecimal(b.USD); err != nil {
+		return
+	}
+	if b.EUR != "" {
+		x[xgen.EUR], err = xgen.ParseDecimal(b.EUR)
+	}
 	return
 }
 
-func (h OpenOrders) convert() (o xgen.OpenOrders) { // Convert tradehill.OpenOrders to xgen.OpenOrders
-	var err os.Error
+func (h OpenOrders) convert(pair xgen.Pair) (o xgen.OpenOrders, err os.Error) { // Convert tradehill.OpenOrders (of the given trading pair) to xgen.OpenOrders
+	o.Pair = pair
 	o.Sell = make(map[string]xgen.OpenOrder)
 	o.Buy = make(map[string]xgen.OpenOrder)
 	for _, order := range h.Orders {
 		var t xgen.OpenOrder
 		t.Date = order.Date
-		t.Price, err = strconv.Atof64(order.Price)
-		check(err)
-		t.Amount, err = strconv.Atof64(order.Amount)
-		check(err)
+		if t.Price, err = xgen.ParseDecimal(order.Price); err != nil {
+			return
+		}
+		if t.Amount, err = xgen.ParseDecimal(order.Amount); err != nil {
+			return
+		}
 		if order.OrderType == 1 { // Sell order
 			o.Sell[strconv.Itoa64(order.Oid)] = t
 		} else if order.OrderType == 2 { // Buy order
 			o.Buy[strconv.Itoa64(order.Oid)] = t
 		} else {
-			panic("Invalid order type")
+			err = os.NewError("invalid order type " + strconv.Itoa(int(order.OrderType)))
+			return
 		}
 	}
 	return
 }
 
 // GetOpenOrders retrieves a list of all open orders.
-func GetOpenOrders(c appengine.Context, login xgen.Credentials) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+func (e *Exchange) GetOpenOrders(c xgen.Context, pair xgen.Pair) (x xgen.OpenOrders, err os.Error) {
+	defer e.wrap(e.url(JsonOrders, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonOrders, map[string][]string{"name": {login.Username}, "pass": {login.Password}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
-	return
+	err = e.query(c, e.url(JsonOrders, pair), map[string][]string{}, &openOrders)
+	if err != nil {
+		return
+	}
+	return openOrders.convert(pair)
 }
 
-// CancelOrder cancels an open order.
-func CancelOrder(c appengine.Context, login xgen.Credentials, oid string) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+// CancelOrder cancels an open order (TradeHill doesn't need to know the order type).
+func (e *Exchange) CancelOrder(c xgen.Context, pair xgen.Pair, oid string, orderType xgen.OrderType) (err os.Error) {
+	defer e.wrap(e.url(JsonCancel, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonCancel, map[string][]string{"name": {login.Username}, "pass": {login.Password}, "oid": {oid}}, &openOrders)
-	check(err)
-	x = openOrders.convert() // Note: Canceling an order may take up to 1 second. During that time the order is considered active and will be returned as active by GetOrders.
+	err = e.post(c, e.url(JsonCancel, pair), map[string][]string{"oid": {oid}}, &openOrders)
+	if err != nil {
+		return
+	}
+	_, err = openOrders.convert(pair) // Note: Canceling an order may take up to 1 second. During that time the order is considered active and will be returned as active by GetOrders.
 	return
 }
 
-// Buy opens a new order to buy BTC.
-func Buy(c appengine.Context, login xgen.Credentials, price float64, amount float64) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+// Buy opens a new order to buy BTC. The price and amount are rounded down to the scales of the currencies, so that
+// the order never costs more than the funds it was calculated for.
+func (e *Exchange) Buy(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonBuy, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonBuy, map[string][]string{"name": {login.Username}, "pass": {login.Password},
-		"price": {strconv.Ftoa64(price, 'f', -1)}, "amount": {strconv.Ftoa64(amount, 'f', -1)}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
+	err = e.post(c, e.url(JsonBuy, pair), map[string][]string{"price": {price.Trunc(pair.Quote.Scale()).String()}, "amount": {amount.Trunc(pair.Base.Scale()).String()}}, &openOrders)
+	if err != nil {
+		return
+	}
+	_, err = openOrders.convert(pair) // Checks that the returned orders are valid
 	return
 }
 
-// Sell opens a new order to sell BTC.
-func Sell(c appengine.Context, login xgen.Credentials, price float64, amount float64) (x xgen.OpenOrders, err os.Error) {
-	defer func() {
-		if e, ok := recover().(os.Error); ok {
-			err = e
-		}
-	}()
+// Sell opens a new order to sell BTC. The amount is rounded down to the scale of BTC, so that it never exceeds the funds.
+func (e *Exchange) Sell(c xgen.Context, pair xgen.Pair, price xgen.Decimal, amount xgen.Decimal) (err os.Error) {
+	defer e.wrap(e.url(JsonSell, pair), &err)
+	if err = xgen.CheckPair(e, pair); err != nil {
+		return
+	}
 	var openOrders OpenOrders
-	err = restapi.PostJson(c, JsonSell, map[string][]string{"name": {login.Username}, "pass": {login.Password},
-		"price": {strconv.Ftoa64(price, 'f', -1)}, "amount": {strconv.Ftoa64(amount, 'f', -1)}}, &openOrders)
-	check(err)
-	x = openOrders.convert()
+	err = e.post(c, e.url(JsonSell, pair), map[string][]string{"price": {price.Round(pair.Quote.Scale()).String()}, "amount": {amount.Trunc(pair.Base.Scale()).String()}}, &openOrders)
+	if err != nil {
+		return
+	}
+	_, err = openOrders.convert(pair) // Checks that the returned orders are valid
 	return
 }
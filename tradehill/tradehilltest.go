@@ -0,0 +1,116 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package tradehill
+
+import (
+	"os"
+	"fmt"
+	"restapi"
+	"xgen"
+)
+
+func d(f float64) xgen.Decimal {
+	return xgen.NewDecimal(f)
+}
+
+// TestTradeHill checks the API calls against a stand-in for TradeHill: the parsing of the replies, the requests made
+// to the market of each pair, the classification of the errors, and the retries of temporary failures.
+func TestTradeHill() os.Error {
+	savedRetries := restapi.Retries
+	restapi.Retries = restapi.RetryPolicy{3, 1e6, 1e6}
+	defer func() { restapi.Retries = savedRetries }()
+	s, err := NewStandIn()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c := restapi.NewTestContext()
+	e := s.Exchange(xgen.Credentials{Username: "user", Password: "pass"})
+	btceur := xgen.Pair{xgen.BTC, xgen.EUR}
+
+	// The markets are separate
+	if err = s.SetQuote(xgen.Quote{Pair: btceur, HighestBuy: d(7), LowestSell: d(7.5), Last: d(7.2)}); err != nil {
+		return err
+	}
+	q, err := e.GetQuote(c, btceur)
+	if err != nil {
+		return err
+	}
+	if q.HighestBuy != d(7) || q.LowestSell != d(7.5) || q.Last != d(7.2) {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetQuote<br>=<br>", q))
+	}
+	if _, err = e.GetQuote(c, xgen.BTCUSD); err == nil {
+		return os.NewError("TestTradeHill: GetQuote returned the quote of BTC/EUR for BTC/USD")
+	}
+
+	// The order book is sorted (best prices first), and a temporary failure is retried
+	err = s.SetBook(xgen.OrderBook{Pair: xgen.BTCUSD, BuyTree: []xgen.Order{{d(9), d(1)}, {d(10), d(2)}}, SellTree: []xgen.Order{{d(11), d(3)}, {d(10.5), d(4)}}})
+	if err != nil {
+		return err
+	}
+	s.ReplyError(path(JsonDepth, xgen.BTCUSD), "Down for maintenance")
+	b, err := e.GetOrderBook(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(b.BuyTree) != 2 || b.BuyTree[0] != (xgen.Order{d(10), d(2)}) || len(b.SellTree) != 2 || b.SellTree[0] != (xgen.Order{d(10.5), d(4)}) {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetOrderBook<br>=<br>", b))
+	}
+	if n := len(s.Calls(path(JsonDepth, xgen.BTCUSD))); n != 2 {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetOrderBook made ", n, " requests during maintenance, want 2"))
+	}
+
+	if err = s.SetBalance(xgen.Balance{xgen.BTC: d(1.5), xgen.USD: d(100)}); err != nil {
+		return err
+	}
+	funds, err := e.GetBalance(c)
+	if err != nil {
+		return err
+	}
+	if funds[xgen.BTC] != d(1.5) || funds[xgen.USD] != d(100) || funds[xgen.EUR] != 0 {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetBalance<br>=<br>", funds))
+	}
+	calls := s.Calls(path(JsonBalance, xgen.BTCUSD))
+	if calls[0].Get("name") != "user" || calls[0].Get("pass") != "pass" {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetBalance sent<br>", calls))
+	}
+
+	err = s.SetOpenOrders(xgen.OpenOrders{xgen.BTCUSD, nil, map[string]xgen.OpenOrder{"42": {1318000000, d(11), d(0.5)}}})
+	if err != nil {
+		return err
+	}
+	open, err := e.GetOpenOrders(c, xgen.BTCUSD)
+	if err != nil {
+		return err
+	}
+	if len(open.Buy) != 0 || len(open.Sell) != 1 || open.Sell["42"] != (xgen.OpenOrder{1318000000, d(11), d(0.5)}) {
+		return os.NewError(fmt.Sprint("TestTradeHill: GetOpenOrders<br>=<br>", open))
+	}
+
+	// The orders are sent with the rounded price and amount, and errors are classified
+	if err = e.Sell(c, xgen.BTCUSD, d(11), d(0.123456789)); err != nil {
+		return err
+	}
+	calls = s.Calls(path(JsonSell, xgen.BTCUSD))
+	if len(calls) != 1 || calls[0].Get("price") != "11" || calls[0].Get("amount") != "0.12345679" {
+		return os.NewError(fmt.Sprint("TestTradeHill: Sell sent<br>", calls))
+	}
+	s.ReplyError(path(JsonBuy, xgen.BTCUSD), "The smallest allowable transaction size is 1.00 USD.")
+	err = e.Buy(c, xgen.BTCUSD, d(10), d(0.01))
+	if xgen.ClassOf(err) != xgen.BelowMinimum || len(s.Calls(path(JsonBuy, xgen.BTCUSD))) != 1 {
+		return os.NewError(fmt.Sprint("TestTradeHill: Buy = ", err, ", want ", xgen.BelowMinimum, " without retries"))
+	}
+	if err = e.CancelOrder(c, xgen.BTCUSD, "42", xgen.SellOrder); err != nil {
+		return err
+	}
+	if calls = s.Calls(path(JsonCancel, xgen.BTCUSD)); calls[0].Get("oid") != "42" {
+		return os.NewError(fmt.Sprint("TestTradeHill: CancelOrder sent<br>", calls))
+	}
+
+	// Without a base URL, the client uses the real exchange
+	if url := (&Exchange{}).url(JsonDepth, btceur); url != "https://api.tradehill.com/APIv1/EUR/Orderbook" {
+		return os.NewError("TestTradeHill: default URL of JsonDepth " + url)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package xgen
+
+import (
+	"big"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Decimal is a fixed point number with 8 decimals (the precision of a satoshi, 1E-8 BTC), used for all monetary values.
+// Decimals can be added, subtracted and compared with the usual operators, but must be multiplied and divided with Mul and Div.
+type Decimal int64
+
+// DecimalPlaces is the number of decimals stored in a Decimal.
+const DecimalPlaces = 8
+
+// One is the Decimal representation of the number 1 (and Satoshi the smallest representable amount).
+const (
+	One     Decimal = 1e8
+	Satoshi Decimal = 1
+)
+
+var bigOne = big.NewInt(int64(One))
+
+// ParseDecimal converts a decimal number such as "12.345" (or "0E-10", as returned by TradeHill) to a Decimal.
+// Digits beyond the 8th decimal are rounded to the nearest satoshi.
+func ParseDecimal(s string) (d Decimal, err os.Error) {
+	invalid := os.NewError("xgen: invalid decimal number: " + strconv.Quote(s))
+	m, exp := strings.TrimSpace(s), 0
+	if i := strings.IndexAny(m, "eE"); i >= 0 {
+		exp, err = strconv.Atoi(m[i+1:])
+		if err != nil {
+			return 0, invalid
+		}
+		m = m[:i]
+	}
+	neg := strings.HasPrefix(m, "-")
+	if neg || strings.HasPrefix(m, "+") {
+		m = m[1:]
+	}
+	digits, decimals := m, 0
+	if i := strings.Index(m, "."); i >= 0 {
+		digits, decimals = m[:i]+m[i+1:], len(m)-i-1
+	}
+	if digits == "" || strings.IndexFunc(digits, func(c int) bool { return c < '0' || c > '9' }) >= 0 {
+		return 0, invalid
+	}
+	n, _ := new(big.Int).SetString(digits, 10)
+	if shift := DecimalPlaces + exp - decimals; shift >= 0 {
+		n.Mul(n, pow10(shift))
+	} else {
+		n = quo(n, pow10(-shift))
+	}
+	if neg {
+		n.Neg(n)
+	}
+	if n.BitLen() > 63 {
+		return 0, os.NewError("xgen: decimal number out of range: " + strconv.Quote(s))
+	}
+	return Decimal(n.Int64()), nil
+}
+
+// MustDecimal is like ParseDecimal but panics if |s| cannot be parsed. It is meant for constants and test data.
+func MustDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// NewDecimal converts a floating point number to a Decimal, rounding it to the nearest satoshi.
+func NewDecimal(f float64) Decimal {
+	if f < 0 {
+		return -Decimal(math.Floor(-f*float64(One) + 0.5))
+	}
+	return Decimal(math.Floor(f*float64(One) + 0.5))
+}
+
+// Float64 converts the Decimal to a floating point number (for display purposes only).
+func (d Decimal) Float64() float64 {
+	return float64(d) / float64(One)
+}
+
+// String formats the Decimal without trailing zeros, e.g. "12.345" or "4".
+func (d Decimal) String() string {
+	u := uint64(d)
+	if d < 0 {
+		u = uint64(-d)
+	}
+	s := strconv.Uitoa64(u / uint64(One))
+	if f := u % uint64(One); f != 0 {
+		fs := strconv.Uitoa64(f)
+		fs = strings.Repeat("0", DecimalPlaces-len(fs)) + fs
+		s += "." + strings.TrimRight(fs, "0")
+	}
+	if d < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// Mul returns d*e rounded to the nearest satoshi. It panics if the result is out of the range of a Decimal.
+func (d Decimal) Mul(e Decimal) Decimal {
+	n := new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(e)))
+	return decimal(quo(n, bigOne), "Mul")
+}
+
+// Div returns d/e rounded to the nearest satoshi. It panics if e is zero or the result is out of the range of a Decimal.
+func (d Decimal) Div(e Decimal) Decimal {
+	n := new(big.Int).Mul(big.NewInt(int64(d)), bigOne)
+	return decimal(quo(n, big.NewInt(int64(e))), "Div")
+}
+
+// DivTrunc returns d/e rounded towards zero (used for the amounts limited by funds, so that amount*price never exceeds
+// the funds). It panics like Div.
+func (d Decimal) DivTrunc(e Decimal) Decimal {
+	n := new(big.Int).Mul(big.NewInt(int64(d)), bigOne)
+	return decimal(n.Quo(n, big.NewInt(int64(e))), "DivTrunc")
+}
+
+// decimal converts the result |n| of operation |op| to a Decimal, panicking if it doesn't fit instead of wrapping around.
+func decimal(n *big.Int, op string) Decimal {
+	if n.BitLen() > 63 {
+		panic("xgen: decimal overflow in " + op)
+	}
+	return Decimal(n.Int64())
+}
+
+// Round rounds the Decimal to given number of decimals (e.g. to the scale of a currency, see Scale).
+func (d Decimal) Round(places int) Decimal {
+	if places >= DecimalPlaces {
+		return d
+	}
+	r := pow10(DecimalPlaces - places)
+	return Decimal(quo(big.NewInt(int64(d)), r).Int64() * r.Int64())
+}
+
+// Trunc truncates the Decimal to given number of decimals (rounding towards zero, so an amount never exceeds the funds).
+func (d Decimal) Trunc(places int) Decimal {
+	if places >= DecimalPlaces {
+		return d
+	}
+	r := Decimal(pow10(DecimalPlaces - places).Int64())
+	return d - d%r
+}
+
+// MarshalJSON encodes the Decimal as a JSON number.
+func (d Decimal) MarshalJSON() ([]byte, os.Error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON decodes a JSON number or a string containing a number (as used by most exchanges) to the Decimal.
+func (d *Decimal) UnmarshalJSON(b []byte) (err os.Error) {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	*d, err = ParseDecimal(s)
+	return
+}
+
+func pow10(n int) *big.Int {
+	p := big.NewInt(1)
+	ten := big.NewInt(10)
+	for i := 0; i < n; i++ {
+		p.Mul(p, ten)
+	}
+	return p
+}
+
+// quo returns x/y rounded to the nearest integer (halves are rounded away from zero).
+func quo(x *big.Int, y *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(x, y, new(big.Int))
+	r.Abs(r.Mul(r, big.NewInt(2)))
+	if r.Cmp(new(big.Int).Abs(y)) >= 0 {
+		if x.Sign()*y.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
@@ -0,0 +1,71 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package xgen
+
+import (
+	"os"
+	"fmt"
+	"strings"
+)
+
+var parseTests = []struct {
+	in  string
+	out string
+}{
+	{"12.345", "12.345"},
+	{"-0.5", "-0.5"},
+	{"4.000", "4"},
+	{"0E-10", "0"},
+	{"1.5e2", "150"},
+	{"0.000000015", "0.00000002"}, // Rounded to the nearest satoshi
+}
+
+// TestDecimal checks parsing, formatting and the arithmetic of Decimal.
+func TestDecimal() os.Error {
+	for _, pt := range parseTests {
+		d, err := ParseDecimal(pt.in)
+		if err != nil {
+			return err
+		}
+		if d.String() != pt.out {
+			return os.NewError(fmt.Sprint("ParseDecimal(", pt.in, ") = ", d, ", want ", pt.out))
+		}
+	}
+	if s := (MustDecimal("0.1") + MustDecimal("0.2")).String(); s != "0.3" {
+		return os.NewError("0.1 + 0.2 = " + s + ", want 0.3")
+	}
+	if s := MustDecimal("1.5").Div(MustDecimal("0.8")).String(); s != "1.875" {
+		return os.NewError("1.5 / 0.8 = " + s + ", want 1.875")
+	}
+	if s := MustDecimal("20").DivTrunc(MustDecimal("3")).String(); s != "6.66666666" {
+		return os.NewError("20 / 3 rounded towards zero = " + s + ", want 6.66666666")
+	}
+	if s := MustDecimal("20").Div(MustDecimal("3")).String(); s != "6.66666667" {
+		return os.NewError("20 / 3 = " + s + ", want 6.66666667")
+	}
+	if err := overflow(func() { MustDecimal("1000000000").Mul(MustDecimal("1000000000")) }); err != nil {
+		return err
+	}
+	if err := overflow(func() { MustDecimal("1000000000").Div(Satoshi) }); err != nil {
+		return err
+	}
+	if s := MustDecimal("12.34567").Mul(MustDecimal("0.994")).Round(USD.Scale()).String(); s != "12.2716" {
+		return os.NewError("12.34567 * 0.994 rounded to USD = " + s + ", want 12.2716")
+	}
+	return nil
+}
+
+// overflow returns an error unless |f| panics with a decimal overflow.
+func overflow(f func()) (err os.Error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, "xgen: decimal overflow") {
+				err = nil
+			}
+		}
+	}()
+	err = os.NewError("xgen: decimal overflow not detected")
+	f()
+	return
+}
@@ -0,0 +1,160 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package xgen
+
+import (
+	"os"
+	"json"
+	"strings"
+	"restapi"
+	"secrets"
+)
+
+// ErrorClass classifies the errors reported by the exchanges, so that the callers can react to them.
+type ErrorClass int
+
+// List of error classes.
+const (
+	UnknownError      ErrorClass = iota // Any other error reported by the exchange
+	InsufficientFunds                   // Not enough funds in the account for the order
+	BelowMinimum                        // Order is smaller than the minimum transaction size of the exchange
+	AuthFailed                          // Invalid credentials, nonce or signature
+	RateLimited                         // Too many requests
+	UnknownOrder                        // No such order (e.g. when canceling an order that was already filled)
+	Unavailable                         // Exchange is down or under maintenance
+)
+
+var errorClassNames = []string{"unknown error", "insufficient funds", "below minimum size", "authentication failed",
+	"rate limited", "unknown order", "exchange unavailable"}
+
+func (c ErrorClass) String() string {
+	if c < 0 || int(c) >= len(errorClassNames) {
+		return errorClassNames[UnknownError]
+	}
+	return errorClassNames[c]
+}
+
+// ExchangeError is an error reported by an exchange in its API response.
+type ExchangeError struct {
+	Exchange string
+	Class    ErrorClass
+	Message  string // As returned by the exchange (with any secrets redacted)
+}
+
+func (e *ExchangeError) String() string {
+	return e.Exchange + ": " + e.Message + " (" + e.Class.String() + ")"
+}
+
+// Temporary tells whether the request may succeed if it is repeated later (see restapi.Temporary).
+func (e *ExchangeError) Temporary() bool {
+	return e.Class == RateLimited || e.Class == Unavailable
+}
+
+// ClassOf returns the class of |err|, which is UnknownError unless |err| is an ExchangeError (possibly wrapped in a CallError).
+func ClassOf(err os.Error) ErrorClass {
+	if e, ok := Unwrap(err).(*ExchangeError); ok {
+		return e.Class
+	}
+	return UnknownError
+}
+
+// ErrorPattern maps the error messages of an exchange containing Substring (in any case) to Class.
+type ErrorPattern struct {
+	Substring string
+	Class     ErrorClass
+}
+
+// NewExchangeError returns the error for |message| reported by |exchange|, classified by the first matching pattern of |patterns|.
+func NewExchangeError(exchange string, message string, patterns []ErrorPattern) *ExchangeError {
+	message = secrets.Redact(message)
+	lower := strings.ToLower(message)
+	for _, p := range patterns {
+		if strings.Index(lower, strings.ToLower(p.Substring)) >= 0 {
+			return &ExchangeError{exchange, p.Class, message}
+		}
+	}
+	return &ExchangeError{exchange, UnknownError, message}
+}
+
+// ParseError returns the error reported in the API response |b| of |exchange| (classified by |patterns|),
+// or nil if the response is not an error. The exchanges report errors as a JSON object with an "error" (or "Error") string.
+func ParseError(exchange string, b []byte, patterns []ErrorPattern) os.Error {
+	var r struct {
+		Error string
+	}
+	if json.Unmarshal(b, &r) != nil || r.Error == "" {
+		return nil
+	}
+	return NewExchangeError(exchange, r.Error, patterns)
+}
+
+// CallError is an error of an API call with the context it happened in: the exchange, the API endpoint called,
+// and the phase of the run (e.g. "GetQuote" or "Execute trades"). The fields that are not known are empty.
+type CallError struct {
+	Phase    string
+	Exchange string
+	Endpoint string // URL of the API function
+	Err      os.Error
+}
+
+func (e *CallError) String() string {
+	s := ""
+	if e.Phase != "" {
+		s += e.Phase + ": "
+	}
+	if e.Exchange != "" {
+		s += e.Exchange + ": "
+	}
+	if e.Endpoint != "" {
+		s += e.Endpoint + ": "
+	}
+	return s + e.Err.String()
+}
+
+// Temporary tells whether the underlying error is temporary (see restapi.Temporary).
+func (e *CallError) Temporary() bool {
+	return restapi.Temporary(e.Err)
+}
+
+// WrapError adds the exchange and the API |endpoint| to |err|, unless it is nil. If |err| is a CallError already,
+// only the missing fields are filled in.
+func WrapError(exchange string, endpoint string, err os.Error) os.Error {
+	if err == nil {
+		return nil
+	}
+	e := &CallError{Exchange: exchange, Endpoint: endpoint, Err: err}
+	if ce, ok := err.(*CallError); ok {
+		*e = *ce
+		if e.Exchange == "" {
+			e.Exchange = exchange
+		}
+		if e.Endpoint == "" {
+			e.Endpoint = endpoint
+		}
+	}
+	return e
+}
+
+// InPhase adds |phase| to |err|, unless it is nil (see WrapError).
+func InPhase(phase string, err os.Error) os.Error {
+	if err == nil {
+		return nil
+	}
+	e := &CallError{Phase: phase, Err: err}
+	if ce, ok := err.(*CallError); ok {
+		*e = *ce
+		if e.Phase == "" {
+			e.Phase = phase
+		}
+	}
+	return e
+}
+
+// Unwrap returns the error wrapped in a CallError, or |err| itself if it is not a CallError.
+func Unwrap(err os.Error) os.Error {
+	if e, ok := err.(*CallError); ok {
+		return e.Err
+	}
+	return err
+}
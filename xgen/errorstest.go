@@ -0,0 +1,43 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package xgen
+
+import (
+	"os"
+	"fmt"
+)
+
+var errorPatterns = []ErrorPattern{
+	{"smallest allowable transaction size", BelowMinimum},
+	{"insufficient", InsufficientFunds},
+	{"too many requests", RateLimited},
+}
+
+var parseErrorTests = []struct {
+	in  string
+	out ErrorClass
+	ok  bool // An error is reported
+}{
+	{`{"error": "The smallest allowable transaction size is 1.00 USD."}`, BelowMinimum, true},
+	{`{"Error": "Insufficient funds"}`, InsufficientFunds, true},
+	{`{"error": "Too many requests, slow down"}`, RateLimited, true},
+	{`{"error": "Something else"}`, UnknownError, true},
+	{`{"error": ""}`, UnknownError, false},
+	{`{"usds": "10.5", "btcs": "1"}`, UnknownError, false},
+	{`[1, 2]`, UnknownError, false},
+}
+
+// TestErrors checks that the error responses of the exchanges are detected and classified.
+func TestErrors() os.Error {
+	for _, et := range parseErrorTests {
+		err := ParseError("Exch", []byte(et.in), errorPatterns)
+		if (err != nil) != et.ok || ClassOf(err) != et.out {
+			return os.NewError(fmt.Sprint("ParseError(", et.in, ") = ", err, ", want class ", et.out))
+		}
+	}
+	if e := NewExchangeError("Exch", "Too many requests", errorPatterns); !e.Temporary() {
+		return os.NewError("ExchangeError.Temporary: rate limited error is not temporary")
+	}
+	return nil
+}
@@ -4,16 +4,13 @@
 // Package xgen provides generic structures for storing data from various Bitcoin exchanges
 package xgen
 
-// TODO: Store monetary values as fixed points (instead of floating points), at least if native support gets added to Go
-
-import "appengine/datastore"
-
 // Quote is a struct representing the best available buy and sell prices at the time.
 type Quote struct {
-	Date       datastore.Time
-	HighestBuy float64
-	LowestSell float64
-	Last       float64
+	Pair       Pair
+	Date       int64 // Unix timestamp
+	HighestBuy Decimal
+	LowestSell Decimal
+	Last       Decimal
 }
 
 // Validate method checks that |Quote| values are valid (non-zero).
@@ -26,13 +23,14 @@ func (t Quote) Validate() bool {
 
 // Order is a struct representing a single limit order from the order book.
 type Order struct {
-	Price  float64 // Price per BTC
-	Amount float64 // Number of BTC
+	Price  Decimal // Price per unit of the base currency (e.g. USD per BTC)
+	Amount Decimal // Amount of the base currency (e.g. number of BTC)
 }
 type orders []Order
 
 // OrderBook is a struct representing a limit order book.
 type OrderBook struct {
+	Pair     Pair
 	BuyTree  orders // Bids
 	SellTree orders // Asks
 }
@@ -71,8 +69,8 @@ func (m OrderBook) Validate() bool {
 type Trade struct {
 	Date   int64   // Unix timestamp
 	Tid    int64   // Unique trade id
-	Price  float64 // Price in USD (or other currency)
-	Amount float64 // Amount of BTC
+	Price  Decimal // Price in USD (or other currency)
+	Amount Decimal // Amount of BTC
 }
 
 // UniqueKey is a method identifying the trade id, to be used as a key by the datastore.
@@ -0,0 +1,68 @@
+// Copyright 2011 Teppo Salonen. All rights reserved.
+// This file is part of ArBit and distributed under the terms of the MIT/X11 license.
+
+package xgen
+
+import (
+	"os"
+	"restapi"
+	"appdb"
+)
+
+// Context is the environment the exchanges are accessed in (an App Engine request or the standalone daemon).
+type Context interface {
+	restapi.Context
+	Store() appdb.Store // Storage for persistent data
+}
+
+// Exchange is the interface implemented by the API package of each Bitcoin exchange.
+type Exchange interface {
+	Name() string  // Unique name of the exchange, also used in the datastore kinds (e.g. "Ticker_MtGox")
+	Pairs() []Pair // Trading pairs supported by the exchange
+
+	// Public Market Data
+	GetQuote(c Context, pair Pair) (Quote, os.Error)
+	GetOrderBook(c Context, pair Pair) (OrderBook, os.Error)
+
+	// Authenticated Trading Functions (the exchanges retry the requests that are safe to repeat, but never CancelOrder, Buy or Sell)
+	GetBalance(c Context) (Balance, os.Error)
+	GetOpenOrders(c Context, pair Pair) (OpenOrders, os.Error)
+	CancelOrder(c Context, pair Pair, oid string, orderType OrderType) os.Error
+	Buy(c Context, pair Pair, price Decimal, amount Decimal) os.Error
+	Sell(c Context, pair Pair, price Decimal, amount Decimal) os.Error
+}
+
+// Supports tells whether exchange |x| trades in |pair|.
+func Supports(x Exchange, pair Pair) bool {
+	for _, p := range x.Pairs() {
+		if p == pair {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPair returns an error if exchange |x| does not trade in |pair|.
+func CheckPair(x Exchange, pair Pair) os.Error {
+	if !Supports(x, pair) {
+		return os.NewError(x.Name() + ": unsupported trading pair " + pair.String())
+	}
+	return nil
+}
+
+var exchanges []Exchange
+
+// Register makes an exchange available for arbitrage. Exchanges are used in the order they were registered.
+func Register(x Exchange) {
+	for _, e := range exchanges {
+		if e.Name() == x.Name() {
+			panic("xgen: Register called twice for exchange " + x.Name())
+		}
+	}
+	exchanges = append(exchanges, x)
+}
+
+// Exchanges returns all registered exchanges.
+func Exchanges() []Exchange {
+	return exchanges
+}
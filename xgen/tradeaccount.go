@@ -3,34 +3,100 @@
 
 package xgen
 
-// TODO: Store monetary values as fixed points (instead of floating points), at least if native support gets added to Go
+import (
+	"os"
+	"strings"
+)
+
+// Currency is a currency code, e.g. "BTC" or "USD".
+type Currency string
 
-// List of currencies.
+// List of well-known currencies (any other currency code can be used as well).
 const (
-	BTC = iota
-	USD
+	BTC Currency = "BTC"
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+	JPY Currency = "JPY"
+)
+
+// Scales contains the number of decimals each currency is traded in (e.g. Mt Gox stores USD prices as integers times 1E5, and JPY times 1E3).
+var Scales = map[Currency]int{BTC: 8, USD: 5, EUR: 5, JPY: 3}
+
+// Scale returns the number of decimals the currency is traded in (the full precision of Decimal for unknown currencies).
+func (c Currency) Scale() int {
+	if s, ok := Scales[c]; ok {
+		return s
+	}
+	return DecimalPlaces
+}
+
+// Pair is a trading pair, e.g. BTC/USD for buying and selling BTC (the base currency) with prices quoted in USD.
+type Pair struct {
+	Base  Currency
+	Quote Currency
+}
 
-	NumCurrencies
+// BTCUSD is the trading pair all the exchanges originally supported.
+var BTCUSD = Pair{BTC, USD}
+
+// String formats the pair as "BTC/USD".
+func (p Pair) String() string {
+	return string(p.Base) + "/" + string(p.Quote)
+}
+
+// ParsePair converts a string such as "BTC/USD" to a Pair.
+func ParsePair(s string) (p Pair, err os.Error) {
+	c := strings.Split(s, "/")
+	if len(c) != 2 || c[0] == "" || c[1] == "" || c[0] == c[1] {
+		return p, os.NewError("xgen: invalid trading pair: " + s)
+	}
+	return Pair{Currency(strings.ToUpper(c[0])), Currency(strings.ToUpper(c[1]))}, nil
+}
+
+// OrderType tells whether an order is a buy or a sell order.
+type OrderType int8
+
+// List of order types.
+const (
+	BuyOrder OrderType = iota
+	SellOrder
 )
 
-// Credentials stores the username and password for the account.
+// Credentials stores the login for the account: either the username and password, or an API key and its secret.
 type Credentials struct {
 	Username string
 	Password string
+	Key      string // API key (used instead of the password by the exchanges supporting signed requests)
+	Secret   string // API secret, in the encoding the exchange gives it in (e.g. base64 for Mt Gox)
 }
 
-// Balance contains the amount of each currency in the account.
-type Balance [NumCurrencies]float64
+// HasKey tells whether the credentials contain an API key for signing the requests.
+func (c Credentials) HasKey() bool {
+	return c.Key != "" && c.Secret != ""
+}
+
+// Balance contains the amount of each currency in the account (currencies not in the map have zero balance).
+type Balance map[Currency]Decimal
+
+// Copy returns a copy of the balance, which can be modified without changing the original.
+func (b Balance) Copy() Balance {
+	c := make(Balance, len(b))
+	for k, v := range b {
+		c[k] = v
+	}
+	return c
+}
 
 // OpenOrder contains basic information of an order.
 type OpenOrder struct {
 	Date   int64   // Timestamp for when the order was created
-	Price  float64 // Price per BTC (usually in USD)
-	Amount float64 // Amount of BTC
+	Price  Decimal // Price per unit of the base currency (e.g. USD per BTC)
+	Amount Decimal // Amount of the base currency (e.g. BTC)
 }
 
 // OpenOrders is a struct representing all our open buy and sell orders in the account.
 type OpenOrders struct {
+	Pair Pair
 	Buy  map[string]OpenOrder // Each order has a unique ID, used as the map key
 	Sell map[string]OpenOrder // Some exchanges don't use integers for the Order ID's, therefore using string instead
 }